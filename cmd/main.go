@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	"k8s.io/klog"
 
@@ -39,6 +40,18 @@ func init() {
 	flag.StringVar(&conf.DriverName, "drivername", driverName, "Name of the driver")
 	flag.StringVar(&conf.Endpoint, "endpoint", "unix://tmp/spdkcsi.sock", "CSI endpoint")
 	flag.StringVar(&conf.NodeID, "nodeid", "", "node id")
+	flag.StringVar(&conf.MetricsEndpoint, "metrics-endpoint", "", "Address to serve prometheus metrics on, e.g. :9090 (disabled if empty)")
+	flag.Float64Var(&conf.APIBudget.QPS, "api-qps", util.DefaultRequestBudget.QPS, "Requests per second to each cluster API for CSI operations (0 is unlimited)")
+	flag.IntVar(&conf.APIBudget.Burst, "api-burst", util.DefaultRequestBudget.Burst, "Request burst to each cluster API for CSI operations")
+	flag.IntVar(&conf.APIBudget.MaxInFlight, "api-max-inflight", util.DefaultRequestBudget.MaxInFlight, "Concurrent requests to each cluster API for CSI operations (0 is unlimited)")
+	flag.Float64Var(&conf.MonitorAPIBudget.QPS, "monitor-api-qps", util.DefaultMonitorRequestBudget.QPS, "Requests per second to each cluster API for the connection monitor (0 is unlimited)")
+	flag.IntVar(&conf.MonitorAPIBudget.Burst, "monitor-api-burst", util.DefaultMonitorRequestBudget.Burst, "Request burst to each cluster API for the connection monitor")
+	flag.IntVar(&conf.MonitorAPIBudget.MaxInFlight, "monitor-api-max-inflight", util.DefaultMonitorRequestBudget.MaxInFlight, "Concurrent requests to each cluster API for the connection monitor (0 is unlimited)")
+	flag.StringVar(&conf.KubeletDir, "kubelet-dir", "/var/lib/kubelet", "Kubelet root directory, scanned for staged volumes when the node server starts")
+	flag.StringVar(&conf.StateDir, "state-dir", "/var/lib/spdkcsi", "Node directory for state kept across restarts, e.g. the NVMe host identity")
+	flag.DurationVar(&conf.OrphanGCInterval, "orphan-gc-interval", 5*time.Minute, "Interval to look for NVMe-oF connections no staged volume uses (0 disables)")
+	flag.DurationVar(&conf.OrphanGCGracePeriod, "orphan-gc-grace-period", 10*time.Minute, "Time an orphan connection is kept before it is disconnected")
+	flag.BoolVar(&conf.OrphanGCDryRun, "orphan-gc-dry-run", false, "Only report orphan connections, do not disconnect them")
 	flag.BoolVar(&conf.IsControllerServer, "controller", false, "Start controller server")
 	flag.BoolVar(&conf.IsNodeServer, "node", false, "Start node server")
 
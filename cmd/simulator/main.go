@@ -0,0 +1,101 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// simulator serves an in-memory SimplyBlock management API for local
+// development and offline tests of the CSI driver.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/simulator"
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+var (
+	listen       = flag.String("listen", "127.0.0.1:8080", "Address to serve the management API on")
+	clusterID    = flag.String("cluster-id", "00000000-0000-4000-8000-000000000000", "ID of the simulated cluster")
+	secret       = flag.String("secret", "simulator", "Cluster secret required on requests")
+	pools        = flag.String("pools", "pool01", "Comma separated list of pools to create")
+	poolSize     = flag.Int64("pool-size", 100<<30, "Capacity of each pool in bytes")
+	storageNodes = flag.String("storage-nodes", "", "Comma separated list of IPs of additional storage nodes")
+	latency      = flag.Duration("latency", 0, "Delay added to every request")
+	errorRate    = flag.Float64("error-rate", 0, "Fraction (0..1) of requests failing with HTTP 500")
+	secretFile   = flag.String("secret-file", "", "Write a CSI driver secret.json for the simulator to this file")
+)
+
+func main() {
+	klog.InitFlags(nil)
+	if err := flag.Set("logtostderr", "true"); err != nil {
+		klog.Exitf("failed to set logtostderr flag: %v", err)
+	}
+	flag.Parse()
+
+	sim := simulator.New(*clusterID, *secret)
+	// the simulator always starts with one storage node on 127.0.0.1
+	for _, ip := range strings.Split(*storageNodes, ",") {
+		if ip != "" {
+			sim.AddStorageNode(ip)
+		}
+	}
+	for _, name := range strings.Split(*pools, ",") {
+		if name != "" {
+			sim.AddPool(name, *poolSize)
+		}
+	}
+	sim.SetLatency(*latency)
+	sim.SetErrorRate(*errorRate)
+
+	if *secretFile != "" {
+		if err := writeSecretFile(*secretFile); err != nil {
+			klog.Exitf("failed to write secret file: %v", err)
+		}
+		klog.Infof("wrote CSI secret for the simulator to %s, use it with SPDKCSI_SECRET=%s", *secretFile, *secretFile)
+	}
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           sim,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	klog.Infof("SimplyBlock API simulator for cluster %s listening on %s", *clusterID, *listen)
+	if err := server.ListenAndServe(); err != nil {
+		klog.Exitf("simulator stopped: %v", err)
+	}
+}
+
+func writeSecretFile(fileName string) error {
+	clusters := util.ClustersInfo{
+		Clusters: []util.ClusterConfig{{
+			ClusterID:       *clusterID,
+			ClusterEndpoint: fmt.Sprintf("http://%s", *listen),
+			ClusterSecret:   *secret,
+		}},
+	}
+	data, err := json.MarshalIndent(clusters, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0o600)
+}
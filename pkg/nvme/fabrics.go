@@ -0,0 +1,205 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nvme controls NVMe over Fabrics connections of the host through
+// the kernel interfaces nvme-cli uses: connecting by writing to
+// /dev/nvme-fabrics, disconnecting through sysfs and reading subsystems,
+// controllers and ANA states from /sys/class/nvme-subsystem.
+package nvme
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"k8s.io/klog"
+)
+
+// ErrAlreadyConnected is returned by Connect when a controller with the same
+// transport address and NQN exists
+var ErrAlreadyConnected = errors.New("nvme: already connected")
+
+// Fabrics is the NVMe-oF control interface of the host
+type Fabrics struct {
+	// SysfsRoot is the sysfs mount point, /sys
+	SysfsRoot string
+	// FabricsDevice is the fabrics control device, /dev/nvme-fabrics
+	FabricsDevice string
+
+	// openFabrics opens FabricsDevice, replaced by tests
+	openFabrics func(name string) (io.ReadWriteCloser, error)
+}
+
+// New returns the Fabrics of the host
+func New() *Fabrics {
+	return &Fabrics{
+		SysfsRoot:     "/sys",
+		FabricsDevice: "/dev/nvme-fabrics",
+	}
+}
+
+// ConnectOptions are the options of a fabrics connect, zero values are left
+// to the kernel defaults
+type ConnectOptions struct {
+	Transport string // tcp or rdma
+	TrAddr    string
+	TrSvcID   string
+	NQN       string
+
+	HostNQN string
+	HostID  string
+
+	CtrlLossTmo    int // seconds, -1 retries forever
+	ReconnectDelay int // seconds
+	FastIOFailTmo  int // seconds, -1 disables
+	KeepAliveTmo   int // seconds
+	NrIOQueues     int
+
+	// DH-HMAC-CHAP secrets in DHHC-1 format, the controller secret enables
+	// bidirectional authentication
+	DHChapSecret     string
+	DHChapCtrlSecret string
+	// TLS encrypts NVMe/TCP, with the PSK TLSKey from the kernel keyring
+	TLS    bool
+	TLSKey int
+}
+
+// String formats the options for logging, without the secrets
+func (o *ConnectOptions) String() string {
+	return o.format(true)
+}
+
+// format formats the options the way the fabrics device expects them
+func (o *ConnectOptions) format(redact bool) string {
+	opts := []string{
+		"transport=" + strings.ToLower(o.Transport),
+		"traddr=" + o.TrAddr,
+		"nqn=" + o.NQN,
+	}
+	if o.TrSvcID != "" {
+		opts = append(opts, "trsvcid="+o.TrSvcID)
+	}
+	if o.HostNQN != "" {
+		opts = append(opts, "hostnqn="+o.HostNQN)
+	}
+	if o.HostID != "" {
+		opts = append(opts, "hostid="+o.HostID)
+	}
+	for _, opt := range []struct {
+		key   string
+		value int
+	}{
+		{"nr_io_queues", o.NrIOQueues},
+		{"reconnect_delay", o.ReconnectDelay},
+		{"ctrl_loss_tmo", o.CtrlLossTmo},
+		{"fast_io_fail_tmo", o.FastIOFailTmo},
+		{"keep_alive_tmo", o.KeepAliveTmo},
+	} {
+		if opt.value != 0 {
+			opts = append(opts, fmt.Sprintf("%s=%d", opt.key, opt.value))
+		}
+	}
+	for _, opt := range []struct {
+		key    string
+		secret string
+	}{
+		{"dhchap_secret", o.DHChapSecret},
+		{"dhchap_ctrl_secret", o.DHChapCtrlSecret},
+	} {
+		switch {
+		case opt.secret == "":
+		case redact:
+			opts = append(opts, opt.key+"=<redacted>")
+		default:
+			opts = append(opts, opt.key+"="+opt.secret)
+		}
+	}
+	if o.TLS {
+		opts = append(opts, "tls")
+		if o.TLSKey != 0 {
+			opts = append(opts, "tls_key="+strconv.Itoa(o.TLSKey))
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// Connect creates a controller and returns its name, e.g. nvme3
+func (f *Fabrics) Connect(opts *ConnectOptions) (string, error) {
+	open := f.openFabrics
+	if open == nil {
+		open = func(name string) (io.ReadWriteCloser, error) {
+			return os.OpenFile(name, os.O_RDWR, 0)
+		}
+	}
+	dev, err := open(f.FabricsDevice)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", f.FabricsDevice, err)
+	}
+	defer dev.Close()
+
+	klog.Infof("nvme connect: %s", opts)
+	if _, err = io.WriteString(dev, opts.format(false)); err != nil {
+		if errors.Is(err, syscall.EALREADY) {
+			return "", fmt.Errorf("%w: %s at %s:%s", ErrAlreadyConnected, opts.NQN, opts.TrAddr, opts.TrSvcID)
+		}
+		return "", fmt.Errorf("failed to connect %s at %s:%s: %w", opts.NQN, opts.TrAddr, opts.TrSvcID, err)
+	}
+
+	buf := make([]byte, 256)
+	n, err := dev.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to read connect result: %w", err)
+	}
+	instance, err := parseConnectResult(string(buf[:n]))
+	if err != nil {
+		return "", err
+	}
+	return "nvme" + strconv.Itoa(instance), nil
+}
+
+// parseConnectResult parses "instance=3,cntlid=1" and returns the instance
+func parseConnectResult(result string) (int, error) {
+	for _, token := range strings.Split(strings.TrimSpace(result), ",") {
+		key, value, _ := strings.Cut(token, "=")
+		if key == "instance" {
+			instance, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, fmt.Errorf("invalid connect result %q: %w", result, err)
+			}
+			return instance, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid connect result %q", result)
+}
+
+// Disconnect deletes a controller, a controller that is gone already is
+// not an error
+func (f *Fabrics) Disconnect(controller string) error {
+	deleteFile := f.sysfs("class", "nvme", controller, "delete_controller")
+	if _, err := os.Stat(deleteFile); os.IsNotExist(err) {
+		klog.Warningf("nvme controller %s already deleted", controller)
+		return nil
+	}
+	klog.Infof("nvme disconnect: %s", controller)
+	if err := os.WriteFile(deleteFile, []byte("1"), 0o200); err != nil {
+		return fmt.Errorf("failed to delete controller %s: %w", controller, err)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvme
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const (
+	testNQN    = "nqn.2023-02.io.simplyblock:cluster1:lvol:lvol1"
+	testNSUUID = "5e2a4d1c-8f3b-4c6a-9d2e-7b1f0a3c4d5e"
+)
+
+// fakeController creates controller ctrl of subsystem subsys in a fake sysfs
+// tree, with namespace path nvme<X>c<Y>n1 in the given ANA state
+func fakeController(t *testing.T, root, subsys, ctrl, address, state, anaState string) {
+	t.Helper()
+	ctrlDir := filepath.Join(root, "class", "nvme", ctrl)
+	mustWrite(t, filepath.Join(ctrlDir, "transport"), "tcp\n")
+	mustWrite(t, filepath.Join(ctrlDir, "address"), address+"\n")
+	mustWrite(t, filepath.Join(ctrlDir, "state"), state+"\n")
+	mustWrite(t, filepath.Join(ctrlDir, "delete_controller"), "")
+	mustWrite(t, filepath.Join(ctrlDir, "nvme0c"+ctrl[len("nvme"):]+"n1", "ana_state"), anaState+"\n")
+	if err := os.MkdirAll(filepath.Join(root, "class", "nvme-subsystem", subsys, ctrl), 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeSysfs creates subsystem nvme-subsys0 with namespace nvme0n1 reachable
+// through an optimized and a non-optimized controller
+func fakeSysfs(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	subsysDir := filepath.Join(root, "class", "nvme-subsystem", "nvme-subsys0")
+	mustWrite(t, filepath.Join(subsysDir, "subsysnqn"), testNQN+"\n")
+	mustWrite(t, filepath.Join(subsysDir, "model"), "lvol1\n")
+	mustWrite(t, filepath.Join(subsysDir, "serial"), "ha\n")
+	mustWrite(t, filepath.Join(subsysDir, "nvme0n1", "size"), "2048\n")
+	mustWrite(t, filepath.Join(subsysDir, "nvme0n1", "nsid"), "1\n")
+	mustWrite(t, filepath.Join(subsysDir, "nvme0n1", "uuid"), testNSUUID+"\n")
+	fakeController(t, root, "nvme-subsys0", "nvme0", "traddr=10.0.0.1,trsvcid=4420", "live", "optimized")
+	fakeController(t, root, "nvme-subsys0", "nvme1", "traddr=10.0.0.2,trsvcid=4420,src_addr=10.0.1.1", "connecting", "non-optimized")
+	return root
+}
+
+func mustWrite(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubsystems(t *testing.T) {
+	f := &Fabrics{SysfsRoot: fakeSysfs(t)}
+
+	subsystems, err := f.Subsystems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subsystems) != 1 {
+		t.Fatalf("found %d subsystems, want 1", len(subsystems))
+	}
+	subsys := subsystems[0]
+	if subsys.NQN != testNQN || subsys.Model != "lvol1" || subsys.Serial != "ha" {
+		t.Errorf("unexpected subsystem %+v", subsys)
+	}
+	if len(subsys.Namespaces) != 1 || subsys.Namespaces[0] != "nvme0n1" {
+		t.Errorf("unexpected namespaces %v", subsys.Namespaces)
+	}
+	want := []Path{
+		{Controller: "nvme0", Transport: "tcp", Address: "traddr=10.0.0.1,trsvcid=4420", TrAddr: "10.0.0.1", TrSvcID: "4420", State: "live", ANAState: "optimized"},
+		{Controller: "nvme1", Transport: "tcp", Address: "traddr=10.0.0.2,trsvcid=4420,src_addr=10.0.1.1", TrAddr: "10.0.0.2", TrSvcID: "4420", State: "connecting", ANAState: "non-optimized"},
+	}
+	if len(subsys.Paths) != len(want) {
+		t.Fatalf("found %d paths, want %d", len(subsys.Paths), len(want))
+	}
+	for i := range want {
+		if subsys.Paths[i] != want[i] {
+			t.Errorf("path %d: got %+v, want %+v", i, subsys.Paths[i], want[i])
+		}
+	}
+
+	connected, err := f.IsConnected(testNQN)
+	if err != nil || !connected {
+		t.Errorf("IsConnected(%s) = %v, %v", testNQN, connected, err)
+	}
+	connected, err = f.IsConnected("nqn.2023-02.io.simplyblock:cluster1:lvol:other")
+	if err != nil || connected {
+		t.Errorf("IsConnected(other) = %v, %v", connected, err)
+	}
+}
+
+func TestSubsystemsSkipsUnreadable(t *testing.T) {
+	root := fakeSysfs(t)
+	f := &Fabrics{SysfsRoot: root}
+	// a subsystem removed while it is listed leaves a dangling link
+	if err := os.Symlink(filepath.Join(root, "devices", "gone"), filepath.Join(root, "class", "nvme-subsystem", "nvme-subsys1")); err != nil {
+		t.Fatal(err)
+	}
+
+	subsystems, err := f.Subsystems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subsystems) != 1 || subsystems[0].NQN != testNQN {
+		t.Fatalf("unexpected subsystems %+v", subsystems)
+	}
+}
+
+func TestSubsystemForDevice(t *testing.T) {
+	f := &Fabrics{SysfsRoot: fakeSysfs(t)}
+
+	dev := t.TempDir()
+	devicePath := filepath.Join(dev, "nvme0n1")
+	mustWrite(t, devicePath, "")
+	link := filepath.Join(dev, "nvme-lvol1_1")
+	if err := os.Symlink(devicePath, link); err != nil {
+		t.Fatal(err)
+	}
+
+	subsys, err := f.SubsystemForDevice(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subsys.NQN != testNQN {
+		t.Errorf("got subsystem %s, want %s", subsys.NQN, testNQN)
+	}
+
+	other := filepath.Join(dev, "nvme5n1")
+	mustWrite(t, other, "")
+	if _, err := f.SubsystemForDevice(other); err == nil {
+		t.Error("device of unknown subsystem should fail")
+	}
+}
+
+func TestRDMAAvailable(t *testing.T) {
+	root := t.TempDir()
+	f := &Fabrics{SysfsRoot: root}
+	if f.RDMAAvailable() {
+		t.Error("RDMA available without devices")
+	}
+	if err := os.MkdirAll(filepath.Join(root, "class", "infiniband", "mlx5_0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if !f.RDMAAvailable() {
+		t.Error("RDMA device not found")
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	root := fakeSysfs(t)
+	f := &Fabrics{SysfsRoot: root}
+	subsys, err := f.SubsystemByNQN(testNQN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := f.Namespace(subsys, 1, strings.ToUpper(testNSUUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Name != "nvme0n1" || ns.NSID != 1 || ns.UUID != testNSUUID || ns.DevicePath() != "/dev/nvme0n1" {
+		t.Errorf("unexpected namespace %+v", ns)
+	}
+	if _, err := f.Namespace(subsys, 1, "00000000-1111-2222-3333-444444444444"); !errors.Is(err, ErrNamespaceMismatch) {
+		t.Errorf("namespace with other UUID: %v", err)
+	}
+	if _, err := f.Namespace(subsys, 2, ""); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Errorf("unknown NSID: %v", err)
+	}
+
+	// without native multipath the namespace is a child of the controller
+	if err := os.Rename(filepath.Join(root, "class", "nvme-subsystem", "nvme-subsys0", "nvme0n1"), filepath.Join(root, "class", "nvme", "nvme0", "nvme0n1")); err != nil {
+		t.Fatal(err)
+	}
+	if subsys, err = f.SubsystemByNQN(testNQN); err != nil {
+		t.Fatal(err)
+	}
+	if ns, err := f.Namespace(subsys, 1, testNSUUID); err != nil || ns.Name != "nvme0n1" {
+		t.Errorf("namespace of controller %+v, %v", ns, err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	root := fakeSysfs(t)
+	f := &Fabrics{SysfsRoot: root}
+
+	if err := f.Disconnect("nvme1"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "class", "nvme", "nvme1", "delete_controller"))
+	if err != nil || string(data) != "1" {
+		t.Errorf("controller not deleted: %q %v", data, err)
+	}
+	if err := f.Disconnect("nvme7"); err != nil {
+		t.Errorf("disconnecting a deleted controller should succeed: %v", err)
+	}
+}
+
+// fakeFabricsDevice records the options written and answers with result,
+// or fails the write with err
+type fakeFabricsDevice struct {
+	written bytes.Buffer
+	result  string
+	err     error
+}
+
+func (d *fakeFabricsDevice) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.written.Write(p)
+}
+
+func (d *fakeFabricsDevice) Read(p []byte) (int, error) {
+	return copy(p, d.result), nil
+}
+
+func (d *fakeFabricsDevice) Close() error { return nil }
+
+func TestConnect(t *testing.T) {
+	dev := &fakeFabricsDevice{result: "instance=3,cntlid=1\n"}
+	f := &Fabrics{openFabrics: func(string) (io.ReadWriteCloser, error) { return dev, nil }}
+
+	ctrl, err := f.Connect(&ConnectOptions{
+		Transport:      "TCP",
+		TrAddr:         "10.0.0.1",
+		TrSvcID:        "4420",
+		NQN:            testNQN,
+		CtrlLossTmo:    -1,
+		ReconnectDelay: 2,
+		NrIOQueues:     4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctrl != "nvme3" {
+		t.Errorf("got controller %s, want nvme3", ctrl)
+	}
+	want := "transport=tcp,traddr=10.0.0.1,nqn=" + testNQN + ",trsvcid=4420,nr_io_queues=4,reconnect_delay=2,ctrl_loss_tmo=-1"
+	if dev.written.String() != want {
+		t.Errorf("wrote %q, want %q", dev.written.String(), want)
+	}
+
+	dev = &fakeFabricsDevice{result: "instance=4,cntlid=2"}
+	opts := &ConnectOptions{
+		Transport:        "tcp",
+		TrAddr:           "10.0.0.1",
+		NQN:              testNQN,
+		HostNQN:          "nqn.2014-08.org.nvmexpress:uuid:host1",
+		DHChapSecret:     "DHHC-1:00:host:",
+		DHChapCtrlSecret: "DHHC-1:00:ctrl:",
+		TLS:              true,
+		TLSKey:           42,
+	}
+	if _, err := f.Connect(opts); err != nil {
+		t.Fatal(err)
+	}
+	want = "transport=tcp,traddr=10.0.0.1,nqn=" + testNQN + ",hostnqn=nqn.2014-08.org.nvmexpress:uuid:host1" +
+		",dhchap_secret=DHHC-1:00:host:,dhchap_ctrl_secret=DHHC-1:00:ctrl:,tls,tls_key=42"
+	if dev.written.String() != want {
+		t.Errorf("wrote %q, want %q", dev.written.String(), want)
+	}
+	if strings.Contains(opts.String(), "DHHC-1") {
+		t.Errorf("secrets not redacted in %s", opts)
+	}
+
+	dev = &fakeFabricsDevice{err: &os.PathError{Op: "write", Path: "/dev/nvme-fabrics", Err: syscall.EALREADY}}
+	if _, err := f.Connect(&ConnectOptions{Transport: "tcp", TrAddr: "10.0.0.1", NQN: testNQN}); !errors.Is(err, ErrAlreadyConnected) {
+		t.Errorf("duplicate connect returned %v, want ErrAlreadyConnected", err)
+	}
+
+	dev = &fakeFabricsDevice{result: "garbage"}
+	if _, err := f.Connect(&ConnectOptions{Transport: "tcp", TrAddr: "10.0.0.1", NQN: testNQN}); err == nil {
+		t.Error("invalid connect result should fail")
+	}
+}
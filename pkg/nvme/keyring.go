@@ -0,0 +1,103 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvme
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const pskPrefix = "NVMeTLSkey-1:"
+
+// InsertTLSKey adds a configured PSK in interchange format,
+// NVMeTLSkey-1:<hash>:<base64 key and crc>:, to the user keyring as key of
+// type psk, described by the TLS identity of host and subsystem. It returns
+// the key serial to connect with. Needs the nvme_keyring module.
+func InsertTLSKey(hostNQN, subsysNQN, psk string) (int, error) {
+	if hostNQN == "" {
+		return 0, errors.New("a TLS PSK needs a host NQN")
+	}
+	key, hash, err := parsePSK(psk)
+	if err != nil {
+		return 0, err
+	}
+	// a key of the same identity is updated
+	serial, err := unix.AddKey("psk", tlsIdentity(hash, hostNQN, subsysNQN), key, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add TLS PSK for %s to the keyring: %w", subsysNQN, err)
+	}
+	return serial, nil
+}
+
+// RemoveTLSKey unlinks the PSKs InsertTLSKey added for host and subsystem
+// from the user keyring, keys that are not found are ignored
+func RemoveTLSKey(hostNQN, subsysNQN string) error {
+	for _, hash := range []int{1, 2} {
+		serial, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "psk", tlsIdentity(hash, hostNQN, subsysNQN), 0)
+		if errors.Is(err, unix.ENOKEY) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to find TLS PSK for %s in the keyring: %w", subsysNQN, err)
+		}
+		if _, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, serial, unix.KEY_SPEC_USER_KEYRING, 0, 0); err != nil && !errors.Is(err, unix.ENOKEY) {
+			return fmt.Errorf("failed to remove TLS PSK for %s from the keyring: %w", subsysNQN, err)
+		}
+	}
+	return nil
+}
+
+// tlsIdentity is the description of a PSK, the TLS PSK identity of host and
+// subsystem
+func tlsIdentity(hash int, hostNQN, subsysNQN string) string {
+	return fmt.Sprintf("NVMe0R%02d %s %s", hash, hostNQN, subsysNQN)
+}
+
+// parsePSK decodes a PSK in interchange format, returns the key and the
+// hash of its TLS cipher suite, 1 for SHA-256 and 2 for SHA-384
+func parsePSK(psk string) (key []byte, hash int, err error) {
+	if !strings.HasPrefix(psk, pskPrefix) {
+		return nil, 0, fmt.Errorf("TLS PSK does not start with %s", pskPrefix)
+	}
+	fields := strings.Split(strings.TrimPrefix(psk, pskPrefix), ":")
+	if len(fields) != 3 || fields[2] != "" {
+		return nil, 0, errors.New("TLS PSK is not in NVMeTLSkey-1:<hash>:<key>: format")
+	}
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid TLS PSK encoding: %w", err)
+	}
+
+	key = data[:max(len(data)-4, 0)]
+	switch len(key) {
+	case 32:
+		hash = 1
+	case 48:
+		hash = 2
+	default:
+		return nil, 0, fmt.Errorf("invalid TLS PSK length %d", len(key))
+	}
+	if crc32.ChecksumIEEE(key) != binary.LittleEndian.Uint32(data[len(key):]) {
+		return nil, 0, errors.New("TLS PSK checksum mismatch")
+	}
+	return key, hash, nil
+}
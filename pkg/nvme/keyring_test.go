@@ -0,0 +1,57 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvme
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func interchangePSK(key []byte) string {
+	data := binary.LittleEndian.AppendUint32(append([]byte{}, key...), crc32.ChecksumIEEE(key))
+	return "NVMeTLSkey-1:01:" + base64.StdEncoding.EncodeToString(data) + ":"
+}
+
+func TestParsePSK(t *testing.T) {
+	for _, size := range []int{32, 48} {
+		key := bytes.Repeat([]byte{0x5a}, size)
+		parsed, hash, err := parsePSK(interchangePSK(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parsed, key) || hash != size/16-1 {
+			t.Errorf("%d byte key: got %d bytes, hash %d", size, len(parsed), hash)
+		}
+	}
+
+	corrupted := []byte(interchangePSK(bytes.Repeat([]byte{1}, 32)))
+	corrupted[20] ^= 1
+	for _, psk := range []string{
+		string(corrupted),
+		interchangePSK([]byte("short")),
+		"DHHC-1:00:abc:",
+		"NVMeTLSkey-1:01:not base64!:",
+		"NVMeTLSkey-1:01:" + base64.StdEncoding.EncodeToString(make([]byte, 36)),
+	} {
+		if _, _, err := parsePSK(psk); err == nil {
+			t.Errorf("parsePSK(%q) should fail", psk)
+		}
+	}
+}
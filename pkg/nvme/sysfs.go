@@ -0,0 +1,284 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvme
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+var (
+	controllerRe = regexp.MustCompile(`^nvme[0-9]+$`)
+	namespaceRe  = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+	pathRe       = regexp.MustCompile(`^nvme[0-9]+c[0-9]+n[0-9]+$`)
+)
+
+// Subsystem is an NVMe subsystem the host is connected to
+type Subsystem struct {
+	Name       string   // nvme-subsys0
+	NQN        string   // subsystem NQN
+	Model      string   // model number
+	Serial     string   // serial number
+	Paths      []Path   // one path per controller
+	Namespaces []string // block devices, e.g. nvme0n1
+}
+
+// Path is a controller of a subsystem
+type Path struct {
+	Controller string // nvme0
+	Transport  string // tcp, rdma
+	Address    string // traddr=10.0.0.1,trsvcid=4420
+	TrAddr     string
+	TrSvcID    string
+	State      string // live, connecting, resetting, deleting, dead, new
+	ANAState   string // optimized, non-optimized, inaccessible, ... empty without ANA
+	HostID     string // host ID the controller connected with
+}
+
+// Namespace is a namespace block device of a subsystem
+type Namespace struct {
+	Name string // nvme0n1
+	NSID int
+	UUID string // empty if the target does not report one
+}
+
+// DevicePath returns the block device of the namespace
+func (n *Namespace) DevicePath() string {
+	return filepath.Join("/dev", n.Name)
+}
+
+var (
+	// ErrNamespaceNotFound is returned if the subsystem is not connected or
+	// has no namespace with the NSID
+	ErrNamespaceNotFound = errors.New("namespace not found")
+	// ErrNamespaceMismatch is returned if the namespace with the NSID has
+	// another UUID than expected
+	ErrNamespaceMismatch = errors.New("namespace UUID mismatch")
+)
+
+// Live returns whether the path can serve I/O
+func (p *Path) Live() bool {
+	return p.State == "live"
+}
+
+func (f *Fabrics) sysfs(elem ...string) string {
+	return filepath.Join(append([]string{f.SysfsRoot}, elem...)...)
+}
+
+func readAttr(file string) string {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Subsystems returns all NVMe subsystems of the host. Subsystems that
+// cannot be read, e.g. as they are removed while listed, are skipped.
+func (f *Fabrics) Subsystems() ([]Subsystem, error) {
+	entries, err := os.ReadDir(f.sysfs("class", "nvme-subsystem"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list nvme subsystems: %w", err)
+	}
+
+	subsystems := make([]Subsystem, 0, len(entries))
+	for _, entry := range entries {
+		subsys, err := f.subsystem(entry.Name())
+		if err != nil {
+			klog.Warningf("skipping nvme subsystem %s: %v", entry.Name(), err)
+			continue
+		}
+		subsystems = append(subsystems, *subsys)
+	}
+	return subsystems, nil
+}
+
+func (f *Fabrics) subsystem(name string) (*Subsystem, error) {
+	dir := f.sysfs("class", "nvme-subsystem", name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read nvme subsystem %s: %w", name, err)
+	}
+
+	subsys := &Subsystem{
+		Name:   name,
+		NQN:    readAttr(filepath.Join(dir, "subsysnqn")),
+		Model:  readAttr(filepath.Join(dir, "model")),
+		Serial: readAttr(filepath.Join(dir, "serial")),
+	}
+	for _, entry := range entries {
+		switch {
+		case controllerRe.MatchString(entry.Name()):
+			subsys.Paths = append(subsys.Paths, f.path(entry.Name()))
+		case namespaceRe.MatchString(entry.Name()):
+			subsys.Namespaces = append(subsys.Namespaces, entry.Name())
+		}
+	}
+	// without native multipath the namespaces hang off the controllers
+	if len(subsys.Namespaces) == 0 {
+		for _, p := range subsys.Paths {
+			subsys.Namespaces = append(subsys.Namespaces, f.controllerNamespaces(p.Controller)...)
+		}
+	}
+	sort.Slice(subsys.Paths, func(i, j int) bool { return subsys.Paths[i].Controller < subsys.Paths[j].Controller })
+	sort.Strings(subsys.Namespaces)
+	return subsys, nil
+}
+
+func (f *Fabrics) path(controller string) Path {
+	dir := f.sysfs("class", "nvme", controller)
+	p := Path{
+		Controller: controller,
+		Transport:  readAttr(filepath.Join(dir, "transport")),
+		Address:    readAttr(filepath.Join(dir, "address")),
+		State:      readAttr(filepath.Join(dir, "state")),
+		HostID:     readAttr(filepath.Join(dir, "hostid")),
+	}
+	for _, part := range strings.Split(p.Address, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "traddr":
+			p.TrAddr = value
+		case "trsvcid":
+			p.TrSvcID = value
+		}
+	}
+
+	// the ANA state is per namespace path, all namespaces of our subsystems
+	// share the ANA group of the controller
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if pathRe.MatchString(entry.Name()) {
+				p.ANAState = readAttr(filepath.Join(dir, entry.Name(), "ana_state"))
+				break
+			}
+		}
+	}
+	return p
+}
+
+func (f *Fabrics) controllerNamespaces(controller string) []string {
+	entries, err := os.ReadDir(f.sysfs("class", "nvme", controller))
+	if err != nil {
+		return nil
+	}
+	var namespaces []string
+	for _, entry := range entries {
+		if namespaceRe.MatchString(entry.Name()) {
+			namespaces = append(namespaces, entry.Name())
+		}
+	}
+	return namespaces
+}
+
+// SubsystemByNQN returns the subsystem with the NQN, nil if not connected
+func (f *Fabrics) SubsystemByNQN(nqn string) (*Subsystem, error) {
+	subsystems, err := f.Subsystems()
+	if err != nil {
+		return nil, err
+	}
+	for i := range subsystems {
+		if subsystems[i].NQN == nqn {
+			return &subsystems[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// SubsystemForDevice returns the subsystem of a namespace block device,
+// devicePath may be a symlink like /dev/disk/by-id/...
+func (f *Fabrics) SubsystemForDevice(devicePath string) (*Subsystem, error) {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve device path %s: %w", devicePath, err)
+	}
+	devName := filepath.Base(realPath)
+
+	subsystems, err := f.Subsystems()
+	if err != nil {
+		return nil, err
+	}
+	for i := range subsystems {
+		for _, ns := range subsystems[i].Namespaces {
+			if ns == devName {
+				return &subsystems[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no nvme subsystem found for %s", devicePath)
+}
+
+// IsConnected returns whether the host has a controller of the subsystem
+func (f *Fabrics) IsConnected(nqn string) (bool, error) {
+	subsys, err := f.SubsystemByNQN(nqn)
+	if err != nil {
+		return false, err
+	}
+	return subsys != nil && len(subsys.Paths) > 0, nil
+}
+
+// RDMAAvailable returns whether the host has an RDMA capable device, e.g. a
+// RoCE or InfiniBand adapter
+func (f *Fabrics) RDMAAvailable() bool {
+	entries, err := os.ReadDir(f.sysfs("class", "infiniband"))
+	return err == nil && len(entries) > 0
+}
+
+// Namespace returns the namespace of a subsystem by NSID. If uuid is given
+// the namespace must have it, so a namespace that was replaced by another one
+// with the same NSID is never used.
+func (f *Fabrics) Namespace(subsys *Subsystem, nsid int, uuid string) (*Namespace, error) {
+	for _, name := range subsys.Namespaces {
+		ns := f.namespace(subsys, name)
+		if ns.NSID != nsid {
+			continue
+		}
+		if uuid != "" && !strings.EqualFold(ns.UUID, uuid) {
+			return nil, fmt.Errorf("namespace %d of %s has UUID %q, expected %s: %w", nsid, subsys.NQN, ns.UUID, uuid, ErrNamespaceMismatch)
+		}
+		return ns, nil
+	}
+	return nil, fmt.Errorf("namespace %d of %s: %w", nsid, subsys.NQN, ErrNamespaceNotFound)
+}
+
+// namespace reads the attributes of a namespace, with native multipath it
+// is in the subsystem dir, else in the dir of its controller
+func (f *Fabrics) namespace(subsys *Subsystem, name string) *Namespace {
+	dir := f.sysfs("class", "nvme-subsystem", subsys.Name, name)
+	for _, p := range subsys.Paths {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		dir = f.sysfs("class", "nvme", p.Controller, name)
+	}
+	ns := &Namespace{Name: name, UUID: readAttr(filepath.Join(dir, "uuid"))}
+	ns.NSID, _ = strconv.Atoi(readAttr(filepath.Join(dir, "nsid")))
+	if strings.Trim(ns.UUID, "0-") == "" {
+		ns.UUID = ""
+	}
+	return ns
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvme
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Uevent is a kernel object event, e.g. a controller changing state
+type Uevent struct {
+	Action  string // add, remove, change, ...
+	DevPath string // /devices/virtual/nvme-fabrics/ctl/nvme0
+	Env     map[string]string
+}
+
+// IsNVMe returns whether the event concerns an NVMe controller, subsystem
+// or namespace
+func (e *Uevent) IsNVMe() bool {
+	switch e.Env["SUBSYSTEM"] {
+	case "nvme", "nvme-subsystem":
+		return true
+	case "block":
+		return strings.HasPrefix(e.Env["DEVNAME"], "nvme")
+	}
+	return false
+}
+
+// parseUevent parses a kernel uevent message, "action@devpath" followed by
+// KEY=value pairs, all NUL terminated
+func parseUevent(msg []byte) (*Uevent, error) {
+	fields := bytes.Split(bytes.TrimRight(msg, "\x00"), []byte{0})
+	action, devPath, ok := strings.Cut(string(fields[0]), "@")
+	if !ok {
+		return nil, fmt.Errorf("invalid uevent header %q", fields[0])
+	}
+	event := &Uevent{Action: action, DevPath: devPath, Env: make(map[string]string, len(fields)-1)}
+	for _, field := range fields[1:] {
+		if key, value, ok := strings.Cut(string(field), "="); ok {
+			event.Env[key] = value
+		}
+	}
+	return event, nil
+}
+
+// WatchUevents calls notify for every NVMe uevent of the kernel until ctx is
+// done. notify is called with nil when the socket overflowed and events
+// were lost.
+func WatchUevents(ctx context.Context, notify func(*Uevent)) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return fmt.Errorf("failed to open uevent socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		return fmt.Errorf("failed to bind uevent socket: %w", err)
+	}
+	// wake up every second to notice ctx is done
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		return fmt.Errorf("failed to set uevent socket timeout: %w", err)
+	}
+
+	buf := make([]byte, 64*1024)
+	for ctx.Err() == nil {
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		switch {
+		case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+			continue
+		case errors.Is(err, unix.ENOBUFS):
+			notify(nil)
+			continue
+		case err != nil:
+			return fmt.Errorf("failed to receive uevent: %w", err)
+		}
+		// only trust the kernel
+		if sa, ok := from.(*unix.SockaddrNetlink); !ok || sa.Pid != 0 {
+			continue
+		}
+		event, err := parseUevent(buf[:n])
+		if err == nil && event.IsNVMe() {
+			notify(event)
+		}
+	}
+	return nil
+}
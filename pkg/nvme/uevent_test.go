@@ -0,0 +1,52 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvme
+
+import "testing"
+
+func TestParseUevent(t *testing.T) {
+	tests := []struct {
+		msg  string
+		nvme bool
+	}{
+		{"change@/devices/virtual/nvme-fabrics/ctl/nvme0\x00ACTION=change\x00DEVPATH=/devices/virtual/nvme-fabrics/ctl/nvme0\x00SUBSYSTEM=nvme\x00NVME_EVENT=connected\x00SEQNUM=4711\x00", true},
+		{"add@/devices/virtual/nvme-subsystem/nvme-subsys0/nvme0n1\x00ACTION=add\x00SUBSYSTEM=block\x00DEVNAME=nvme0n1\x00", true},
+		{"add@/devices/virtual/block/loop0\x00ACTION=add\x00SUBSYSTEM=block\x00DEVNAME=loop0\x00", false},
+		{"change@/devices/system/cpu/cpu1\x00ACTION=change\x00SUBSYSTEM=cpu\x00", false},
+	}
+	for _, tt := range tests {
+		event, err := parseUevent([]byte(tt.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.IsNVMe() != tt.nvme {
+			t.Errorf("%s: IsNVMe() = %v, want %v", event.DevPath, event.IsNVMe(), tt.nvme)
+		}
+	}
+
+	event, err := parseUevent([]byte(tests[0].msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Action != "change" || event.DevPath != "/devices/virtual/nvme-fabrics/ctl/nvme0" || event.Env["NVME_EVENT"] != "connected" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	if _, err := parseUevent([]byte("libudev\x00garbage")); err == nil {
+		t.Error("message without header should fail")
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminPrefix is the path prefix of the endpoints controlling the simulator
+// at runtime. They do not require the cluster secret.
+//
+//	POST   /_sim/faults                 inject a Fault (JSON body)
+//	DELETE /_sim/faults                 clear faults, latency and error rate
+//	PUT    /_sim/latency?value=100ms    delay every request
+//	PUT    /_sim/errorrate?value=0.1    fail a fraction of requests with HTTP 500
+//	PUT    /_sim/pools/<name>?size=10G  add a pool
+//	PUT    /_sim/pools/<name>/full?value=true
+//	PUT    /_sim/storagenodes/<id>?status=offline
+//	GET    /_sim/storagenodes           list storage nodes
+const adminPrefix = "_sim"
+
+//nolint:cyclop // one case per endpoint
+func (s *Simulator) serveAdmin(w http.ResponseWriter, r *http.Request, path string) {
+	segments := strings.Split(path, "/")
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodPost && path == "faults":
+		var f Fault
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if f.StatusCode == 0 {
+			f.StatusCode = http.StatusInternalServerError
+		}
+		s.InjectFault(f)
+
+	case r.Method == http.MethodDelete && path == "faults":
+		s.ClearFaults()
+
+	case r.Method == http.MethodPut && path == "latency":
+		d, err := time.ParseDuration(query.Get("value"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.SetLatency(d)
+
+	case r.Method == http.MethodPut && path == "errorrate":
+		rate, err := strconv.ParseFloat(query.Get("value"), 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.SetErrorRate(rate)
+
+	case r.Method == http.MethodPut && len(segments) == 2 && segments[0] == "pools":
+		size, err := parseSize(query.Get("size"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeResult(w, s.AddPool(segments[1], size))
+		return
+
+	case r.Method == http.MethodPut && len(segments) == 3 && segments[0] == "pools" && segments[2] == "full":
+		full, err := strconv.ParseBool(query.Get("value"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.SetPoolFull(segments[1], full)
+
+	case r.Method == http.MethodPut && len(segments) == 2 && segments[0] == "storagenodes":
+		s.SetStorageNodeStatus(segments[1], query.Get("status"))
+
+	case r.Method == http.MethodGet && path == "storagenodes":
+		s.mtx.Lock()
+		nodes := s.listStorageNodes()
+		s.mtx.Unlock()
+		writeResult(w, nodes)
+		return
+
+	default:
+		writeError(w, http.StatusNotFound, "unknown simulator endpoint "+r.Method+" /"+adminPrefix+"/"+path)
+		return
+	}
+	writeResult(w, true)
+}
@@ -0,0 +1,762 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package simulator implements an in-memory SimplyBlock management API. It
+// serves the endpoints used by the CSI driver so that the driver can be
+// developed and tested without a simplyblock cluster, and it can inject
+// faults such as latency, errors and full pools.
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// clusterSize is the allocation unit of a pool
+	clusterSize = 4 * 1024 * 1024
+	// firstPort is the NVMe/TCP port of the first volume
+	firstPort = 4420
+)
+
+// Fault describes an error the simulator returns instead of handling a request
+type Fault struct {
+	Method     string `json:"method,omitempty"` // HTTP method to match, any if empty
+	Path       string `json:"path,omitempty"`   // path prefix to match (e.g. "lvol/connect"), any if empty
+	StatusCode int    `json:"status_code"`      // HTTP status code to return
+	Message    string `json:"message"`          // error message in the response body
+	Count      int    `json:"count,omitempty"`  // number of requests to fail, forever if 0
+}
+
+type pool struct {
+	Name          string `json:"name"`
+	UUID          string `json:"uuid"`
+	TotalClusters int64  `json:"total_data_clusters"`
+	FreeClusters  int64  `json:"free_clusters"`
+	ClusterSize   int64  `json:"cluster_size"`
+	full          bool
+}
+
+type lvol struct {
+	Name       string   `json:"lvol_name"`
+	UUID       string   `json:"uuid"`
+	Size       int64    `json:"size"`
+	PoolName   string   `json:"pool_name"`
+	NodeID     string   `json:"node_id"`
+	Nodes      []string `json:"nodes"`
+	Status     string   `json:"status"`
+	PvcName    string   `json:"pvc_name,omitempty"`
+	ChunkSize  int      `json:"distr_chunk_bs,omitempty"`
+	SnapshotID string   `json:"snapshot_id,omitempty"`
+	port       int
+	// allocated are the bytes reserved in the pool, clones share the
+	// clusters of their snapshot until resized
+	allocated int64
+}
+
+type snapshot struct {
+	Name      string `json:"snapshot_name"`
+	UUID      string `json:"uuid"`
+	Size      int64  `json:"size"`
+	PoolName  string `json:"pool_name"`
+	PoolID    string `json:"pool_uuid"`
+	CreatedAt string `json:"created_at"`
+	Lvol      struct {
+		UUID string `json:"id"`
+	} `json:"lvol"`
+}
+
+type storageNode struct {
+	UUID   string `json:"uuid"`
+	IP     string `json:"mgmt_ip"`
+	Status string `json:"status"`
+}
+
+type cachingNode struct {
+	UUID     string   `json:"id"`
+	Hostname string   `json:"hostname"`
+	Lvols    []string `json:"lvols"`
+}
+
+// Simulator is an in-memory SimplyBlock management API. It implements
+// http.Handler and is safe for concurrent use.
+type Simulator struct {
+	clusterID string
+	secret    string
+
+	mtx          sync.Mutex
+	pools        map[string]*pool
+	lvols        map[string]*lvol
+	snapshots    map[string]*snapshot
+	storageNodes []*storageNode
+	cachingNodes map[string]*cachingNode
+	nextID       int
+	nextPort     int
+
+	latency   time.Duration
+	errorRate float64
+	faults    []*Fault
+	rand      *rand.Rand
+}
+
+// New creates a simulator of the cluster clusterID with one online storage
+// node and no pools. Requests must carry secret, unless it is empty.
+func New(clusterID, secret string) *Simulator {
+	s := &Simulator{
+		clusterID:    clusterID,
+		secret:       secret,
+		pools:        make(map[string]*pool),
+		lvols:        make(map[string]*lvol),
+		snapshots:    make(map[string]*snapshot),
+		cachingNodes: make(map[string]*cachingNode),
+		nextPort:     firstPort,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec // not used for security
+	}
+	s.AddStorageNode("127.0.0.1")
+	return s
+}
+
+// ClusterID returns the ID of the simulated cluster
+func (s *Simulator) ClusterID() string {
+	return s.clusterID
+}
+
+// newID returns a unique UUID formatted ID, must be called with mtx held
+func (s *Simulator) newID() string {
+	s.nextID++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", s.nextID)
+}
+
+// AddPool adds a pool with the given capacity and returns its UUID
+func (s *Simulator) AddPool(name string, sizeBytes int64) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	clusters := sizeBytes / clusterSize
+	p := &pool{
+		Name:          name,
+		UUID:          s.newID(),
+		TotalClusters: clusters,
+		FreeClusters:  clusters,
+		ClusterSize:   clusterSize,
+	}
+	s.pools[name] = p
+	return p.UUID
+}
+
+// SetPoolFull makes all allocations in the pool fail with "No space left"
+func (s *Simulator) SetPoolFull(name string, full bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if p, ok := s.pools[name]; ok {
+		p.full = full
+	}
+}
+
+// AddStorageNode adds an online storage node and returns its UUID. Volumes
+// created afterwards get one NVMe-oF path per storage node.
+func (s *Simulator) AddStorageNode(ip string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	node := &storageNode{UUID: s.newID(), IP: ip, Status: "online"}
+	s.storageNodes = append(s.storageNodes, node)
+	return node.UUID
+}
+
+// SetStorageNodeStatus sets the status (e.g. "online", "offline") of a storage node
+func (s *Simulator) SetStorageNodeStatus(nodeID, status string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, node := range s.storageNodes {
+		if node.UUID == nodeID {
+			node.Status = status
+		}
+	}
+}
+
+// AddCachingNode adds a caching node and returns its UUID
+func (s *Simulator) AddCachingNode(hostname string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	node := &cachingNode{UUID: s.newID(), Hostname: hostname}
+	s.cachingNodes[node.UUID] = node
+	return node.UUID
+}
+
+// SetLatency delays every request by d
+func (s *Simulator) SetLatency(d time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.latency = d
+}
+
+// SetErrorRate makes the given fraction (0..1) of requests fail with HTTP 500
+func (s *Simulator) SetErrorRate(rate float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.errorRate = rate
+}
+
+// InjectFault adds a fault. Faults are matched in the order they were added.
+func (s *Simulator) InjectFault(f Fault) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all faults, the latency and the error rate
+func (s *Simulator) ClearFaults() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.faults = nil
+	s.latency = 0
+	s.errorRate = 0
+}
+
+// LvolCount returns the number of volumes, including clones
+func (s *Simulator) LvolCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.lvols)
+}
+
+// LvolChunkSize returns the chunk size a volume was created with, 0 if it
+// was left to the cluster or the volume does not exist
+func (s *Simulator) LvolChunkSize(lvolID string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if l, ok := s.lvols[lvolID]; ok {
+		return l.ChunkSize
+	}
+	return 0
+}
+
+// SnapshotCount returns the number of snapshots
+func (s *Simulator) SnapshotCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.snapshots)
+}
+
+// fault returns the fault to apply to the request, must be called with mtx held
+func (s *Simulator) fault(method, path string) *Fault {
+	for i, f := range s.faults {
+		if f.Method != "" && !strings.EqualFold(f.Method, method) {
+			continue
+		}
+		if !strings.HasPrefix(path, strings.Trim(f.Path, "/")) {
+			continue
+		}
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	if s.errorRate > 0 && s.rand.Float64() < s.errorRate {
+		return &Fault{StatusCode: http.StatusInternalServerError, Message: "injected error"}
+	}
+	return nil
+}
+
+// httpError is returned by handlers to send an error response
+type httpError struct {
+	code    int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func errNotFound(kind, id string) error {
+	return &httpError{http.StatusNotFound, fmt.Sprintf("No such device: %s %s", kind, id)}
+}
+
+func errBadRequest(format string, args ...interface{}) error {
+	return &httpError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// ServeHTTP implements http.Handler
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the driver joins the base URL and the path with an extra slash
+	path := strings.Trim(r.URL.Path, "/")
+	if strings.HasPrefix(path, adminPrefix) {
+		s.serveAdmin(w, r, strings.Trim(strings.TrimPrefix(path, adminPrefix), "/"))
+		return
+	}
+	path = strings.Trim(strings.TrimPrefix(path, "api/v1"), "/")
+
+	klog.V(5).Infof("simulator: %s %s", r.Method, path)
+
+	if s.secret != "" && r.Header.Get("secret") != s.secret {
+		writeError(w, http.StatusUnauthorized, "invalid cluster secret")
+		return
+	}
+
+	s.mtx.Lock()
+	latency := s.latency
+	f := s.fault(r.Method, path)
+	s.mtx.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if f != nil {
+		writeError(w, f.StatusCode, f.Message)
+		return
+	}
+
+	result, err := s.handle(r, strings.Split(path, "/"))
+	if err != nil {
+		if herr, ok := err.(*httpError); ok { //nolint:errorlint // handlers return *httpError unwrapped
+			writeError(w, herr.code, herr.message)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeResult(w, result)
+}
+
+//nolint:cyclop // one case per endpoint
+func (s *Simulator) handle(r *http.Request, segments []string) (interface{}, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	route := r.Method + " " + segments[0]
+	n := len(segments)
+	switch {
+	case route == "GET pool" && n == 2 && segments[1] == "get_pools":
+		return s.getPools(), nil
+
+	case route == "GET lvol" && n == 1:
+		return s.listLvols(), nil
+	case route == "POST lvol" && n == 1:
+		return s.createLvol(r)
+	case route == "GET lvol" && n == 3 && segments[1] == "connect":
+		return s.connectLvol(segments[2])
+	case route == "PUT lvol" && n == 3 && segments[1] == "resize":
+		return s.resizeLvol(r, segments[2])
+	case route == "GET lvol" && n == 2:
+		return s.getLvol(segments[1])
+	case route == "GET lvol" && n == 3:
+		return s.getLvolByName(segments[1], segments[2])
+	case route == "DELETE lvol" && n == 2:
+		return s.deleteLvol(segments[1])
+
+	case route == "GET snapshot" && n == 1:
+		return s.listSnapshots(), nil
+	case route == "POST snapshot" && n == 1:
+		return s.createSnapshot(r)
+	case route == "POST snapshot" && n == 2 && segments[1] == "clone":
+		return s.cloneSnapshot(r)
+	case route == "DELETE snapshot" && n == 2:
+		return s.deleteSnapshot(segments[1])
+
+	case route == "GET storagenode" && n == 1:
+		return s.listStorageNodes(), nil
+	case route == "GET storagenode" && n == 2:
+		return s.getStorageNode(segments[1])
+
+	case route == "GET cachingnode" && n == 1:
+		return s.listCachingNodes(), nil
+	case route == "PUT cachingnode" && n == 3 && (segments[1] == "connect" || segments[1] == "disconnect"):
+		return s.connectCachingNode(r, segments[2], segments[1] == "connect")
+	}
+	return nil, &httpError{http.StatusNotFound, fmt.Sprintf("unknown endpoint %s /%s", r.Method, strings.Join(segments, "/"))}
+}
+
+func (s *Simulator) getPools() []pool {
+	pools := make([]pool, 0, len(s.pools))
+	for _, p := range s.pools {
+		pools = append(pools, *p)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return pools
+}
+
+func (s *Simulator) listLvols() []lvol {
+	lvols := make([]lvol, 0, len(s.lvols))
+	for _, l := range s.lvols {
+		lvols = append(lvols, *l)
+	}
+	sort.Slice(lvols, func(i, j int) bool { return lvols[i].UUID < lvols[j].UUID })
+	return lvols
+}
+
+// allocate reserves size bytes in the pool, must be called with mtx held
+func (s *Simulator) allocate(poolName string, size int64) error {
+	p, ok := s.pools[poolName]
+	if !ok {
+		return errBadRequest("pool not found: %s", poolName)
+	}
+	clusters := (size + clusterSize - 1) / clusterSize
+	if p.full || clusters > p.FreeClusters {
+		return errBadRequest("No space left on pool %s", poolName)
+	}
+	p.FreeClusters -= clusters
+	return nil
+}
+
+// release returns size bytes to the pool, must be called with mtx held
+func (s *Simulator) release(poolName string, size int64) {
+	if p, ok := s.pools[poolName]; ok {
+		p.FreeClusters += (size + clusterSize - 1) / clusterSize
+	}
+}
+
+// newLvol creates a volume on all storage nodes, must be called with mtx held
+func (s *Simulator) newLvol(name, poolName string, size int64) *lvol {
+	l := &lvol{
+		Name:     name,
+		UUID:     s.newID(),
+		Size:     size,
+		PoolName: poolName,
+		Status:   "online",
+		port:     s.nextPort,
+	}
+	s.nextPort++
+	for _, node := range s.storageNodes {
+		l.Nodes = append(l.Nodes, node.UUID)
+	}
+	if len(l.Nodes) > 0 {
+		l.NodeID = l.Nodes[0]
+	}
+	s.lvols[l.UUID] = l
+	return l
+}
+
+func (s *Simulator) createLvol(r *http.Request) (interface{}, error) {
+	var req struct {
+		Name      string `json:"name"`
+		Size      string `json:"size"`
+		Pool      string `json:"pool"`
+		PvcName   string `json:"pvc_name"`
+		ChunkSize int    `json:"distr_chunk_bs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errBadRequest("invalid request: %v", err)
+	}
+	if req.Name == "" {
+		return nil, errBadRequest("missing lvol name")
+	}
+	size, err := parseSize(req.Size)
+	if err != nil {
+		return nil, errBadRequest("invalid size %q: %v", req.Size, err)
+	}
+	for _, l := range s.lvols {
+		if l.Name == req.Name && l.PoolName == req.Pool {
+			return nil, errBadRequest("lvol %s already exists in pool %s", req.Name, req.Pool)
+		}
+	}
+	if err := s.allocate(req.Pool, size); err != nil {
+		return nil, err
+	}
+	l := s.newLvol(req.Name, req.Pool, size)
+	l.PvcName = req.PvcName
+	l.ChunkSize = req.ChunkSize
+	l.allocated = size
+	return l.UUID, nil
+}
+
+func (s *Simulator) getLvol(lvolID string) (interface{}, error) {
+	l, ok := s.lvols[lvolID]
+	if !ok {
+		return nil, errNotFound("lvol", lvolID)
+	}
+	return []lvol{*l}, nil
+}
+
+func (s *Simulator) getLvolByName(poolName, name string) (interface{}, error) {
+	for _, l := range s.lvols {
+		if l.Name == name && l.PoolName == poolName {
+			return []lvol{*l}, nil
+		}
+	}
+	return nil, errNotFound("lvol", poolName+"/"+name)
+}
+
+func (s *Simulator) connectLvol(lvolID string) (interface{}, error) {
+	l, ok := s.lvols[lvolID]
+	if !ok {
+		return nil, errNotFound("lvol", lvolID)
+	}
+	type connectResp struct {
+		Nqn            string `json:"nqn"`
+		ReconnectDelay int    `json:"reconnect-delay"`
+		NrIoQueues     int    `json:"nr-io-queues"`
+		CtrlLossTmo    int    `json:"ctrl-loss-tmo"`
+		Port           int    `json:"port"`
+		IP             string `json:"ip"`
+		Connect        string `json:"connect"`
+		NSID           int    `json:"ns_id"`
+	}
+	nqn := fmt.Sprintf("nqn.2023-02.io.simplyblock:%s:lvol:%s", s.clusterID, l.UUID)
+	var resp []connectResp
+	for _, nodeID := range l.Nodes {
+		for _, node := range s.storageNodes {
+			if node.UUID != nodeID {
+				continue
+			}
+			resp = append(resp, connectResp{
+				Nqn:            nqn,
+				ReconnectDelay: 2,
+				NrIoQueues:     3,
+				CtrlLossTmo:    60,
+				Port:           l.port,
+				IP:             node.IP,
+				Connect:        fmt.Sprintf("sudo nvme connect --transport=tcp --traddr=%s --trsvcid=%d --nqn=%s", node.IP, l.port, nqn),
+				NSID:           1,
+			})
+		}
+	}
+	return resp, nil
+}
+
+func (s *Simulator) resizeLvol(r *http.Request, lvolID string) (interface{}, error) {
+	l, ok := s.lvols[lvolID]
+	if !ok {
+		return nil, errNotFound("lvol", lvolID)
+	}
+	var req struct {
+		Size json.Number `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errBadRequest("invalid request: %v", err)
+	}
+	size, err := parseSize(req.Size.String())
+	if err != nil {
+		return nil, errBadRequest("invalid size %q: %v", req.Size, err)
+	}
+	if size < l.Size {
+		return nil, errBadRequest("new size %d is smaller than current size %d", size, l.Size)
+	}
+	if err := s.allocate(l.PoolName, size-l.Size); err != nil {
+		return nil, err
+	}
+	l.allocated += size - l.Size
+	l.Size = size
+	return true, nil
+}
+
+func (s *Simulator) deleteLvol(lvolID string) (interface{}, error) {
+	l, ok := s.lvols[lvolID]
+	if !ok {
+		return nil, errNotFound("lvol", lvolID)
+	}
+	for _, c := range s.cachingNodes {
+		for _, id := range c.Lvols {
+			if id == lvolID {
+				return nil, errBadRequest("lvol %s is connected to caching node %s", lvolID, c.UUID)
+			}
+		}
+	}
+	s.release(l.PoolName, l.allocated)
+	delete(s.lvols, lvolID)
+	return true, nil
+}
+
+func (s *Simulator) listSnapshots() []snapshot {
+	snapshots := make([]snapshot, 0, len(s.snapshots))
+	for _, snap := range s.snapshots {
+		snapshots = append(snapshots, *snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].UUID < snapshots[j].UUID })
+	return snapshots
+}
+
+func (s *Simulator) createSnapshot(r *http.Request) (interface{}, error) {
+	var req struct {
+		LvolID string `json:"lvol_id"`
+		Name   string `json:"snapshot_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errBadRequest("invalid request: %v", err)
+	}
+	l, ok := s.lvols[req.LvolID]
+	if !ok {
+		return nil, errNotFound("lvol", req.LvolID)
+	}
+	for _, snap := range s.snapshots {
+		if snap.Name == req.Name && snap.Lvol.UUID == l.UUID {
+			return snap.UUID, nil
+		}
+	}
+	p := s.pools[l.PoolName]
+	if p != nil && p.full {
+		return nil, errBadRequest("No space left on pool %s", l.PoolName)
+	}
+	snap := &snapshot{
+		Name:      req.Name,
+		UUID:      s.newID(),
+		Size:      l.Size,
+		PoolName:  l.PoolName,
+		CreatedAt: strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if p != nil {
+		snap.PoolID = p.UUID
+	}
+	snap.Lvol.UUID = l.UUID
+	s.snapshots[snap.UUID] = snap
+	return snap.UUID, nil
+}
+
+func (s *Simulator) cloneSnapshot(r *http.Request) (interface{}, error) {
+	var req struct {
+		SnapshotID string `json:"snapshot_id"`
+		CloneName  string `json:"clone_name"`
+		PvcName    string `json:"pvc_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errBadRequest("invalid request: %v", err)
+	}
+	snap, ok := s.snapshots[req.SnapshotID]
+	if !ok {
+		return nil, errNotFound("snapshot", req.SnapshotID)
+	}
+	for _, l := range s.lvols {
+		if l.Name == req.CloneName && l.PoolName == snap.PoolName {
+			return nil, errBadRequest("lvol %s already exists in pool %s", req.CloneName, snap.PoolName)
+		}
+	}
+	// clones share the snapshot's clusters until written, nothing to allocate
+	if p := s.pools[snap.PoolName]; p != nil && p.full {
+		return nil, errBadRequest("No space left on pool %s", snap.PoolName)
+	}
+	l := s.newLvol(req.CloneName, snap.PoolName, snap.Size)
+	l.PvcName = req.PvcName
+	l.SnapshotID = snap.UUID
+	return l.UUID, nil
+}
+
+func (s *Simulator) deleteSnapshot(snapshotID string) (interface{}, error) {
+	if _, ok := s.snapshots[snapshotID]; !ok {
+		return nil, errNotFound("snapshot", snapshotID)
+	}
+	delete(s.snapshots, snapshotID)
+	return true, nil
+}
+
+func (s *Simulator) getStorageNode(nodeID string) (interface{}, error) {
+	for _, node := range s.storageNodes {
+		if node.UUID == nodeID {
+			return []storageNode{*node}, nil
+		}
+	}
+	return nil, errNotFound("storage node", nodeID)
+}
+
+func (s *Simulator) listStorageNodes() []storageNode {
+	nodes := make([]storageNode, 0, len(s.storageNodes))
+	for _, node := range s.storageNodes {
+		nodes = append(nodes, *node)
+	}
+	return nodes
+}
+
+func (s *Simulator) listCachingNodes() []cachingNode {
+	nodes := make([]cachingNode, 0, len(s.cachingNodes))
+	for _, node := range s.cachingNodes {
+		node := *node
+		node.Lvols = append([]string(nil), node.Lvols...)
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].UUID < nodes[j].UUID })
+	return nodes
+}
+
+func (s *Simulator) connectCachingNode(r *http.Request, nodeID string, connect bool) (interface{}, error) {
+	node, ok := s.cachingNodes[nodeID]
+	if !ok {
+		return nil, errNotFound("caching node", nodeID)
+	}
+	var req struct {
+		LvolID string `json:"lvol_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errBadRequest("invalid request: %v", err)
+	}
+	if _, ok := s.lvols[req.LvolID]; !ok {
+		return nil, errNotFound("lvol", req.LvolID)
+	}
+	var lvols []string
+	for _, id := range node.Lvols {
+		if id != req.LvolID {
+			lvols = append(lvols, id)
+		}
+	}
+	if connect {
+		lvols = append(lvols, req.LvolID)
+	}
+	node.Lvols = lvols
+	return true, nil
+}
+
+// parseSize parses sizes like "1024", "100M" or "2G" into bytes
+func parseSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	if size == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(size[len(size)-1:]) {
+	case "K":
+		multiplier = 1024
+	case "M":
+		multiplier = 1024 * 1024
+	case "G":
+		multiplier = 1024 * 1024 * 1024
+	case "T":
+		multiplier = 1024 * 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		size = size[:len(size)-1]
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * multiplier, nil
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	// the driver accepts scalars in "result" and lists in "results"
+	key := "result"
+	switch result.(type) {
+	case string, bool:
+	default:
+		key = "results"
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{key: result, "status": true}) //nolint:errcheck // client gone
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": message, "status": false}) //nolint:errcheck // client gone
+}
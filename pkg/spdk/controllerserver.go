@@ -51,6 +51,7 @@ const (
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
 	volumeLocks *util.VolumeLocks
+	newBackend  util.BackendFactory
 }
 
 type spdkVolume struct {
@@ -75,23 +76,37 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		klog.Errorf("failed to get cluster_id from parameters")
 		return nil, status.Error(codes.Internal, "failed to get cluster_id from parameters")
 	}
+	connectParams, err := util.ParseConnectParams(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err = util.ValidateTuningProfile(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err = validateFsckPolicy(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, _, err = stripeGeometry(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	sbClient, err := util.NewsimplyBlockClient(clusterID)
+	sbClient, err := cs.newBackend(clusterID, util.RequestClassDefault)
 	if err != nil {
-		return nil, err
+		klog.Errorf("failed to create spdk client: %v", err)
+		return nil, sbStatusError(err)
 	}
 
 	csiVolume, err := cs.createVolume(ctx, req, sbClient)
 	if err != nil {
 		klog.Errorf("failed to create volume, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	volumeInfo, err := cs.publishVolume(csiVolume.GetVolumeId(), sbClient)
 	if err != nil {
 		klog.Errorf("failed to publish volume, volumeID: %s err: %v", volumeID, err)
 		cs.deleteVolume(csiVolume.GetVolumeId()) //nolint:errcheck // we can do little
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	// copy volume info. node needs these info to contact target(ip, port, nqn, ...)
@@ -106,6 +121,7 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if volType, ok := req.GetParameters()["type"]; ok {
 		csiVolume.VolumeContext["targetType"] = volType
 	}
+	connectParams.SetVolumeContext(csiVolume.VolumeContext)
 
 	return &csi.CreateVolumeResponse{Volume: csiVolume}, nil
 }
@@ -125,7 +141,7 @@ func (cs *controllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolum
 		klog.Warningf("volume already deleted: %s", volumeID)
 	case err != nil:
 		klog.Errorf("failed to unpublish volume, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	// no harm if volume already deleted
@@ -135,7 +151,7 @@ func (cs *controllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolum
 		klog.Warningf("volume not exists: %s", volumeID)
 	} else if err != nil {
 		klog.Errorf("failed to delete volume, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
@@ -175,29 +191,29 @@ func (cs *controllerServer) CreateSnapshot(_ context.Context, req *csi.CreateSna
 		klog.Errorf("failed to get spdk volume, volumeID: %s err: %v", volumeID, err)
 		return nil, err
 	}
-	sbclient, err := util.NewsimplyBlockClient(spdkVol.clusterID)
+	sbclient, err := cs.newBackend(spdkVol.clusterID, util.RequestClassDefault)
 	if err != nil {
 		klog.Errorf("failed to create spdk client: %v", err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	snapshotID, err := sbclient.CreateSnapshot(spdkVol.lvolID, snapshotName)
 	klog.Infof("CreateSnapshot : snapshotID=%s", snapshotID)
 	if err != nil {
 		klog.Errorf("failed to create snapshot, volumeID: %s snapshotName: %s err: %v", volumeID, snapshotName, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	volSize, err := sbclient.GetVolumeSize(spdkVol.lvolID)
 	klog.Infof("CreateSnapshot : volSize=%s", volSize)
 	if err != nil {
 		klog.Errorf("failed to get volume info, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 	size, err := strconv.ParseInt(volSize, 10, 64)
 	if err != nil {
 		klog.Errorf("failed to parse volume size, size: %s err: %v", volSize, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 	creationTime := timestamppb.Now()
 	snapshotData := csi.Snapshot{
@@ -220,10 +236,10 @@ func (cs *controllerServer) DeleteSnapshot(_ context.Context, req *csi.DeleteSna
 		klog.Errorf("failed to get spdk snapshot, snapshotID: %s err: %v", snapshotID, err)
 		return nil, err
 	}
-	sbclient, err := util.NewsimplyBlockClient(snapshot.clusterID)
+	sbclient, err := cs.newBackend(snapshot.clusterID, util.RequestClassDefault)
 	if err != nil {
 		klog.Errorf("failed to create spdk client: %v", err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	klog.Infof("snapshotID=%s", snapshotID)
@@ -232,15 +248,30 @@ func (cs *controllerServer) DeleteSnapshot(_ context.Context, req *csi.DeleteSna
 
 	klog.Infof("Deleting Snapshot : snapshotID=%s", snapshotID)
 
-	err = sbclient.DeleteSnapshot(snapshotID)
+	// the backend knows the snapshot by its ID without the cluster prefix
+	err = sbclient.DeleteSnapshot(snapshot.snapshotID)
 	if err != nil {
 		klog.Errorf("failed to delete snapshot, snapshotID: %s err: %v", snapshotID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// sbStatusError converts an error of the SimplyBlock client into a gRPC status.
+// Requests rejected by an open cluster circuit or by the client-side request
+// budget are reported as Unavailable/ResourceExhausted so that the sidecars
+// retry with backoff.
+func sbStatusError(err error) error {
+	switch {
+	case errors.Is(err, util.ErrClusterUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, util.ErrClusterBusy):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
 func getIntParameter(params map[string]string, key string, defaultValue int) (int, error) {
 	if valueStr, exists := params[key]; exists {
 		value, err := strconv.Atoi(valueStr)
@@ -268,6 +299,11 @@ func prepareCreateVolumeReq(ctx context.Context, req *csi.CreateVolumeRequest, s
 	if err != nil {
 		return nil, err
 	}
+	// 0 leaves the chunk size to the cluster
+	distrChunkBs, err := getIntParameter(params, "distr_chunk_bs", 0)
+	if err != nil {
+		return nil, err
+	}
 
 	priorClass, err := getIntParameter(params, "lvol_priority_class", 0)
 	if err != nil {
@@ -310,19 +346,24 @@ func prepareCreateVolumeReq(ctx context.Context, req *csi.CreateVolumeRequest, s
 		}
 	}
 
-	hostID, err := getHostIDAnnotation(ctx, pvcName, pvcNamespace)
-	if err != nil {
-		return nil, err
-	}
+	// PVC annotations are only available when the provisioner passes the
+	// PVC metadata (--extra-create-metadata)
+	var hostID, lvolID, modelID string
+	if pvcNameSelected && pvcNamespaceSelected {
+		hostID, err = getHostIDAnnotation(ctx, pvcName, pvcNamespace)
+		if err != nil {
+			return nil, err
+		}
 
-	lvolID, err := getLvolIDAnnotation(ctx, pvcName, pvcNamespace)
-	if err != nil {
-		return nil, err
-	}
+		lvolID, err = getLvolIDAnnotation(ctx, pvcName, pvcNamespace)
+		if err != nil {
+			return nil, err
+		}
 
-	modelID, err := getNvmfModelIDAnnotation(ctx, pvcName, pvcNamespace)
-	if err != nil {
-		return nil, err
+		modelID, err = getNvmfModelIDAnnotation(ctx, pvcName, pvcNamespace)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	createVolReq := util.CreateLVolData{
@@ -340,6 +381,7 @@ func prepareCreateVolumeReq(ctx context.Context, req *csi.CreateVolumeRequest, s
 		Encryption:   encryption,
 		DistNdcs:     distrNdcs,
 		DistNpcs:     distrNpcs,
+		DistChunkBs:  distrChunkBs,
 		CryptoKey1:   cryptoKey1,
 		CryptoKey2:   cryptoKey2,
 		HostID:       hostID,
@@ -350,17 +392,17 @@ func prepareCreateVolumeReq(ctx context.Context, req *csi.CreateVolumeRequest, s
 	return &createVolReq, nil
 }
 
-func (cs *controllerServer) getExistingVolume(name, poolName string, sbclient *util.NodeNVMf, vol *csi.Volume) (*csi.Volume, error) {
+func (cs *controllerServer) getExistingVolume(name, poolName string, sbclient util.Backend, vol *csi.Volume) (*csi.Volume, error) {
 	volumeID, err := sbclient.GetVolume(name, poolName)
 	if err == nil {
-		vol.VolumeId = fmt.Sprintf("%s:%s:%s", sbclient.Client.ClusterID, poolName, volumeID)
+		vol.VolumeId = fmt.Sprintf("%s:%s:%s", sbclient.ClusterID(), poolName, volumeID)
 		klog.V(5).Info("volume already exists", vol.GetVolumeId())
 		return vol, nil
 	}
 	return nil, err
 }
 
-func (cs *controllerServer) createVolume(ctx context.Context, req *csi.CreateVolumeRequest, sbclient *util.NodeNVMf) (*csi.Volume, error) {
+func (cs *controllerServer) createVolume(ctx context.Context, req *csi.CreateVolumeRequest, sbclient util.Backend) (*csi.Volume, error) {
 	size := req.GetCapacityRange().GetRequiredBytes()
 	if size == 0 {
 		klog.Warningln("invalid volume size, resize to 1G")
@@ -400,8 +442,12 @@ func (cs *controllerServer) createVolume(ctx context.Context, req *csi.CreateVol
 		klog.Errorf("error creating simplyBlock volume: %v", err)
 		return nil, err
 	}
-	vol.VolumeId = fmt.Sprintf("%s:%s:%s", sbclient.Client.ClusterID, poolName, volumeID)
+	vol.VolumeId = fmt.Sprintf("%s:%s:%s", sbclient.ClusterID(), poolName, volumeID)
 	klog.V(5).Info("successfully created volume from Simplyblock with Volume ID: ", vol.GetVolumeId())
+	// the node formats the volume with the stripe geometry it was created with
+	if createVolReq.DistChunkBs > 0 {
+		vol.VolumeContext["distr_chunk_bs"] = strconv.Itoa(createVolReq.DistChunkBs)
+	}
 
 	return &vol, nil
 }
@@ -440,7 +486,7 @@ func getSnapshot(csiSnapshotID string) (*spdkSnapshot, error) {
 	return nil, fmt.Errorf("missing clusterID in csiSnapshotID: %s", csiSnapshotID)
 }
 
-func (cs *controllerServer) publishVolume(volumeID string, sbclient *util.NodeNVMf) (map[string]string, error) {
+func (cs *controllerServer) publishVolume(volumeID string, sbclient util.Backend) (map[string]string, error) {
 	spdkVol, err := getSPDKVol(volumeID)
 	if err != nil {
 		return nil, err
@@ -463,7 +509,7 @@ func (cs *controllerServer) deleteVolume(volumeID string) error {
 	if err != nil {
 		return err
 	}
-	sbclient, err := util.NewsimplyBlockClient(spdkVol.clusterID)
+	sbclient, err := cs.newBackend(spdkVol.clusterID, util.RequestClassDefault)
 	if err != nil {
 		return err
 	}
@@ -475,7 +521,7 @@ func (cs *controllerServer) unpublishVolume(volumeID string) error {
 	if err != nil {
 		return err
 	}
-	sbclient, err := util.NewsimplyBlockClient(spdkVol.clusterID)
+	sbclient, err := cs.newBackend(spdkVol.clusterID, util.RequestClassDefault)
 	if err != nil {
 		return err
 	}
@@ -490,7 +536,7 @@ func (cs *controllerServer) ControllerExpandVolume(_ context.Context, req *csi.C
 		return nil, err
 	}
 
-	sbclient, err := util.NewsimplyBlockClient(spdkVol.clusterID)
+	sbclient, err := cs.newBackend(spdkVol.clusterID, util.RequestClassDefault)
 	if err != nil {
 		return nil, err
 	}
@@ -498,7 +544,7 @@ func (cs *controllerServer) ControllerExpandVolume(_ context.Context, req *csi.C
 	_, err = sbclient.ResizeVolume(spdkVol.lvolID, updatedSize)
 	if err != nil {
 		klog.Errorf("failed to resize lvol, LVolID: %s err: %v", spdkVol.lvolID, err)
-		return nil, err
+		return nil, sbStatusError(err)
 	}
 	return &csi.ControllerExpandVolumeResponse{
 		CapacityBytes:         updatedSize,
@@ -516,15 +562,15 @@ func (cs *controllerServer) ListSnapshots(_ context.Context, _ *csi.ListSnapshot
 	}
 
 	for _, clusterID := range clusters {
-		sbclient, err := util.NewsimplyBlockClient(clusterID)
+		sbclient, err := cs.newBackend(clusterID, util.RequestClassDefault)
 		if err != nil {
 			klog.Errorf("failed to create spdk client: %v", err)
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, sbStatusError(err)
 		}
 
 		snapshotEntries, err := sbclient.ListSnapshots()
 		if err != nil {
-			return nil, err
+			return nil, sbStatusError(err)
 		}
 		entries = append(entries, snapshotEntries...)
 	}
@@ -615,10 +661,10 @@ func (cs *controllerServer) ControllerGetVolume(_ context.Context, req *csi.Cont
 		return nil, err
 	}
 
-	sbclient, err := util.NewsimplyBlockClient(spdkVol.clusterID)
+	sbclient, err := cs.newBackend(spdkVol.clusterID, util.RequestClassDefault)
 	if err != nil {
 		klog.Errorf("failed to create spdk client: %v", err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	volumeInfo, err := sbclient.VolumeInfo(spdkVol.lvolID)
@@ -654,10 +700,11 @@ func (cs *controllerServer) ControllerGetVolume(_ context.Context, req *csi.Cont
 	}, nil
 }
 
-func newControllerServer(d *csicommon.CSIDriver) (*controllerServer, error) {
+func newControllerServer(d *csicommon.CSIDriver, newBackend util.BackendFactory) (*controllerServer, error) {
 	server := controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
 		volumeLocks:             util.NewVolumeLocks(),
+		newBackend:              newBackend,
 	}
 	return &server, nil
 }
@@ -684,10 +731,10 @@ func (cs *controllerServer) handleSnapshotSource(snapshot *csi.VolumeContentSour
 		klog.Errorf("failed to get spdk snapshot, csiSnapshotID: %s err: %v", csiSnapshotID, err)
 		return nil, err
 	}
-	sbclient, err := util.NewsimplyBlockClient(sbSnapshot.clusterID)
+	sbclient, err := cs.newBackend(sbSnapshot.clusterID, util.RequestClassDefault)
 	if err != nil {
 		klog.Errorf("failed to create spdk client: %v", err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
 	klog.Infof("CreateSnapshot : snapshotID=%s", sbSnapshot.snapshotID)
@@ -698,9 +745,9 @@ func (cs *controllerServer) handleSnapshotSource(snapshot *csi.VolumeContentSour
 	volumeID, err := sbclient.CloneSnapshot(sbSnapshot.snapshotID, snapshotName, newSize, pvcName)
 	if err != nil {
 		klog.Errorf("error creating simplyBlock volume: %v", err)
-		return nil, err
+		return nil, sbStatusError(err)
 	}
-	vol.VolumeId = fmt.Sprintf("%s:%s:%s", sbclient.Client.ClusterID, poolName, volumeID)
+	vol.VolumeId = fmt.Sprintf("%s:%s:%s", sbclient.ClusterID(), poolName, volumeID)
 	klog.V(5).Info("successfully Restored Snapshot from Simplyblock with Volume ID: ", vol.GetVolumeId())
 
 	return vol, nil
@@ -723,18 +770,18 @@ func (cs *controllerServer) handleVolumeSource(srcVolume *csi.VolumeContentSourc
 		klog.Errorf("failed to get spdk volume, srcVolumeID: %s err: %v", srcVolumeID, err)
 		return nil, err
 	}
-	sbclient, err := util.NewsimplyBlockClient(spdkVol.clusterID)
+	sbclient, err := cs.newBackend(spdkVol.clusterID, util.RequestClassDefault)
 	if err != nil {
 		klog.Errorf("failed to create spdk client: %v", err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 
-	klog.Infof("CreateSnapshot: clusterID=%s poolName=%s", sbclient.Client.ClusterID, poolName)
+	klog.Infof("CreateSnapshot: clusterID=%s poolName=%s", sbclient.ClusterID(), poolName)
 	snapshotID, err := sbclient.CreateSnapshot(spdkVol.lvolID, snapshotName)
-	klog.Infof("CreatedSnapshot: clusterID=%s snapshotID=%s", sbclient.Client.ClusterID, snapshotID)
+	klog.Infof("CreatedSnapshot: clusterID=%s snapshotID=%s", sbclient.ClusterID(), snapshotID)
 	if err != nil {
 		klog.Errorf("failed to create snapshot, srcVolumeID: %s snapshotName: %s err: %v", srcVolumeID, snapshotName, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, sbStatusError(err)
 	}
 	newSize := fmt.Sprintf("%dM", sizeMiB)
 	klog.Infof("CloneSnapshot : snapshotName=%s", snapshotName)
@@ -746,9 +793,9 @@ func (cs *controllerServer) handleVolumeSource(srcVolume *csi.VolumeContentSourc
 	volumeID, err := sbclient.CloneSnapshot(snapshot.snapshotID, snapshotName, newSize, pvcName)
 	if err != nil {
 		klog.Errorf("error creating simplyBlock volume: %v", err)
-		return nil, err
+		return nil, sbStatusError(err)
 	}
-	vol.VolumeId = fmt.Sprintf("%s:%s:%s", sbclient.Client.ClusterID, poolName, volumeID)
+	vol.VolumeId = fmt.Sprintf("%s:%s:%s", sbclient.ClusterID(), poolName, volumeID)
 	klog.V(5).Info("successfully created clonesnapshot volume from Simplyblock with Volume ID: ", vol.GetVolumeId())
 
 	return vol, nil
@@ -0,0 +1,264 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/simulator"
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// newSimulatedController returns a controller server talking to a simulated
+// cluster. Breaker and limiter state is global, use a unique clusterID per test.
+func newSimulatedController(t *testing.T, clusterID string) (*simulator.Simulator, *controllerServer) {
+	t.Helper()
+	sim := simulator.New(clusterID, "secret")
+	sim.AddPool("pool01", 10<<30)
+	server := httptest.NewServer(sim)
+	t.Cleanup(server.Close)
+
+	secret, err := json.Marshal(util.ClustersInfo{Clusters: []util.ClusterConfig{{
+		ClusterID:       clusterID,
+		ClusterEndpoint: server.URL,
+		ClusterSecret:   "secret",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretFile := filepath.Join(t.TempDir(), "secret.json")
+	if err := os.WriteFile(secretFile, secret, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SPDKCSI_SECRET", secretFile)
+
+	cs, err := newControllerServer(csicommon.NewCSIDriver("csi.simplyblock.io", "0.1.0", "node"), util.NewBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim, cs
+}
+
+func createVolumeRequest(clusterID, name string, size int64) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		Parameters: map[string]string{
+			"cluster_id": clusterID,
+			"pool_name":  "pool01",
+			"type":       "nvmf",
+		},
+	}
+}
+
+func TestControllerVolumeLifecycle(t *testing.T) {
+	const clusterID = "controller-lifecycle"
+	sim, cs := newSimulatedController(t, clusterID)
+	ctx := context.Background()
+
+	resp, err := cs.CreateVolume(ctx, createVolumeRequest(clusterID, "pvc-1", 1<<30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol := resp.GetVolume()
+	if !strings.HasPrefix(vol.GetVolumeId(), clusterID+":pool01:") {
+		t.Fatalf("unexpected volume ID %s", vol.GetVolumeId())
+	}
+	if vol.GetVolumeContext()["nqn"] == "" || vol.GetVolumeContext()["targetType"] != "nvmf" {
+		t.Fatalf("volume context misses connection info: %v", vol.GetVolumeContext())
+	}
+
+	// creating a volume with the same name is idempotent
+	again, err := cs.CreateVolume(ctx, createVolumeRequest(clusterID, "pvc-1", 1<<30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.GetVolume().GetVolumeId() != vol.GetVolumeId() || sim.LvolCount() != 1 {
+		t.Fatalf("volume created twice: %s, %s", vol.GetVolumeId(), again.GetVolume().GetVolumeId())
+	}
+
+	expanded, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      vol.GetVolumeId(),
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expanded.GetCapacityBytes() != 2<<30 || !expanded.GetNodeExpansionRequired() {
+		t.Fatalf("unexpected expand response %v", expanded)
+	}
+
+	snap, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: vol.GetVolumeId(), Name: "snap-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.GetSnapshot().GetSizeBytes() != 2<<30 {
+		t.Fatalf("snapshot size %d, want %d", snap.GetSnapshot().GetSizeBytes(), 2<<30)
+	}
+
+	restoreReq := createVolumeRequest(clusterID, "pvc-2", 2<<30)
+	restoreReq.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+		Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snap.GetSnapshot().GetSnapshotId()},
+	}}
+	restored, err := cs.CreateVolume(ctx, restoreReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cloneReq := createVolumeRequest(clusterID, "pvc-3", 2<<30)
+	cloneReq.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+		Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: vol.GetVolumeId()},
+	}}
+	cloned, err := cs.CreateVolume(ctx, cloneReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sim.LvolCount() != 3 {
+		t.Fatalf("%d volumes, want 3", sim.LvolCount())
+	}
+
+	for _, id := range []string{cloned.GetVolume().GetVolumeId(), restored.GetVolume().GetVolumeId(), vol.GetVolumeId()} {
+		if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snap.GetSnapshot().GetSnapshotId()}); err != nil {
+		t.Fatal(err)
+	}
+	if sim.LvolCount() != 0 {
+		t.Fatalf("%d volumes left after delete", sim.LvolCount())
+	}
+}
+
+func TestControllerCreateVolumeWithoutPVCMetadata(t *testing.T) {
+	const clusterID = "controller-no-pvc-metadata"
+	sim, cs := newSimulatedController(t, clusterID)
+
+	// without --extra-create-metadata there is no PVC to read annotations
+	// from, and no cluster to read them in this test
+	req := createVolumeRequest(clusterID, "pvc-1", 1<<30)
+	if _, ok := req.GetParameters()[CSIStorageNameKey]; ok {
+		t.Fatal("request carries PVC metadata")
+	}
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if count := sim.LvolCount(); count != 1 {
+		t.Fatalf("%d lvols after create, expected 1", count)
+	}
+}
+
+func TestControllerCreateVolumeChunkSize(t *testing.T) {
+	const clusterID = "controller-chunk-size"
+	sim, cs := newSimulatedController(t, clusterID)
+	ctx := context.Background()
+
+	req := createVolumeRequest(clusterID, "pvc-1", 1<<30)
+	req.Parameters["distr_chunk_bs"] = "65536"
+	resp, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the backend stripes the volume with the chunk size the node formats
+	// it with
+	vol, err := getSPDKVol(resp.GetVolume().GetVolumeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunkSize := sim.LvolChunkSize(vol.lvolID); chunkSize != 65536 {
+		t.Errorf("volume created with chunk size %d, want 65536", chunkSize)
+	}
+	if chunkSize := resp.GetVolume().GetVolumeContext()["distr_chunk_bs"]; chunkSize != "65536" {
+		t.Errorf("volume context has chunk size %q, want 65536", chunkSize)
+	}
+
+	req = createVolumeRequest(clusterID, "pvc-2", 1<<30)
+	req.Parameters["distr_chunk_bs"] = "1000"
+	if _, err := cs.CreateVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("volume with invalid chunk size not rejected: %v", err)
+	}
+}
+
+func TestControllerDeleteSnapshot(t *testing.T) {
+	const clusterID = "controller-delete-snapshot"
+	sim, cs := newSimulatedController(t, clusterID)
+	ctx := context.Background()
+
+	resp, err := cs.CreateVolume(ctx, createVolumeRequest(clusterID, "pvc-1", 1<<30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: resp.GetVolume().GetVolumeId(), Name: "snap-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(snap.GetSnapshot().GetSnapshotId(), clusterID+":") {
+		t.Fatalf("snapshot ID %s is not prefixed with the cluster ID", snap.GetSnapshot().GetSnapshotId())
+	}
+	if _, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snap.GetSnapshot().GetSnapshotId()}); err != nil {
+		t.Fatal(err)
+	}
+	if count := sim.SnapshotCount(); count != 0 {
+		t.Fatalf("%d snapshots left after delete", count)
+	}
+}
+
+func TestControllerCreateVolumePoolFull(t *testing.T) {
+	const clusterID = "controller-pool-full"
+	sim, cs := newSimulatedController(t, clusterID)
+	sim.SetPoolFull("pool01", true)
+
+	_, err := cs.CreateVolume(context.Background(), createVolumeRequest(clusterID, "pvc-1", 1<<30))
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "No space left") {
+		t.Fatalf("expected no space error, got %v", err)
+	}
+	if sim.LvolCount() != 0 {
+		t.Fatalf("%d volumes created on a full pool", sim.LvolCount())
+	}
+}
+
+func TestControllerUsesBackendFactory(t *testing.T) {
+	var requested []string
+	factory := func(clusterID string, _ util.RequestClass) (util.Backend, error) {
+		requested = append(requested, clusterID)
+		return nil, fmt.Errorf("cluster %s: %w", clusterID, util.ErrClusterUnavailable)
+	}
+	cs, err := newControllerServer(csicommon.NewCSIDriver("csi.simplyblock.io", "0.1.0", "node"), factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cs.CreateVolume(context.Background(), createVolumeRequest("controller-factory", "pvc-1", 1<<30))
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable, got %v", err)
+	}
+	if len(requested) != 1 || requested[0] != "controller-factory" {
+		t.Fatalf("factory called for %v", requested)
+	}
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package spdk
 
 import (
+	"context"
+	"path/filepath"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog"
 
@@ -46,6 +49,9 @@ func Run(conf *util.Config) {
 		}
 	)
 
+	util.SetRequestBudget(util.RequestClassDefault, conf.APIBudget)
+	util.SetRequestBudget(util.RequestClassMonitor, conf.MonitorAPIBudget)
+
 	cd = csicommon.NewCSIDriver(conf.DriverName, conf.DriverVersion, conf.NodeID)
 	if cd == nil {
 		klog.Fatalln("Failed to initialize CSI Driver.")
@@ -58,21 +64,37 @@ func Run(conf *util.Config) {
 	ids = newIdentityServer(cd)
 
 	if conf.IsNodeServer {
-		var err error
-		ns, err = newNodeServer(cd)
+		// used by every connect, also of the goroutines the node server starts
+		identity, err := util.InitHostIdentity(conf.StateDir, conf.NodeID)
+		if err != nil {
+			klog.Fatalf("failed to initialize the host identity: %s", err)
+		}
+		ns, err = newNodeServer(cd, conf.NodeID)
 		if err != nil {
 			klog.Fatalf("failed to create node server: %s", err)
 		}
+		ns.hostIdentity = identity
+		ns.events = newVolumeEvents(conf.NodeID)
+		// runs once on startup, also with the periodic collection disabled
+		ns.orphans = util.NewOrphanCollector(filepath.Join(conf.KubeletDir, "plugins"), ns.mounter, conf.OrphanGCGracePeriod, conf.OrphanGCDryRun)
+		ns.reconcile(filepath.Join(conf.KubeletDir, "plugins"))
+		// the paths of staged volumes are repaired once reconciled
+		go util.NewPathHealthController().Run(context.Background())
+		if conf.OrphanGCInterval > 0 {
+			go ns.orphans.Run(context.Background(), conf.OrphanGCInterval)
+		}
 	}
 
 	if conf.IsControllerServer {
 		var err error
-		cs, err = newControllerServer(cd)
+		cs, err = newControllerServer(cd, util.NewBackend)
 		if err != nil {
 			klog.Fatalf("failed to create controller server: %s", err)
 		}
 	}
 
+	util.ServeMetrics(conf.MetricsEndpoint)
+
 	s := csicommon.NewNonBlockingGRPCServer()
 	s.Start(conf.Endpoint, ids, cs, ns)
 	s.Wait()
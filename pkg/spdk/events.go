@@ -0,0 +1,81 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+// volumeEvents emits Kubernetes events on the PVCs of volumes
+type volumeEvents struct {
+	clientset kubernetes.Interface
+	recorder  record.EventRecorder
+}
+
+// newVolumeEvents returns the events of the node plugin on nodeID, nil
+// outside a cluster
+func newVolumeEvents(nodeID string) *volumeEvents {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		klog.Warningf("not emitting volume events, failed to get in-cluster config: %v", err)
+		return nil
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Warningf("not emitting volume events, failed to create clientset: %v", err)
+		return nil
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return &volumeEvents{
+		clientset: clientset,
+		recorder:  broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "simplyblock-csi-node", Host: nodeID}),
+	}
+}
+
+// Event emits an event on the PVC of a volume. Only volumes provisioned
+// with the PVC metadata (--extra-create-metadata) know their PVC, the
+// event is dropped for others.
+func (e *volumeEvents) Event(volumeContext map[string]string, eventType, reason, message string) {
+	if e == nil {
+		return
+	}
+	name, namespace := volumeContext[CSIStorageNameKey], volumeContext[CSIStorageNamespaceKey]
+	if name == "" || namespace == "" {
+		klog.V(5).Infof("volume %s has no PVC, dropping event %s", volumeContext["volumeID"], reason)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the event refers to the PVC by UID
+	pvc, err := e.clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("failed to get PVC %s/%s, dropping event %s: %v", namespace, name, reason, err)
+		return
+	}
+	e.recorder.Event(pvc, eventType, reason, message)
+}
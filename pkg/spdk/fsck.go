@@ -0,0 +1,193 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"k8s.io/utils/exec"
+)
+
+// fsck policies by fsck_policy storage class parameter
+const (
+	fsckPolicyNone   = "none"
+	fsckPolicyCheck  = "check"
+	fsckPolicyRepair = "repair"
+)
+
+// fsckResult is the outcome of a filesystem check
+type fsckResult int
+
+const (
+	fsckClean fsckResult = iota
+	fsckRepaired
+	// fsckLogDirty is a journal or log left to replay by the mount
+	fsckLogDirty
+	fsckFailed
+	fsckError
+)
+
+// validateFsckPolicy returns an error if the fsck_policy storage class
+// parameter names no policy
+func validateFsckPolicy(params map[string]string) error {
+	switch params["fsck_policy"] {
+	case "", fsckPolicyNone, fsckPolicyCheck, fsckPolicyRepair:
+		return nil
+	}
+	return fmt.Errorf("unknown fsck_policy %q, expected one of %s, %s, %s", params["fsck_policy"], fsckPolicyNone, fsckPolicyCheck, fsckPolicyRepair)
+}
+
+// fsckCommand returns the command checking or repairing a filesystem, nil
+// if there is none. btrfs is only checked, its repair is not safe to run
+// unattended.
+func fsckCommand(fsType string, repair bool) []string {
+	switch fsType {
+	case "ext4", "ext3":
+		if repair {
+			return []string{"e2fsck", "-f", "-y"}
+		}
+		return []string{"e2fsck", "-f", "-n"}
+	case "xfs":
+		if repair {
+			return []string{"xfs_repair"}
+		}
+		return []string{"xfs_repair", "-n"}
+	case "btrfs":
+		return []string{"btrfs", "check", "--readonly"}
+	}
+	return nil
+}
+
+// fsckOutcome returns the result of a fsckCommand by its exit status
+func fsckOutcome(fsType string, repair bool, exitStatus int) fsckResult {
+	switch {
+	case exitStatus == 0:
+		return fsckClean
+	case fsType == "ext4" || fsType == "ext3":
+		// bit 1 and 2 are errors corrected, 4 errors left, 8 and more
+		// failures of e2fsck itself
+		switch {
+		case exitStatus >= 8:
+			return fsckError
+		case exitStatus&4 != 0:
+			return fsckFailed
+		case repair:
+			return fsckRepaired
+		}
+		return fsckFailed
+	case fsType == "xfs":
+		if repair && exitStatus == 2 {
+			return fsckLogDirty
+		}
+		if exitStatus == 1 {
+			return fsckFailed
+		}
+		return fsckError
+	}
+	return fsckFailed
+}
+
+// fsckLogDirtyMarkers are printed by the read-only checks of filesystems
+// with a journal or log to replay, their findings may be spurious then
+var fsckLogDirtyMarkers = map[string]string{
+	"ext4": "skipping journal recovery",
+	"ext3": "skipping journal recovery",
+	"xfs":  "valuable metadata changes in a log",
+}
+
+// fsckLogIsDirty returns whether the output of a read-only check reports a
+// journal or log that needs to be replayed
+func fsckLogIsDirty(fsType string, output []byte) bool {
+	marker, ok := fsckLogDirtyMarkers[fsType]
+	return ok && strings.Contains(string(output), marker)
+}
+
+// checkFilesystem runs the fsck policy of a volume on its existing
+// filesystem before it is mounted. A volume mounted read-only is only
+// checked. It reports the result in the node log and as event of the PVC,
+// and returns an error if the filesystem must not be mounted.
+func (ns *nodeServer) checkFilesystem(executor exec.Interface, devicePath, fsType string, readOnly bool, volumeContext map[string]string) error {
+	policy := volumeContext["fsck_policy"]
+	if policy == "" || policy == fsckPolicyNone {
+		return nil
+	}
+	repair := policy == fsckPolicyRepair && !readOnly
+	command := fsckCommand(fsType, repair)
+	if command == nil {
+		klog.Infof("no filesystem check for %s, skipping fsck of %s", fsType, devicePath)
+		return nil
+	}
+	command = append(command, devicePath)
+
+	klog.Infof("running %s", strings.Join(command, " "))
+	output, err := executor.Command(command[0], command[1:]...).CombinedOutput()
+	exitStatus := 0
+	result := fsckError
+	var exitErr exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitStatus = exitErr.ExitStatus()
+		result = fsckOutcome(fsType, repair, exitStatus)
+	} else if err == nil {
+		result = fsckClean
+	}
+	if !repair && (result == fsckClean || result == fsckFailed) && fsckLogIsDirty(fsType, output) {
+		result = fsckLogDirty
+	}
+
+	volumeID := volumeContext["volumeID"]
+	switch result {
+	case fsckClean:
+		klog.Infof("filesystem check of volume %s (%s) passed", volumeID, devicePath)
+		ns.events.Event(volumeContext, corev1.EventTypeNormal, "FilesystemCheckPassed", fmt.Sprintf("%s filesystem check passed", fsType))
+		return nil
+	case fsckRepaired:
+		klog.Warningf("filesystem of volume %s (%s) repaired:\n%s", volumeID, devicePath, output)
+		ns.events.Event(volumeContext, corev1.EventTypeWarning, "FilesystemRepaired", fmt.Sprintf("%s filesystem errors were repaired: %s", fsType, lastLine(output)))
+		return nil
+	case fsckLogDirty:
+		action := "checked"
+		if repair {
+			action = "repaired"
+		}
+		if readOnly {
+			// mounted with noLogReplayFlags
+			klog.Warningf("filesystem of volume %s (%s) has a dirty log, mounting it read-only without replaying the log:\n%s", volumeID, devicePath, output)
+			ns.events.Event(volumeContext, corev1.EventTypeNormal, "FilesystemLogReplay", fmt.Sprintf("%s log is dirty and not replayed on the read-only volume, not %s", fsType, action))
+			return nil
+		}
+		klog.Warningf("filesystem of volume %s (%s) has a dirty log, mounting it to replay the log:\n%s", volumeID, devicePath, output)
+		ns.events.Event(volumeContext, corev1.EventTypeNormal, "FilesystemLogReplay", fmt.Sprintf("%s log is dirty and replayed by the mount, not %s", fsType, action))
+		return nil
+	case fsckFailed:
+		klog.Errorf("filesystem check of volume %s (%s) failed, not mounting it:\n%s", volumeID, devicePath, output)
+		ns.events.Event(volumeContext, corev1.EventTypeWarning, "FilesystemCheckFailed", fmt.Sprintf("%s filesystem has errors, not mounted: %s", fsType, lastLine(output)))
+		return fmt.Errorf("filesystem of %s has errors, %s exited with %d", devicePath, command[0], exitStatus)
+	}
+	klog.Errorf("failed to check filesystem of volume %s (%s): %v\n%s", volumeID, devicePath, err, output)
+	ns.events.Event(volumeContext, corev1.EventTypeWarning, "FilesystemCheckFailed", fmt.Sprintf("%s filesystem check could not run: %v", fsType, err))
+	return fmt.Errorf("failed to check filesystem of %s: %w", devicePath, err)
+}
+
+// lastLine returns the last line of command output, the summary of fsck
+func lastLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,129 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+func TestFsckOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		fsType     string
+		repair     bool
+		exitStatus int
+		want       fsckResult
+	}{
+		{"ext4", false, 0, fsckClean},
+		{"ext4", false, 4, fsckFailed},
+		{"ext4", true, 1, fsckRepaired},
+		{"ext4", true, 5, fsckFailed},
+		{"ext4", true, 8, fsckError},
+		{"xfs", false, 1, fsckFailed},
+		{"xfs", true, 2, fsckLogDirty},
+		{"xfs", false, 2, fsckError},
+		{"btrfs", false, 1, fsckFailed},
+	} {
+		if got := fsckOutcome(tc.fsType, tc.repair, tc.exitStatus); got != tc.want {
+			t.Errorf("%s repair %v exit %d: %d, want %d", tc.fsType, tc.repair, tc.exitStatus, got, tc.want)
+		}
+	}
+
+	if err := validateFsckPolicy(map[string]string{"fsck_policy": "repair"}); err != nil {
+		t.Error(err)
+	}
+	if err := validateFsckPolicy(map[string]string{"fsck_policy": "fix"}); err == nil {
+		t.Error("unknown fsck policy accepted")
+	}
+}
+
+// fakeFsck returns an executor running a fake fsck with the output and exit
+// status, and the command line it ran
+func fakeFsck(output string, exitStatus int, runErr error) (*testingexec.FakeExec, *[]string) {
+	var argv []string
+	fake := &testingexec.FakeExec{}
+	fake.CommandScript = append(fake.CommandScript, func(cmd string, args ...string) exec.Cmd {
+		argv = append([]string{cmd}, args...)
+		fakeCmd := &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{
+			func() ([]byte, []byte, error) {
+				err := runErr
+				if exitStatus != 0 {
+					err = testingexec.FakeExitError{Status: exitStatus}
+				}
+				return []byte(output), nil, err
+			},
+		}}
+		return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+	})
+	return fake, &argv
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	const (
+		ext4Dirty = "Warning: skipping journal recovery because doing a read-only filesystem check.\n" +
+			"/dev/nvme0n1: clean, 11/65536 files, 12955/262144 blocks"
+		xfsDirty = "ALERT: The filesystem has valuable metadata changes in a log which is being\n" +
+			"ignored because the -n option was used.  Expect spurious inconsistencies\n" +
+			"which may be resolved by first mounting the filesystem to replay the log."
+	)
+	ns := &nodeServer{}
+	for _, tc := range []struct {
+		name       string
+		policy     string
+		fsType     string
+		readOnly   bool
+		output     string
+		exitStatus int
+		runErr     error
+		command    string
+		wantErr    bool
+	}{
+		{name: "no policy", fsType: "ext4"},
+		{name: "ext4 clean", policy: "check", fsType: "ext4", command: "e2fsck -f -n /dev/nvme0n1"},
+		{name: "ext4 errors", policy: "check", fsType: "ext4", output: "Inode 12 has illegal blocks", exitStatus: 4,
+			command: "e2fsck -f -n /dev/nvme0n1", wantErr: true},
+		{name: "ext4 needs recovery", policy: "check", fsType: "ext4", output: ext4Dirty, exitStatus: 4,
+			command: "e2fsck -f -n /dev/nvme0n1"},
+		{name: "ext4 repaired", policy: "repair", fsType: "ext4", exitStatus: 1, command: "e2fsck -f -y /dev/nvme0n1"},
+		{name: "ext4 read-only is only checked", policy: "repair", fsType: "ext4", readOnly: true, exitStatus: 4,
+			command: "e2fsck -f -n /dev/nvme0n1", wantErr: true},
+		{name: "xfs errors", policy: "check", fsType: "xfs", output: "agf_freeblks 12, counted 13", exitStatus: 1,
+			command: "xfs_repair -n /dev/nvme0n1", wantErr: true},
+		{name: "xfs dirty log", policy: "check", fsType: "xfs", output: xfsDirty, exitStatus: 1,
+			command: "xfs_repair -n /dev/nvme0n1"},
+		{name: "xfs dirty log on repair", policy: "repair", fsType: "xfs", exitStatus: 2, command: "xfs_repair /dev/nvme0n1"},
+		{name: "check not run", policy: "check", fsType: "xfs", runErr: errors.New("executable file not found"),
+			command: "xfs_repair -n /dev/nvme0n1", wantErr: true},
+		{name: "no check", policy: "check", fsType: "vfat"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			executor, argv := fakeFsck(tc.output, tc.exitStatus, tc.runErr)
+			volumeContext := map[string]string{"volumeID": "vol1", "fsck_policy": tc.policy}
+			err := ns.checkFilesystem(executor, "/dev/nvme0n1", tc.fsType, tc.readOnly, volumeContext)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("error %v, want error %v", err, tc.wantErr)
+			}
+			if command := strings.Join(*argv, " "); command != tc.command {
+				t.Errorf("ran %q, want %q", command, tc.command)
+			}
+		})
+	}
+}
@@ -20,8 +20,11 @@ import (
 	"context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/klog"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/util"
 )
 
 type identityServer struct {
@@ -34,6 +37,22 @@ func newIdentityServer(d *csicommon.CSIDriver) *identityServer {
 	}
 }
 
+// Probe reports the plugin as not ready only if the circuit of every cluster
+// contacted so far is open, as no request can succeed in that case.
+func (ids *identityServer) Probe(_ context.Context, _ *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	states := util.ClusterCircuitStates()
+	ready := len(states) == 0
+	for clusterID, state := range states {
+		if state == util.CircuitOpen {
+			klog.Warningf("probe: circuit of cluster %s is %s", clusterID, state)
+			continue
+		}
+		klog.V(5).Infof("probe: circuit of cluster %s is %s", clusterID, state)
+		ready = true
+	}
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(ready)}, nil
+}
+
 func (ids *identityServer) GetPluginCapabilities(_ context.Context, _ *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	return &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
@@ -0,0 +1,155 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	defaultFsType = "ext4"
+	// defaultChunkSize is the chunk size of the storage cluster in bytes,
+	// the data of a volume is striped over distr_ndcs chunks
+	defaultChunkSize = 4096
+	// ext4BlockSize is the block size of ext4 volumes unless the mkfs options
+	// set one, mkfs.ext4 picks smaller ones for small volumes
+	ext4BlockSize = 4096
+	// xfsMaxLogSunit is the largest log stripe unit of XFS in 512 byte
+	// sectors, 256KiB
+	xfsMaxLogSunit = 512
+)
+
+// mkfsOptionsParams are the storage class parameters with extra mkfs
+// options by filesystem
+var mkfsOptionsParams = map[string]string{
+	"ext4":  "mkfs_ext4_options",
+	"xfs":   "mkfs_xfs_options",
+	"btrfs": "mkfs_btrfs_options",
+}
+
+// stripeOptionsRe matches mkfs options that set the stripe geometry, the
+// computed one is left out then
+var stripeOptionsRe = map[string]*regexp.Regexp{
+	"ext4": regexp.MustCompile(`\b(stride|stripe[_-]width)=`),
+	"xfs":  regexp.MustCompile(`\b(sunit|swidth|su|sw)=`),
+}
+
+// mountFsType returns the filesystem of a mount capability, ext4 if none
+// is given
+func mountFsType(mnt *csi.VolumeCapability_MountVolume) string {
+	if fsType := mnt.GetFsType(); fsType != "" {
+		return fsType
+	}
+	return defaultFsType
+}
+
+// mkfsOptions returns the options to format a volume with: the stripe
+// geometry of the volume and the extra options of the storage class for the
+// filesystem. Options for another filesystem are an error.
+func mkfsOptions(fsType string, volumeContext map[string]string) ([]string, error) {
+	for fs, param := range mkfsOptionsParams {
+		if _, ok := volumeContext[param]; ok && fs != fsType {
+			return nil, fmt.Errorf("%s does not apply to %s volumes", param, fsType)
+		}
+	}
+	extra := strings.Fields(volumeContext[mkfsOptionsParams[fsType]])
+
+	var options []string
+	if re, ok := stripeOptionsRe[fsType]; ok && !re.MatchString(strings.Join(extra, " ")) {
+		chunkSize, dataChunks, err := stripeGeometry(volumeContext)
+		if err != nil {
+			return nil, err
+		}
+		switch fsType {
+		case "ext4":
+			return ext4StripeOptions(extra, chunkSize, dataChunks)
+		case "xfs":
+			// in 512 byte sectors
+			sunit := chunkSize / 512
+			options = append(options,
+				"-d", fmt.Sprintf("sunit=%d,swidth=%d", sunit, sunit*dataChunks),
+				"-l", fmt.Sprintf("sunit=%d", min(sunit, xfsMaxLogSunit)))
+		}
+	}
+	return append(options, extra...), nil
+}
+
+// ext4StripeOptions returns the extra ext4 options with the stripe geometry
+// merged into their extended options, mke2fs only keeps the last -E. The
+// stride is in blocks of the block size of the options, -b 4096 if none.
+func ext4StripeOptions(extra []string, chunkSize, dataChunks int) ([]string, error) {
+	var options, extended []string
+	var blockSize int
+	for i := 0; i < len(extra); i++ {
+		opt, value := extra[i], ""
+		switch {
+		case opt == "-E" || opt == "-b":
+			if i+1 == len(extra) {
+				return nil, fmt.Errorf("mkfs option %s without a value", opt)
+			}
+			i++
+			value = extra[i]
+		case strings.HasPrefix(opt, "-E") || strings.HasPrefix(opt, "-b"):
+			opt, value = opt[:2], opt[2:]
+		default:
+			options = append(options, opt)
+			continue
+		}
+		if opt == "-E" {
+			extended = append(extended, value)
+			continue
+		}
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid block size %q in mkfs options", value)
+		}
+		blockSize = size
+	}
+	if blockSize == 0 {
+		blockSize = ext4BlockSize
+	}
+
+	// in filesystem blocks
+	stride := max(chunkSize/blockSize, 1)
+	extended = append([]string{fmt.Sprintf("stride=%d,stripe_width=%d", stride, stride*dataChunks)}, extended...)
+	return append([]string{"-b", strconv.Itoa(blockSize), "-E", strings.Join(extended, ",")}, options...), nil
+}
+
+// stripeGeometry returns the chunk size in bytes and the number of data
+// chunks of a stripe of the volume
+func stripeGeometry(volumeContext map[string]string) (chunkSize, dataChunks int, err error) {
+	chunkSize, dataChunks = defaultChunkSize, 1
+	if s := volumeContext["distr_chunk_bs"]; s != "" {
+		chunkSize, err = strconv.Atoi(s)
+		if err != nil || chunkSize <= 0 || chunkSize%defaultChunkSize != 0 {
+			return 0, 0, fmt.Errorf("distr_chunk_bs must be a positive multiple of %d", defaultChunkSize)
+		}
+	}
+	if s := volumeContext["distr_ndcs"]; s != "" {
+		dataChunks, err = strconv.Atoi(s)
+		if err != nil || dataChunks <= 0 {
+			return 0, 0, errors.New("distr_ndcs must be a positive number")
+		}
+	}
+	return chunkSize, dataChunks, nil
+}
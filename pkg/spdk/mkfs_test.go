@@ -0,0 +1,109 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMkfsOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		fsType        string
+		volumeContext map[string]string
+		want          []string
+		wantErr       bool
+	}{
+		{
+			name:          "ext4 default chunk size",
+			fsType:        "ext4",
+			volumeContext: map[string]string{"distr_ndcs": "2"},
+			want:          []string{"-b", "4096", "-E", "stride=1,stripe_width=2"},
+		},
+		{
+			name:          "ext4 extra options",
+			fsType:        "ext4",
+			volumeContext: map[string]string{"distr_ndcs": "4", "distr_chunk_bs": "16384", "mkfs_ext4_options": "-O ^has_journal"},
+			want:          []string{"-b", "4096", "-E", "stride=4,stripe_width=16", "-O", "^has_journal"},
+		},
+		{
+			name:          "ext4 extended options",
+			fsType:        "ext4",
+			volumeContext: map[string]string{"distr_ndcs": "2", "distr_chunk_bs": "16384", "mkfs_ext4_options": "-E lazy_itable_init=0 -O ^has_journal -Enodiscard"},
+			want:          []string{"-b", "4096", "-E", "stride=4,stripe_width=8,lazy_itable_init=0,nodiscard", "-O", "^has_journal"},
+		},
+		{
+			name:          "ext4 block size",
+			fsType:        "ext4",
+			volumeContext: map[string]string{"distr_ndcs": "2", "distr_chunk_bs": "16384", "mkfs_ext4_options": "-b 1024"},
+			want:          []string{"-b", "1024", "-E", "stride=16,stripe_width=32"},
+		},
+		{
+			name:          "ext4 with own geometry",
+			fsType:        "ext4",
+			volumeContext: map[string]string{"distr_ndcs": "2", "mkfs_ext4_options": "-b 1024 -E stride=8"},
+			want:          []string{"-b", "1024", "-E", "stride=8"},
+		},
+		{
+			name:          "ext4 invalid block size",
+			fsType:        "ext4",
+			volumeContext: map[string]string{"mkfs_ext4_options": "-b 4k"},
+			wantErr:       true,
+		},
+		{
+			name:          "xfs",
+			fsType:        "xfs",
+			volumeContext: map[string]string{"distr_ndcs": "4", "distr_chunk_bs": "524288"},
+			want:          []string{"-d", "sunit=1024,swidth=4096", "-l", "sunit=512"},
+		},
+		{
+			name:          "xfs with own geometry",
+			fsType:        "xfs",
+			volumeContext: map[string]string{"distr_ndcs": "4", "mkfs_xfs_options": "-d su=64k,sw=4"},
+			want:          []string{"-d", "su=64k,sw=4"},
+		},
+		{
+			name:          "btrfs",
+			fsType:        "btrfs",
+			volumeContext: map[string]string{"distr_ndcs": "2", "mkfs_btrfs_options": "-m single"},
+			want:          []string{"-m", "single"},
+		},
+		{
+			name:          "options of another filesystem",
+			fsType:        "xfs",
+			volumeContext: map[string]string{"mkfs_ext4_options": "-O ^has_journal"},
+			wantErr:       true,
+		},
+		{
+			name:          "invalid chunk size",
+			fsType:        "ext4",
+			volumeContext: map[string]string{"distr_chunk_bs": "1000"},
+			wantErr:       true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := mkfsOptions(tc.fsType, tc.volumeContext)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error %v, want error %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("options %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
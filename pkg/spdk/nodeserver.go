@@ -19,39 +19,61 @@ package spdk
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
-	osexec "os/exec"
-	"strconv"
-	"time"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"google.golang.org/grpc"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
 	mount "k8s.io/mount-utils"
 	"k8s.io/utils/exec"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/nvme"
 	"github.com/spdk/spdk-csi/pkg/util"
 )
 
+// the kernel and sysfs as seen by the node server, replaced by tests
+var (
+	setDeviceReadOnly = util.SetDeviceReadOnly
+	volumeDevicePath  = util.VolumeDevicePath
+	isNQNConnected    = util.IsNQNConnected
+)
+
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
-	mounter       mount.Interface
-	volumeLocks   *util.VolumeLocks
-	xpuConnClient *grpc.ClientConn
-	xpuTargetType string
-	kvmPciBridges int
+	mounter     mount.Interface
+	executor    exec.Interface
+	volumeLocks *util.VolumeLocks
+	// nodeID is the CSI node ID, cache volumes find their caching node by it
+	nodeID string
+	// xpus are nil on nodes without xPU
+	xpus *util.XPUPool
+	// events are nil outside a cluster
+	events *volumeEvents
+	// hostIdentity is reported in NodeGetInfo
+	hostIdentity *util.HostIdentity
+	// orphans tears down the orphan connections on startup, nil outside a
+	// cluster
+	orphans *util.OrphanCollector
 }
 
-func newNodeServer(d *csicommon.CSIDriver) (*nodeServer, error) {
+// topologyKeyNVMeHostID reports the NVMe host ID of the node, the host NQN
+// is derived from it. Kubelet adds it as node label. It does not constrain
+// where volumes are accessible: the controller does not advertise
+// VOLUME_ACCESSIBILITY_CONSTRAINTS and returns no accessible topology.
+const topologyKeyNVMeHostID = "simplyblock.io/nvme-host-id"
+
+func newNodeServer(d *csicommon.CSIDriver, nodeID string) (*nodeServer, error) {
 	ns := &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
 		mounter:           mount.New(""),
+		executor:          exec.New(),
 		volumeLocks:       util.NewVolumeLocks(),
+		nodeID:            nodeID,
 	}
 
 	// get xPU nodes' configs, see deploy/kubernetes/nodeserver-config-map.yaml
@@ -67,12 +89,8 @@ func newNodeServer(d *csicommon.CSIDriver) (*nodeServer, error) {
 	}
 	//nolint:tagliatelle // not using json:snake case
 	var config struct {
-		XPUList []struct {
-			Name       string `json:"name"`
-			TargetType string `json:"targetType"`
-			TargetAddr string `json:"targetAddr"`
-		} `json:"xpuList"`
-		KvmPciBridges int `json:"kvmPciBridges,omitempty"`
+		XPUList       []util.XPUConfig `json:"xpuList"`
+		KvmPciBridges int              `json:"kvmPciBridges,omitempty"`
 	}
 
 	err = util.ParseJSONFile(configFile, &config)
@@ -80,56 +98,123 @@ func newNodeServer(d *csicommon.CSIDriver) (*nodeServer, error) {
 		return nil, fmt.Errorf("error in the configuration file specified in %s (%s by default): %w", spdkcsiNodeServerConfigFileEnv, spdkcsiNodeServerConfigFile, err)
 	}
 	klog.Infof("obtained xPU info (%v) from configuration file (%s)", config.XPUList, spdkcsiNodeServerConfigFile)
-
-	ns.kvmPciBridges = config.KvmPciBridges
 	klog.Infof("obtained KvmPciBridges num (%v) from configuration file (%s)", config.KvmPciBridges, spdkcsiNodeServerConfigFile)
 
-	// try to set up a connection to the first available xPU node in the list via grpc
-	// once the connection is built, send pings every 10 seconds if there is no activity
-	// FIXME (JingYan): when there are multiple xPU nodes, find a better way to choose one to connect with
-
-	var xpuConnClient, conn *grpc.ClientConn
-	var xpuTargetType string
-
-	for i := range config.XPUList {
-		if config.XPUList[i].TargetType != "" && config.XPUList[i].TargetAddr != "" {
-			klog.Infof("TargetType: %v, TargetAddr: %v.", config.XPUList[i].TargetType, config.XPUList[i].TargetAddr)
-			conn, err = grpc.Dial(
-				config.XPUList[i].TargetAddr,
-				grpc.WithTransportCredentials(insecure.NewCredentials()),
-				grpc.WithBlock(),
-				grpc.WithKeepaliveParams(keepalive.ClientParameters{
-					Time:                10 * time.Second,
-					Timeout:             1 * time.Second,
-					PermitWithoutStream: true,
-				}),
-				grpc.FailOnNonTempDialError(true),
-			)
-			if err != nil {
-				klog.Errorf("failed to connect to xPU node in: %s, %s", config.XPUList[i].TargetAddr, err)
-			} else {
-				klog.Infof("connected to xPU node %v with TargetType as %v", config.XPUList[i].TargetAddr, config.XPUList[i].TargetType)
-				xpuConnClient = conn
-				xpuTargetType = config.XPUList[i].TargetType
-				break
-			}
-		} else {
-			klog.Errorf("missing xPU TargetType or TargetAddr in xPUList index %d, skipping this xPU node", i)
-		}
+	// keep connections to all xPUs, volumes are spread across the healthy ones
+	ns.xpus = util.NewXPUPool(config.XPUList, config.KvmPciBridges)
+	if ns.xpus == nil {
+		klog.Infof("xpuList has no usable xPU node, will continue without xPU node")
+	} else {
+		go ns.xpus.Run(context.Background())
 	}
-	if xpuConnClient == nil && xpuTargetType == "" {
-		klog.Infof("failed to connect to any xPU node in the xpuList or xpuList is empty, will continue without xPU node")
+
+	return ns, nil
+}
+
+func (ns *nodeServer) NodeGetVolumeStats(_ context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	if volumeID == "" || volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID and volume path must be provided")
 	}
-	ns.xpuConnClient = xpuConnClient
-	ns.xpuTargetType = xpuTargetType
 
-	go util.MonitorConnection()
+	info, err := os.Stat(volumePath)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s not found", volumePath)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stat volume path %s: %v", volumePath, err)
+	}
 
-	return ns, nil
+	var usage []*csi.VolumeUsage
+	if info.IsDir() {
+		usage, err = filesystemUsage(volumePath)
+	} else {
+		usage, err = blockUsage(volumePath)
+	}
+	if err != nil {
+		klog.Errorf("failed to get volume stats, volumeID: %s err: %v", volumeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: ns.volumeCondition(req.GetStagingTargetPath()),
+	}, nil
+}
+
+// filesystemUsage returns bytes and inodes of the filesystem mounted at path
+func filesystemUsage(path string) ([]*csi.VolumeUsage, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(path, &statfs); err != nil {
+		return nil, fmt.Errorf("failed to statfs %s: %w", path, err)
+	}
+	blockSize := statfs.Bsize
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * blockSize,
+			Available: int64(statfs.Bavail) * blockSize,
+			Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		},
+	}, nil
 }
 
-func (ns *nodeServer) NodeGetVolumeStats(_ context.Context, _ *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// blockUsage returns the size of the block device published at path, used
+// and available bytes are unknown for raw block volumes
+func blockUsage(path string) ([]*csi.VolumeUsage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get size of %s: %w", path, err)
+	}
+	return []*csi.VolumeUsage{
+		{
+			Unit:  csi.VolumeUsage_BYTES,
+			Total: size,
+		},
+	}, nil
+}
+
+// volumeCondition checks the NVMe paths of the device of the volume stashed
+// at stagingParentPath, or the xPU it is attached through
+func (ns *nodeServer) volumeCondition(stagingParentPath string) *csi.VolumeCondition {
+	if stagingParentPath == "" {
+		return &csi.VolumeCondition{Message: "staging path unknown, volume condition not checked"}
+	}
+	volumeContext, err := util.LookupVolumeContext(stagingParentPath)
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume context not found: %v", err)}
+	}
+	// the stashed device path may have changed with a reconnect
+	devicePath, err := volumeDevicePath(volumeContext)
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("device of the volume not found: %v", err)}
+	}
+	if util.IsXPUTargetType(volumeContext["targetType"]) {
+		xpuContext, err := util.LookupXPUContext(stagingParentPath)
+		if err != nil {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("xPU context not found: %v", err)}
+		}
+		if !ns.xpus.IsHealthy(xpuContext["xpu"]) {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("xPU %s is unhealthy, stage the volume again to move it", xpuContext["xpu"])}
+		}
+		return &csi.VolumeCondition{Message: fmt.Sprintf("attached through xPU %s", xpuContext["xpu"])}
+	}
+	if !util.IsNVMfTarget(volumeContext["targetType"]) {
+		return &csi.VolumeCondition{Message: fmt.Sprintf("%s volume, path states not checked", volumeContext["targetType"])}
+	}
+	abnormal, message := util.VolumeCondition(devicePath)
+	return &csi.VolumeCondition{Abnormal: abnormal, Message: message}
 }
 
 func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
@@ -154,10 +239,65 @@ func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolum
 	vc := req.GetVolumeContext()
 
 	vc["stagingParentPath"] = stagingParentPath
-	initiator, err = util.NewSpdkCsiInitiator(vc)
+	vc["volumeID"] = volumeID
+
+	// volumes sharing the subsystem use the same stashed state
+	defer util.LockSubsystem(vc["nqn"])()
+
+	// refuse invalid filesystem parameters before connecting
+	if mnt := req.GetVolumeCapability().GetMount(); mnt != nil {
+		if _, err = mkfsOptions(mountFsType(mnt), vc); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err = validateFsckPolicy(vc); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	// NVMe-oF secrets are kept apart from the stashed volume context
+	auth, err := util.TakeNVMfAuth(req.GetSecrets(), vc)
 	if err != nil {
-		klog.Errorf("failed to create spdk initiator, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the xPU connects NVMe-oF volumes and exposes them to the host
+	useXPU := ns.xpus != nil && util.IsNVMfTarget(vc["targetType"])
+	if useXPU && auth != nil {
+		return nil, status.Error(codes.InvalidArgument, "NVMe-oF authentication is not supported through an xPU")
+	}
+	// a failed first stage leaves no state of the subsystem behind
+	connected := false
+	defer func() {
+		if err != nil && !connected && util.IsNVMfTarget(vc["targetType"]) {
+			util.CleanUpUnusedSubsystem(vc["nqn"])
+		}
+	}()
+	if auth != nil {
+		if err = util.StashNVMfAuth(vc["nqn"], auth); err != nil {
+			klog.Errorf("failed to stash secrets, volumeID: %s err: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	var xpuInitiator *util.XPUInitiator
+	if useXPU {
+		xpuInitiator, err = ns.xpus.NewInitiator(vc)
+		if err != nil {
+			klog.Errorf("failed to create xPU initiator, volumeID: %s err: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		initiator = xpuInitiator
+	} else {
+		// reconnects of lost paths only know the NQN
+		if util.IsNVMfTarget(vc["targetType"]) {
+			if err = util.StashConnectParams(vc["nqn"], util.VolumeConnectParams(vc)); err != nil {
+				klog.Errorf("failed to stash connect parameters, volumeID: %s err: %v", volumeID, err)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		initiator, err = util.NewSpdkCsiInitiator(vc, ns.nodeID)
+		if err != nil {
+			klog.Errorf("failed to create spdk initiator, volumeID: %s err: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
 	devicePath, err := initiator.Connect() // idempotent
@@ -165,11 +305,37 @@ func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolum
 		klog.Errorf("failed to connect initiator, volumeID: %s err: %v", volumeID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	connected = true
 	defer func() {
 		if err != nil {
 			initiator.Disconnect() //nolint:errcheck // ignore error
 		}
 	}()
+	if xpuInitiator != nil {
+		// the host sees the xPU function, not the NVMe-oF target
+		vc["targetType"] = xpuInitiator.Context()["targetType"]
+		if err = util.StashXPUContext(xpuInitiator.Context(), stagingParentPath); err != nil {
+			klog.Errorf("failed to stash xPU context, volumeID: %s err: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else if util.IsNVMfTarget(vc["targetType"]) {
+		// pin the namespace, later lookups refuse another one with the same NSID
+		var namespace *nvme.Namespace
+		if namespace, err = util.VolumeNamespace(vc); err != nil {
+			klog.Errorf("failed to find namespace, volumeID: %s err: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		vc["nsUuid"] = namespace.UUID
+		devicePath = namespace.DevicePath()
+		if err = util.TuneVolume(vc); err != nil {
+			klog.Errorf("failed to tune volume, volumeID: %s err: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err = protectDevice(devicePath, req.GetVolumeCapability(), vc); err != nil {
+		klog.Errorf("failed to set device read-only, volumeID: %s err: %v", volumeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	if err = ns.stageVolume(devicePath, stagingTargetPath, req, vc); err != nil { // idempotent
 		klog.Errorf("failed to stage volume, volumeID: %s devicePath:%s err: %v", volumeID, devicePath, err)
 		return nil, status.Error(codes.Internal, err.Error())
@@ -205,16 +371,29 @@ func (ns *nodeServer) NodeUnstageVolume(_ context.Context, req *csi.NodeUnstageV
 		klog.Errorf("failed to lookup volume context, volumeID: %s err: %v", volumeID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	initiator, err := util.NewSpdkCsiInitiator(volumeContext)
+	releaseDevice(volumeContext)
+	initiator, err := ns.stagedInitiator(stagingParentPath, volumeContext)
 	if err != nil {
 		klog.Errorf("failed to create spdk initiator, volumeID: %s err: %v", volumeID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	unlockSubsystem := util.LockSubsystem(volumeContext["nqn"])
 	err = initiator.Disconnect() // idempotent
+	unlockSubsystem()
 	if err != nil {
 		klog.Errorf("failed to disconnect initiator, volumeID: %s err: %v", volumeID, err)
+		if status.Code(err) == codes.Unavailable {
+			// the volume of an unhealthy xPU is unstaged once it is back
+			return nil, err
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if util.IsXPUTargetType(volumeContext["targetType"]) {
+		if err := util.CleanUpXPUContext(stagingParentPath); err != nil {
+			klog.Errorf("failed to clean up xPU context, volumeID: %s err: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
 	if err := util.CleanUpVolumeContext(stagingParentPath); err != nil {
 		klog.Errorf("failed to clean up volume context, volumeID: %s err: %v", volumeID, err)
 		return nil, status.Error(codes.Internal, err.Error())
@@ -222,6 +401,18 @@ func (ns *nodeServer) NodeUnstageVolume(_ context.Context, req *csi.NodeUnstageV
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// stagedInitiator returns the initiator a volume was staged with
+func (ns *nodeServer) stagedInitiator(stagingParentPath string, volumeContext map[string]string) (util.SpdkCsiInitiator, error) {
+	if !util.IsXPUTargetType(volumeContext["targetType"]) {
+		return util.NewSpdkCsiInitiator(volumeContext, ns.nodeID)
+	}
+	xpuContext, err := util.LookupXPUContext(stagingParentPath)
+	if err != nil {
+		return nil, err
+	}
+	return ns.xpus.StagedInitiator(volumeContext, xpuContext)
+}
+
 func (ns *nodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	unlock := ns.volumeLocks.Lock(volumeID)
@@ -248,6 +439,18 @@ func (ns *nodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpubl
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil || ns.hostIdentity == nil {
+		return resp, err
+	}
+	// the host NQN is no valid label value
+	resp.AccessibleTopology = &csi.Topology{
+		Segments: map[string]string{topologyKeyNVMeHostID: ns.hostIdentity.HostID},
+	}
+	return resp, nil
+}
+
 func (ns *nodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
@@ -265,6 +468,13 @@ func (ns *nodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapab
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
 			{
 				Type: &csi.NodeServiceCapability_Rpc{
 					Rpc: &csi.NodeServiceCapability_RPC{
@@ -281,6 +491,11 @@ func (ns *nodeServer) NodeExpandVolume(_ context.Context, req *csi.NodeExpandVol
 
 	volumeID := req.GetVolumeId()
 	volumeMountPath := req.GetVolumePath()
+	if volumeID == "" || volumeMountPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID and volume path must be provided")
+	}
+	unlock := ns.volumeLocks.Lock(volumeID)
+	defer unlock()
 
 	stagingParentPath := req.GetStagingTargetPath()
 	volumeContext, err := util.LookupVolumeContext(stagingParentPath)
@@ -288,9 +503,25 @@ func (ns *nodeServer) NodeExpandVolume(_ context.Context, req *csi.NodeExpandVol
 		return nil, status.Errorf(codes.Internal, "failed to retrieve volume context for volume %s: %v", volumeID, err)
 	}
 
-	devicePath, ok := volumeContext["devicePath"]
-	if !ok || devicePath == "" {
-		return nil, status.Errorf(codes.Internal, "could not find device path for volume %s", volumeID)
+	// the stashed device path may have changed with a reconnect
+	devicePath, err := volumeDevicePath(volumeContext)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not find device of volume %s: %v", volumeID, err)
+	}
+
+	// the namespace was grown on the target, make the kernel see it
+	size, err := util.RescanDevice(devicePath, req.GetCapacityRange().GetRequiredBytes())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to rescan device of volume %s: %v", volumeID, err)
+	}
+
+	isBlock := req.GetVolumeCapability().GetBlock() != nil
+	if info, err := os.Stat(volumeMountPath); err == nil && !info.IsDir() {
+		isBlock = true
+	}
+	if isBlock {
+		klog.Infof("volume %s is a block volume, device %s has %d bytes", volumeID, devicePath, size)
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
 	}
 
 	resizer := mount.NewResizeFs(exec.New())
@@ -311,7 +542,7 @@ func (ns *nodeServer) NodeExpandVolume(_ context.Context, req *csi.NodeExpandVol
 		}
 	}
 
-	return &csi.NodeExpandVolumeResponse{}, nil
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
 }
 
 // must be idempotent
@@ -330,53 +561,56 @@ func (ns *nodeServer) stageVolume(devicePath, stagingPath string, req *csi.NodeS
 	if mounted {
 		return nil
 	}
-	fsType := req.GetVolumeCapability().GetMount().GetFsType()
-	// if fsType is not specified, use ext4 as default
-	if fsType == "" {
-		fsType = "ext4"
-	}
-
+	fsType := mountFsType(req.GetVolumeCapability().GetMount())
 	mntFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
-	formatOptions := []string{}
+	formatOptions, err := mkfsOptions(fsType, volumeContext)
+	if err != nil {
+		return err
+	}
 
 	if fsType == "xfs" {
-		distrNdcs, errNdcs := strconv.Atoi(volumeContext["distr_ndcs"])
-		if errNdcs != nil {
-			return errNdcs
-		}
-
-		formatOptions = append(formatOptions, "-d", fmt.Sprintf("sunit=%d,swidth=%d", 8*distrNdcs, 8*distrNdcs), "-l", fmt.Sprintf("sunit=%d", 8*distrNdcs))
-
 		// By default, xfs does not allow mounting of two volumes with the same filesystem uuid.
 		// Force ignore this uuid to be able to mount volume + its clone / restored snapshot on the same node.
 		mntFlags = append(mntFlags, "nouuid")
 	}
 
-	switch req.GetVolumeCapability().GetAccessMode().GetMode() {
-	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
-		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+	readOnly := isReadOnly(req.GetVolumeCapability())
+	if readOnly {
+		// the device is read-only, the journal or log of a crash consistent
+		// snapshot cannot be replayed
 		mntFlags = append(mntFlags, "ro")
-	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
-	case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
-	case csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
-	case csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER:
-	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
-	case csi.VolumeCapability_AccessMode_UNKNOWN:
+		if flag, ok := noLogReplayFlags[fsType]; ok {
+			mntFlags = append(mntFlags, flag)
+		}
+	}
+
+	// stashed with the volume context to repair the mount after a restart
+	volumeContext["fsType"] = fsType
+	volumeContext["mountFlags"] = strings.Join(mntFlags, ",")
+
+	mounter := mount.SafeFormatAndMount{Interface: ns.mounter, Exec: ns.executor}
+	existingFormat, err := mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return err
+	}
+	if existingFormat == fsType {
+		if err = ns.checkFilesystem(mounter.Exec, devicePath, fsType, readOnly, volumeContext); err != nil {
+			return err
+		}
 	}
 
 	klog.Infof("mount %s to %s, fstype: %s, flags: %v", devicePath, stagingPath, fsType, mntFlags)
 	klog.Infof("formatOptions %v", formatOptions)
-	mounter := mount.SafeFormatAndMount{Interface: ns.mounter, Exec: exec.New()}
 	err = mounter.FormatAndMountSensitiveWithFormatOptions(devicePath, stagingPath, fsType, mntFlags, nil, formatOptions)
 	if err != nil {
 		return err
 	}
 
-	if fsType == "ext4" {
+	// the superblock of a read-only device cannot be written
+	if fsType == "ext4" && !readOnly {
 		reserved := volumeContext["tune2fs_reserved_blocks"]
 		if reserved != "" {
-			cmd := osexec.Command("tune2fs", "-m", reserved, devicePath)
-			output, err := cmd.CombinedOutput()
+			output, err := ns.executor.Command("tune2fs", "-m", reserved, devicePath).CombinedOutput()
 			if err != nil {
 				klog.Errorf("Failed to apply tune2fs -m %s on %s: %v\nOutput: %s", reserved, devicePath, err, string(output))
 				return fmt.Errorf("tune2fs failed: %w", err)
@@ -390,6 +624,64 @@ func (ns *nodeServer) stageVolume(devicePath, stagingPath string, req *csi.NodeS
 	return nil
 }
 
+// noLogReplayFlags are the mount options by filesystem that mount it
+// without replaying its journal or log
+var noLogReplayFlags = map[string]string{
+	"ext4":  "noload",
+	"ext3":  "noload",
+	"xfs":   "norecovery",
+	"btrfs": "nologreplay",
+}
+
+// isReadOnly returns whether a volume capability has a read-only access mode
+func isReadOnly(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER:
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
+	case csi.VolumeCapability_AccessMode_UNKNOWN:
+	}
+	return false
+}
+
+// protectDevice sets the read-only flag of the device of a volume staged
+// with a read-only access mode, so writes through any path fail, not just
+// through the mount. It is recorded in the volume context.
+func protectDevice(devicePath string, capability *csi.VolumeCapability, volumeContext map[string]string) error {
+	if !isReadOnly(capability) {
+		return nil
+	}
+	if err := setDeviceReadOnly(devicePath, true); err != nil {
+		return err
+	}
+	volumeContext["readOnly"] = "true"
+	return nil
+}
+
+// releaseDevice clears the read-only flag of the device of a volume staged
+// read-only. The device may outlive the volume, e.g. of a subsystem still in
+// use, it is gone after the disconnect otherwise. The device is resolved
+// again, after a reconnect the stashed one may be another volume's.
+func releaseDevice(volumeContext map[string]string) {
+	if volumeContext["readOnly"] != "true" {
+		return
+	}
+	volumeID := volumeContext["volumeID"]
+	devicePath, err := volumeDevicePath(volumeContext)
+	if err != nil {
+		klog.Warningf("not clearing read-only flag, volumeID: %s err: %v", volumeID, err)
+		return
+	}
+	if err := setDeviceReadOnly(devicePath, false); err != nil {
+		klog.Warningf("failed to clear read-only flag, volumeID: %s err: %v", volumeID, err)
+	}
+}
+
 // isStaged if stagingPath is a mount point, it means it is already staged, and vice versa
 func (ns *nodeServer) isStaged(stagingPath string) (bool, error) {
 	isMount, err := ns.mounter.IsMountPoint(stagingPath)
@@ -418,9 +710,9 @@ func (ns *nodeServer) publishVolume(stagingPath string, req *csi.NodePublishVolu
 			return status.Errorf(codes.Internal, "failed to retrieve volume context for volume %s: %v", req.GetVolumeId(), err)
 		}
 
-		devicePath, ok := volumeContext["devicePath"]
-		if !ok || devicePath == "" {
-			return status.Errorf(codes.Internal, "could not find device path for volume %s", req.GetVolumeId())
+		devicePath, err := volumeDevicePath(volumeContext)
+		if err != nil {
+			return status.Errorf(codes.Internal, "could not find device of volume %s: %v", req.GetVolumeId(), err)
 		}
 		stagingPath = devicePath
 
@@ -443,6 +735,10 @@ func (ns *nodeServer) publishVolume(stagingPath string, req *csi.NodePublishVolu
 
 	mntFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 	mntFlags = append(mntFlags, "bind")
+	if req.GetReadonly() {
+		// the bind mount is remounted read-only
+		mntFlags = append(mntFlags, "ro")
+	}
 	klog.Infof("mount %s to %s, fstype: %s, flags: %v", stagingPath, targetPath, fsType, mntFlags)
 	return ns.mounter.Mount(stagingPath, targetPath, fsType, mntFlags)
 }
@@ -0,0 +1,325 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+
+	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/nvme"
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// fakeReadOnly records the read-only flags set on devices instead of the
+// ioctl, and resolves the devices of volumes by their namespace UUID
+func fakeReadOnly(t *testing.T, devices map[string]string) map[string]bool {
+	t.Helper()
+	flags := map[string]bool{}
+	setDeviceReadOnly = func(devicePath string, readOnly bool) error {
+		flags[devicePath] = readOnly
+		return nil
+	}
+	volumeDevicePath = func(volumeContext map[string]string) (string, error) {
+		devicePath, ok := devices[volumeContext["nsUuid"]]
+		if !ok {
+			return "", fmt.Errorf("namespace %s: %w", volumeContext["nsUuid"], nvme.ErrNamespaceMismatch)
+		}
+		return devicePath, nil
+	}
+	t.Cleanup(func() {
+		setDeviceReadOnly = util.SetDeviceReadOnly
+		volumeDevicePath = util.VolumeDevicePath
+	})
+	return flags
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	driver := csicommon.NewCSIDriver("csi.simplyblock.io", "0.1.0", "node1")
+	ns := &nodeServer{
+		DefaultNodeServer: csicommon.NewDefaultNodeServer(driver),
+		hostIdentity: &util.HostIdentity{
+			NodeID:  "node1",
+			HostNQN: "nqn.2014-08.org.nvmexpress:uuid:0b3c5d7e-1f2a-4b6c-8d9e-0a1b2c3d4e5f",
+			HostID:  "0b3c5d7e-1f2a-4b6c-8d9e-0a1b2c3d4e5f",
+		},
+	}
+	resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetNodeId() != "node1" {
+		t.Errorf("node ID %s, want node1", resp.GetNodeId())
+	}
+	if hostID := resp.GetAccessibleTopology().GetSegments()[topologyKeyNVMeHostID]; hostID != ns.hostIdentity.HostID {
+		t.Errorf("host ID %q reported, want %s", hostID, ns.hostIdentity.HostID)
+	}
+}
+
+func TestIsReadOnly(t *testing.T) {
+	for mode, want := range map[csi.VolumeCapability_AccessMode_Mode]bool{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:    true,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        false,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: false,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:   false,
+		csi.VolumeCapability_AccessMode_UNKNOWN:                   false,
+	} {
+		capability := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode}}
+		if got := isReadOnly(capability); got != want {
+			t.Errorf("%s read-only %v, want %v", mode, got, want)
+		}
+	}
+	if isReadOnly(nil) {
+		t.Error("missing capability is read-only")
+	}
+}
+
+func TestReadOnlyDevice(t *testing.T) {
+	const nsUUID = "8e2dcb9d-3a79-4362-965e-fdb0cd3f4b8d"
+	devices := map[string]string{nsUUID: "/dev/nvme0n1"}
+	flags := fakeReadOnly(t, devices)
+	reader := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{
+		Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	}}
+	writer := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{
+		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	}}
+
+	// a writer leaves the device alone
+	volumeContext := map[string]string{"volumeID": "vol1", "nsUuid": nsUUID}
+	if err := protectDevice("/dev/nvme0n1", writer, volumeContext); err != nil {
+		t.Fatal(err)
+	}
+	releaseDevice(volumeContext)
+	if len(flags) != 0 || volumeContext["readOnly"] != "" {
+		t.Fatalf("read-only flag of a writer changed: %v, %v", flags, volumeContext)
+	}
+
+	if err := protectDevice("/dev/nvme0n1", reader, volumeContext); err != nil {
+		t.Fatal(err)
+	}
+	if !flags["/dev/nvme0n1"] || volumeContext["readOnly"] != "true" {
+		t.Fatalf("read-only flag not set: %v, %v", flags, volumeContext)
+	}
+
+	// the device is resolved again on unstage, the stashed one is
+	// another namespace after the reconnect
+	volumeContext["devicePath"] = "/dev/nvme0n1"
+	devices[nsUUID] = "/dev/nvme1n1"
+	flags["/dev/nvme1n1"] = true
+	releaseDevice(volumeContext)
+	if !flags["/dev/nvme0n1"] || flags["/dev/nvme1n1"] {
+		t.Fatalf("read-only flag not cleared on the resolved device: %v", flags)
+	}
+
+	// and left alone if the namespace has another UUID now
+	delete(devices, nsUUID)
+	flags["/dev/nvme1n1"] = true
+	releaseDevice(volumeContext)
+	if !flags["/dev/nvme1n1"] {
+		t.Fatal("read-only flag of another namespace cleared")
+	}
+}
+
+func TestNodeGetVolumeStatsFilesystem(t *testing.T) {
+	ns := &nodeServer{}
+	resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "vol",
+		VolumePath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetUsage()) != 2 {
+		t.Fatalf("expected bytes and inodes, got %v", resp.GetUsage())
+	}
+	for _, usage := range resp.GetUsage() {
+		if usage.GetTotal() <= 0 || usage.GetUsed()+usage.GetAvailable() > usage.GetTotal() {
+			t.Errorf("implausible %s usage %v", usage.GetUnit(), usage)
+		}
+	}
+	if resp.GetVolumeCondition() == nil || resp.GetVolumeCondition().GetAbnormal() {
+		t.Fatalf("unexpected volume condition %v", resp.GetVolumeCondition())
+	}
+}
+
+func TestNodeGetVolumeStatsBlock(t *testing.T) {
+	// a published block volume is a device file, a sparse file has a size too
+	device := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(device, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(device, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stashed device path does not exist anymore
+	stagingPath := t.TempDir()
+	if err := util.StashVolumeContext(map[string]string{
+		"targetType": util.TargetTypeNVMf,
+		"devicePath": filepath.Join(stagingPath, "missing"),
+	}, stagingPath); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := &nodeServer{}
+	resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:          "vol",
+		VolumePath:        device,
+		StagingTargetPath: stagingPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetUsage()) != 1 || resp.GetUsage()[0].GetTotal() != 1<<30 {
+		t.Fatalf("expected device size, got %v", resp.GetUsage())
+	}
+	if !resp.GetVolumeCondition().GetAbnormal() {
+		t.Fatalf("missing device should be abnormal, got %v", resp.GetVolumeCondition())
+	}
+}
+
+func TestVolumeConditionResolvesDevice(t *testing.T) {
+	const nsUUID = "8e2dcb9d-3a79-4362-965e-fdb0cd3f4b8d"
+	// the namespace has another device since the volume was staged
+	device := filepath.Join(t.TempDir(), "nvme1n1")
+	if err := os.WriteFile(device, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	devices := map[string]string{nsUUID: device}
+	fakeReadOnly(t, devices)
+
+	stagingPath := t.TempDir()
+	if err := util.StashVolumeContext(map[string]string{
+		"targetType": util.TargetTypeNVMf,
+		"nsUuid":     nsUUID,
+		"devicePath": filepath.Join(stagingPath, "nvme0n1"),
+	}, stagingPath); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := &nodeServer{}
+	if condition := ns.volumeCondition(stagingPath); condition.GetAbnormal() {
+		t.Fatalf("stashed device path checked, got %v", condition)
+	}
+	delete(devices, nsUUID)
+	if condition := ns.volumeCondition(stagingPath); !condition.GetAbnormal() {
+		t.Fatalf("missing namespace should be abnormal, got %v", condition)
+	}
+}
+
+func TestNodeGetVolumeStatsNotFound(t *testing.T) {
+	ns := &nodeServer{}
+	_, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "vol",
+		VolumePath: filepath.Join(t.TempDir(), "missing"),
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+}
+
+// fakeCommands returns an executor answering commands by name with their
+// output and exit status, and the commands it ran
+func fakeCommands(outputs map[string]string, exitStatus map[string]int) (*testingexec.FakeExec, *[]string) {
+	var commands []string
+	fake := &testingexec.FakeExec{}
+	for i := 0; i < 10; i++ {
+		fake.CommandScript = append(fake.CommandScript, func(cmd string, args ...string) exec.Cmd {
+			commands = append(commands, cmd)
+			fakeCmd := &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) {
+					var err error
+					if status := exitStatus[cmd]; status != 0 {
+						err = testingexec.FakeExitError{Status: status}
+					}
+					return []byte(outputs[cmd]), nil, err
+				},
+			}}
+			return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+		})
+	}
+	return fake, &commands
+}
+
+func TestStageReadOnlyDirtyLog(t *testing.T) {
+	const xfsDirty = "ALERT: The filesystem has valuable metadata changes in a log which is being\n" +
+		"ignored because the -n option was used."
+	for _, tc := range []struct {
+		fsType   string
+		exitCode int
+		flag     string
+	}{
+		{"xfs", 1, "norecovery"},
+		{"ext4", 4, "noload"},
+	} {
+		t.Run(tc.fsType, func(t *testing.T) {
+			output := xfsDirty
+			fsck := "xfs_repair"
+			if tc.fsType == "ext4" {
+				output = "Warning: skipping journal recovery because doing a read-only filesystem check."
+				fsck = "e2fsck"
+			}
+			executor, commands := fakeCommands(
+				map[string]string{"blkid": "DEVNAME=/dev/nvme0n1\nTYPE=" + tc.fsType, fsck: output},
+				map[string]int{fsck: tc.exitCode})
+			mounter := mount.NewFakeMounter(nil)
+			ns := &nodeServer{mounter: mounter, executor: executor}
+
+			// a snapshot restored as read-only volume, its log left dirty
+			req := &csi.NodeStageVolumeRequest{
+				VolumeId: "vol1",
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: tc.fsType}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+				},
+			}
+			volumeContext := map[string]string{"fsck_policy": "repair", "tune2fs_reserved_blocks": "1"}
+			stagingPath := filepath.Join(t.TempDir(), "vol1")
+			if err := ns.stageVolume("/dev/nvme0n1", stagingPath, req, volumeContext); err != nil {
+				t.Fatal(err)
+			}
+			log := mounter.GetLog()
+			if len(log) != 1 || log[0].Action != mount.FakeActionMount || log[0].Target != stagingPath {
+				t.Fatalf("unexpected mounts %+v", log)
+			}
+			points, err := mounter.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != 1 || !slices.Contains(points[0].Opts, "ro") || !slices.Contains(points[0].Opts, tc.flag) {
+				t.Errorf("mounted with options %v, want ro and %s", points[0].Opts, tc.flag)
+			}
+			// the superblock of the read-only device is left alone
+			if slices.Contains(*commands, "tune2fs") {
+				t.Errorf("tune2fs ran on a read-only volume: %v", *commands)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+	mount "k8s.io/mount-utils"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// reconcileSummary counts what the startup reconciliation found and fixed
+type reconcileSummary struct {
+	volumes     int
+	reconnected int
+	remounted   int
+	// orphans are the connections no staged volume uses, disconnected the
+	// ones torn down
+	orphans      int
+	disconnected int
+	failed       int
+}
+
+// reconcile restores the node state after a restart from the volume contexts
+// stashed in the staging paths below kubeletPluginDir. It reconnects volumes,
+// repairs staging mounts and tears down the lvols no volume context refers
+// to with one round of the OrphanCollector. Must run before the node server
+// serves requests.
+func (ns *nodeServer) reconcile(kubeletPluginDir string) reconcileSummary {
+	var summary reconcileSummary
+
+	if _, err := os.Stat(kubeletPluginDir); err != nil {
+		klog.Warningf("skipping startup reconciliation, kubelet plugin directory: %v", err)
+		return summary
+	}
+	stagingPaths, err := util.FindVolumeContexts(kubeletPluginDir)
+	if err != nil {
+		klog.Errorf("skipping startup reconciliation, failed to find staged volumes: %v", err)
+		return summary
+	}
+
+	users := make(map[string][]string)
+	complete := true
+	for _, stagingParentPath := range stagingPaths {
+		volumeContext, err := util.LookupVolumeContext(stagingParentPath)
+		if err != nil {
+			klog.Errorf("failed to read volume context in %s: %v", stagingParentPath, err)
+			summary.failed++
+			complete = false
+			continue
+		}
+		summary.volumes++
+		if nqn, user := volumeContext["nqn"], util.SubsystemUser(volumeContext); nqn != "" && user != "" && util.IsNVMfTarget(volumeContext["targetType"]) {
+			users[nqn] = append(users[nqn], user)
+		}
+		if err := ns.reconcileVolume(stagingParentPath, volumeContext, &summary); err != nil {
+			klog.Errorf("failed to reconcile volume %s in %s: %v", volumeContext["volumeID"], stagingParentPath, err)
+			summary.failed++
+		}
+	}
+
+	// subsystems shared by volumes are disconnected with the last one
+	if err := util.RestoreSubsystemUsers(users, complete); err != nil {
+		klog.Errorf("failed to restore the volumes using each subsystem: %v", err)
+		summary.failed++
+	}
+
+	// the collector reads the volume contexts and subsystem users itself
+	if ns.orphans != nil {
+		var disconnected []string
+		summary.orphans, disconnected = ns.orphans.CollectStartup()
+		summary.disconnected = len(disconnected)
+	}
+
+	klog.Infof("startup reconciliation: %d staged volumes, %d reconnected, %d remounted, %d orphan connections, %d disconnected, %d failed",
+		summary.volumes, summary.reconnected, summary.remounted, summary.orphans, summary.disconnected, summary.failed)
+	return summary
+}
+
+func (ns *nodeServer) reconcileVolume(stagingParentPath string, volumeContext map[string]string, summary *reconcileSummary) error {
+	devicePath := volumeContext["devicePath"]
+
+	if util.IsNVMfTarget(volumeContext["targetType"]) {
+		connected, err := isNQNConnected(volumeContext["nqn"])
+		if err != nil {
+			return err
+		}
+		if !connected {
+			klog.Infof("reconnecting volume %s (%s)", volumeContext["volumeID"], volumeContext["nqn"])
+			initiator, err := util.NewSpdkCsiInitiator(volumeContext, ns.nodeID)
+			if err != nil {
+				return err
+			}
+			if _, err = initiator.Connect(); err != nil {
+				return fmt.Errorf("failed to reconnect: %w", err)
+			}
+			summary.reconnected++
+			if err := util.CheckTuning(volumeContext["nqn"]); err != nil {
+				klog.Warningf("failed to tune volume %s: %v", volumeContext["volumeID"], err)
+			}
+		}
+
+		// the block device of the namespace may have changed
+		if devicePath, err = volumeDevicePath(volumeContext); err != nil {
+			return err
+		}
+		if devicePath != volumeContext["devicePath"] {
+			volumeContext["devicePath"] = devicePath
+			if err := util.StashVolumeContext(volumeContext, stagingParentPath); err != nil {
+				return err
+			}
+		}
+		// a reconnected device is writable again
+		if volumeContext["readOnly"] == "true" {
+			if err := setDeviceReadOnly(devicePath, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	// block volumes and volumes staged by older versions have no staging
+	// mount we could repair
+	fsType, volumeID := volumeContext["fsType"], volumeContext["volumeID"]
+	if fsType == "" || volumeID == "" || devicePath == "" {
+		return nil
+	}
+	stagingTargetPath := filepath.Join(stagingParentPath, volumeID)
+	mounted, err := ns.mounter.IsMountPoint(stagingTargetPath)
+	switch {
+	case err == nil && mounted:
+		return nil
+	case mount.IsCorruptedMnt(err):
+		klog.Warningf("unmounting corrupted staging mount %s", stagingTargetPath)
+		if err := ns.mounter.Unmount(stagingTargetPath); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(stagingTargetPath, 0o755); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+
+	var mntFlags []string
+	if flags := volumeContext["mountFlags"]; flags != "" {
+		mntFlags = strings.Split(flags, ",")
+	}
+	klog.Infof("remounting %s to %s, fstype: %s, flags: %v", devicePath, stagingTargetPath, fsType, mntFlags)
+	if err := ns.mounter.Mount(devicePath, stagingTargetPath, fsType, mntFlags); err != nil {
+		return fmt.Errorf("failed to remount staging path: %w", err)
+	}
+	summary.remounted++
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	mount "k8s.io/mount-utils"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// stageFake stashes a volume context the way NodeStageVolume does below the
+// kubelet staging directory layout
+func stageFake(t *testing.T, stagingParentPath, volumeID, fsType string) string {
+	t.Helper()
+	if err := util.StashVolumeContext(map[string]string{
+		"targetType": util.TargetTypeCache,
+		"volumeID":   volumeID,
+		"devicePath": "/dev/disk/by-id/nvme-" + volumeID,
+		"fsType":     fsType,
+		"mountFlags": "nouuid,ro",
+	}, stagingParentPath); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(stagingParentPath, volumeID)
+}
+
+func TestReconcileRepairsStagingMounts(t *testing.T) {
+	pluginDir := t.TempDir()
+	csiDir := filepath.Join(pluginDir, "kubernetes.io", "csi")
+
+	// staged and mounted
+	mountedPath := stageFake(t, filepath.Join(csiDir, "csi.simplyblock.io", "hash1", "globalmount"), "vol1", "xfs")
+	if err := os.MkdirAll(mountedPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// staged, but the mount is gone
+	lostPath := stageFake(t, filepath.Join(csiDir, "pv", "pv2", "globalmount"), "vol2", "ext4")
+	// block volume, nothing to mount
+	stageFake(t, filepath.Join(csiDir, "volumeDevices", "staging", "pv3"), "vol3", "")
+
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "/dev/nvme0n1", Path: mountedPath, Type: "xfs"}})
+	ns := &nodeServer{mounter: mounter}
+
+	summary := ns.reconcile(pluginDir)
+	if summary.volumes != 3 || summary.remounted != 1 || summary.failed != 0 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	log := mounter.GetLog()
+	if len(log) != 1 || log[0].Action != mount.FakeActionMount || log[0].Target != lostPath ||
+		log[0].Source != "/dev/disk/by-id/nvme-vol2" || log[0].FSType != "ext4" {
+		t.Fatalf("unexpected mounts %+v", log)
+	}
+	points, err := mounter.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mp := range points {
+		if mp.Path == lostPath && (len(mp.Opts) != 2 || mp.Opts[0] != "nouuid" || mp.Opts[1] != "ro") {
+			t.Errorf("remounted with options %v", mp.Opts)
+		}
+	}
+}
+
+func TestReconcileMissingKubeletDir(t *testing.T) {
+	ns := &nodeServer{mounter: mount.NewFakeMounter(nil)}
+	if summary := ns.reconcile(filepath.Join(t.TempDir(), "missing")); summary != (reconcileSummary{}) {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestReconcileSetsReadOnly(t *testing.T) {
+	const nsUUID = "8e2dcb9d-3a79-4362-965e-fdb0cd3f4b8d"
+	// the device of the namespace changed with the reconnect
+	flags := fakeReadOnly(t, map[string]string{nsUUID: "/dev/nvme1n1"})
+	isNQNConnected = func(string) (bool, error) { return true, nil }
+	t.Cleanup(func() { isNQNConnected = util.IsNQNConnected })
+
+	pluginDir := t.TempDir()
+	stagingParentPath := filepath.Join(pluginDir, "kubernetes.io", "csi", "volumeDevices", "staging", "pv1")
+	volumeContext := map[string]string{
+		"targetType": util.TargetTypeNVMf,
+		"volumeID":   "vol1",
+		"nqn":        "nqn.2023-02.io.simplyblock:cluster1:lvol:lvol1",
+		"nsId":       "1",
+		"nsUuid":     nsUUID,
+		"devicePath": "/dev/nvme0n1",
+		"readOnly":   "true",
+	}
+	if err := util.StashVolumeContext(volumeContext, stagingParentPath); err != nil {
+		t.Fatal(err)
+	}
+	// and a writer is left alone
+	writerParentPath := filepath.Join(pluginDir, "kubernetes.io", "csi", "volumeDevices", "staging", "pv2")
+	writerContext := map[string]string{
+		"targetType": util.TargetTypeNVMf,
+		"volumeID":   "vol2",
+		"nqn":        "nqn.2023-02.io.simplyblock:cluster1:lvol:lvol2",
+		"nsId":       "1",
+		"nsUuid":     nsUUID,
+		"devicePath": "/dev/nvme1n1",
+	}
+	if err := util.StashVolumeContext(writerContext, writerParentPath); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := &nodeServer{mounter: mount.NewFakeMounter(nil)}
+	if summary := ns.reconcile(pluginDir); summary.volumes != 2 || summary.failed != 0 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	if len(flags) != 1 || !flags["/dev/nvme1n1"] {
+		t.Fatalf("unexpected read-only flags %v", flags)
+	}
+	stashed, err := util.LookupVolumeContext(stagingParentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stashed["devicePath"] != "/dev/nvme1n1" {
+		t.Errorf("stashed device %s, want /dev/nvme1n1", stashed["devicePath"])
+	}
+}
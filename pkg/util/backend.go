@@ -0,0 +1,144 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import "fmt"
+
+// Backend defines interface for the storage cluster volumes are provisioned from
+//
+//   - ClusterID returns the cluster the backend talks to, it prefixes volume
+//     and snapshot IDs.
+//   - Info returns backend info(endpoint) for debugging purpose
+//   - LvStores returns available volume stores(name, size, etc) on that cluster.
+//   - VolumeInfo returns a string map to be passed to client node. Client node
+//     needs these info to mount the target. E.g, target IP, service port, nqn.
+//   - Create/Delete/Publish/UnpublishVolume per CSI controller service spec.
+//   - LvolNodes, IsNodeOnline, LvolConnections and the caching node methods
+//     are used by the node initiator to (re)connect volumes.
+//
+// NOTE: concurrency, idempotency, message ordering
+//
+// In below text, "implementation" refers to the code implements this interface,
+// and "caller" is the code uses the implementation.
+//
+// Concurrency requirements for implementation and caller:
+//   - Implementation should make sure CreateVolume is thread
+//     safe. Caller is free to request creating multiple volumes in
+//     same volume store concurrently, no data race should happen.
+//   - Implementation should make sure
+//     PublishVolume/UnpublishVolume/DeleteVolume for *different
+//     volumes* thread safe. Caller may issue these requests to
+//     *different volumes", in same volume store or not, concurrently.
+//   - PublishVolume/UnpublishVolume/DeleteVolume for *same volume* is
+//     not thread safe, concurrent access may lead to data
+//     race. Caller must serialize these calls to *same volume*,
+//     possibly by mutex or message queue per volume.
+//   - Implementation should make sure LvStores and VolumeInfo are
+//     thread safe, but it doesn't lock the returned resources. It
+//     means caller should adopt optimistic concurrency control and
+//     retry on specific failures.  E.g, caller calls LvStores and
+//     finds a volume store with enough free space, it calls
+//     CreateVolume but fails with "not enough space" because another
+//     caller may issue similar request at same time. The failed
+//     caller may redo above steps(call LvStores, pick volume store,
+//     CreateVolume) under this condition, or it can simply fail.
+//
+// Idempotent requirements for implementation:
+// Per CSI spec, it's possible that same request been sent multiple times due to
+// issues such as a temporary network failure. Implementation should have basic
+// logic to deal with idempotency.
+// E.g, ignore publishing an already published volume.
+//
+// Out of order messages handling for implementation:
+// Out of order message may happen in kubernetes CSI framework. E.g, unpublish
+// an already deleted volume. The baseline is there should be no code crash or
+// data corruption under these conditions. Implementation may try to detect and
+// report errors if possible.
+type Backend interface {
+	ClusterID() string
+	Info() string
+	LvStores() ([]LvStore, error)
+	VolumeInfo(lvolID string) (map[string]string, error)
+	CreateVolume(params *CreateLVolData) (string, error)
+	GetVolume(lvolName, poolName string) (string, error)
+	GetVolumeSize(lvolID string) (string, error)
+	ListVolumes() ([]*BDev, error)
+	ResizeVolume(lvolID string, newSize int64) (bool, error)
+	DeleteVolume(lvolID string) error
+	PublishVolume(lvolID string) error
+	UnpublishVolume(lvolID string) error
+	CreateSnapshot(lvolID, snapshotName string) (string, error)
+	ListSnapshots() ([]*SnapshotResp, error)
+	CloneSnapshot(snapshotID, cloneName, newSize, pvcName string) (string, error)
+	DeleteSnapshot(snapshotID string) error
+
+	LvolNodes(lvolID string) (*NodeInfo, error)
+	IsNodeOnline(nodeID string) bool
+	LvolConnections(lvolID string) ([]*LvolConnectResp, error)
+	CachingNodes() ([]*CachingNode, error)
+	ConnectCachingNode(nodeID, lvolID string) error
+	DisconnectCachingNode(nodeID, lvolID string) error
+}
+
+// hostAccess is implemented by backends whose volumes only accept the hosts
+// added to them, the node adds itself before it connects
+type hostAccess interface {
+	AllowHost(lvolID, hostNQN string) error
+	DisallowHost(lvolID, hostNQN string) error
+}
+
+// BackendFactory creates the Backend of a cluster whose requests draw from
+// the budget of class
+type BackendFactory func(clusterID string, class RequestClass) (Backend, error)
+
+// backends a cluster can be managed by
+const (
+	BackendSimplyBlock = "simplyblock" // SimplyBlock management API
+	BackendSPDK        = "spdk"        // SPDK JSON-RPC of a standalone target
+)
+
+// NewBackend is the default BackendFactory, it creates the backend
+// configured for the cluster in the cluster secret. Only the management API
+// has request budgets, class does not apply to the SPDK JSON-RPC.
+func NewBackend(clusterID string, class RequestClass) (Backend, error) {
+	clusterConfig, err := getClusterConfig(clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch clusterConfig.Backend {
+	case "", BackendSimplyBlock:
+		node, err := newSimplyBlockClient(clusterConfig, class)
+		if err != nil {
+			return nil, err
+		}
+		return node, nil
+	case BackendSPDK:
+		node, err := newSPDKNode(clusterConfig)
+		if err != nil {
+			return nil, err
+		}
+		return node, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q for clusterID %s", clusterConfig.Backend, clusterID)
+	}
+}
+
+var (
+	_ Backend = &NodeNVMf{}
+	_ Backend = &NodeSPDK{}
+)
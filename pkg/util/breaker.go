@@ -0,0 +1,170 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// CircuitState is the state of the circuit breaker of one cluster
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through to the cluster
+	CircuitClosed CircuitState = iota
+	// CircuitHalfOpen means a background probe is checking if the cluster recovered
+	CircuitHalfOpen
+	// CircuitOpen rejects all requests without contacting the cluster
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// ErrClusterUnavailable is returned when the circuit of a cluster is open and
+// the request was rejected without contacting the cluster.
+var ErrClusterUnavailable = errors.New("cluster unavailable")
+
+// circuitBreaker tracks the health of one cluster's management API.
+//
+// After cfgBreakerFailureThreshold consecutive failures (unreachable endpoint
+// or 5xx response) the circuit opens and all requests fail fast with
+// ErrClusterUnavailable. A background goroutine then probes the cluster with
+// exponential backoff and closes the circuit once a probe succeeds.
+type circuitBreaker struct {
+	clusterID string
+
+	mtx      sync.Mutex
+	state    CircuitState
+	failures int
+	lastErr  error
+	client   RPCClient // used by the background probe
+}
+
+var breakers sync.Map // clusterID -> *circuitBreaker
+
+// clusterBreaker returns the circuit breaker of client's cluster, creating it if needed.
+func clusterBreaker(client *RPCClient) *circuitBreaker {
+	value, loaded := breakers.LoadOrStore(client.ClusterID, &circuitBreaker{clusterID: client.ClusterID})
+	cb, _ := value.(*circuitBreaker) //nolint:errcheck // will not fail to convert
+	if !loaded {
+		breakerStateGauge.WithLabelValues(cb.clusterID).Set(float64(CircuitClosed))
+	}
+	cb.mtx.Lock()
+	// keep the latest endpoint and credentials for probing
+	cb.client = *client
+	cb.mtx.Unlock()
+	return cb
+}
+
+// allow returns an error if requests to the cluster must not be sent
+func (cb *circuitBreaker) allow() error {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	if cb.state == CircuitClosed {
+		return nil
+	}
+	breakerRejectedCounter.WithLabelValues(cb.clusterID).Inc()
+	return fmt.Errorf("%w: %s (circuit %s, last error: %v)", ErrClusterUnavailable, cb.clusterID, cb.state, cb.lastErr)
+}
+
+// record updates the breaker with the outcome of a request. serverErr is
+// true if the request failed because of the cluster rather than the request.
+func (cb *circuitBreaker) record(serverErr bool, err error) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	if !serverErr {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	cb.lastErr = err
+	if cb.state == CircuitClosed && cb.failures >= cfgBreakerFailureThreshold {
+		klog.Errorf("cluster %s failed %d consecutive requests, opening circuit: %v", cb.clusterID, cb.failures, err)
+		cb.setState(CircuitOpen)
+		go cb.probeLoop()
+	}
+}
+
+// setState must be called with mtx held
+func (cb *circuitBreaker) setState(state CircuitState) {
+	cb.state = state
+	breakerStateGauge.WithLabelValues(cb.clusterID).Set(float64(state))
+}
+
+// probeLoop probes the cluster until it answers again, then closes the circuit
+func (cb *circuitBreaker) probeLoop() {
+	interval := cfgBreakerProbeIntervalSeconds * time.Second
+	for {
+		time.Sleep(interval)
+
+		cb.mtx.Lock()
+		cb.setState(CircuitHalfOpen)
+		client := cb.client
+		cb.mtx.Unlock()
+
+		client.HTTPClient = &http.Client{Timeout: cfgBreakerProbeTimeoutSeconds * time.Second}
+		_, serverErr, err := client.callSBCLI("GET", "/pool/get_pools", nil)
+
+		cb.mtx.Lock()
+		if !serverErr {
+			klog.Infof("cluster %s is reachable again, closing circuit", cb.clusterID)
+			cb.failures = 0
+			cb.lastErr = nil
+			cb.setState(CircuitClosed)
+			cb.mtx.Unlock()
+			return
+		}
+		klog.Warningf("cluster %s still unavailable: %v", cb.clusterID, err)
+		cb.lastErr = err
+		cb.setState(CircuitOpen)
+		cb.mtx.Unlock()
+
+		interval *= 2
+		if interval > cfgBreakerMaxProbeIntervalSeconds*time.Second {
+			interval = cfgBreakerMaxProbeIntervalSeconds * time.Second
+		}
+	}
+}
+
+// ClusterCircuitStates returns the circuit state of every cluster contacted so far
+func ClusterCircuitStates() map[string]CircuitState {
+	states := make(map[string]CircuitState)
+	breakers.Range(func(key, value any) bool {
+		cb, _ := value.(*circuitBreaker) //nolint:errcheck // will not fail to convert
+		cb.mtx.Lock()
+		states[cb.clusterID] = cb.state
+		cb.mtx.Unlock()
+		return true
+	})
+	return states
+}
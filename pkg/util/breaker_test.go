@@ -0,0 +1,72 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	node := NewNVMf("breaker-opens", server.URL, "secret")
+	for i := 0; i < cfgBreakerFailureThreshold; i++ {
+		_, err := node.Client.CallSBCLI("GET", "/lvol", nil)
+		if err == nil || errors.Is(err, ErrClusterUnavailable) {
+			t.Fatalf("request %d: expected server error, got %v", i, err)
+		}
+	}
+
+	_, err := node.Client.CallSBCLI("GET", "/lvol", nil)
+	if !errors.Is(err, ErrClusterUnavailable) {
+		t.Fatalf("expected ErrClusterUnavailable, got %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != cfgBreakerFailureThreshold {
+		t.Fatalf("open circuit should not contact the cluster, got %d calls", n)
+	}
+	if state := ClusterCircuitStates()["breaker-opens"]; state == CircuitClosed {
+		t.Fatalf("expected circuit not closed, got %s", state)
+	}
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "No such device"}`)) //nolint:errcheck // test server
+	}))
+	defer server.Close()
+
+	node := NewNVMf("breaker-client-errors", server.URL, "secret")
+	for i := 0; i < 2*cfgBreakerFailureThreshold; i++ {
+		_, err := node.Client.CallSBCLI("GET", "/lvol/missing", nil)
+		if errors.Is(err, ErrClusterUnavailable) {
+			t.Fatalf("request %d: 4xx responses must not open the circuit", i)
+		}
+	}
+	if state := ClusterCircuitStates()["breaker-client-errors"]; state != CircuitClosed {
+		t.Fatalf("expected circuit closed, got %s", state)
+	}
+}
@@ -16,8 +16,16 @@ limitations under the License.
 
 package util
 
+import "time"
+
 const (
 	cfgRPCTimeoutSeconds = 60
+
+	// circuit breaker of the cluster management API
+	cfgBreakerFailureThreshold        = 5
+	cfgBreakerProbeTimeoutSeconds     = 10
+	cfgBreakerProbeIntervalSeconds    = 5
+	cfgBreakerMaxProbeIntervalSeconds = 60
 )
 
 // Config stores parsed command line parameters
@@ -27,6 +35,27 @@ type Config struct {
 	Endpoint      string
 	NodeID        string
 
+	// MetricsEndpoint is the address to serve prometheus metrics on, disabled if empty
+	MetricsEndpoint string
+
+	// request budgets per cluster for CSI operations and the connection monitor
+	APIBudget        RequestBudget
+	MonitorAPIBudget RequestBudget
+
+	// KubeletDir is the kubelet root directory, scanned by the node server
+	// for staged volumes on startup
+	KubeletDir string
+
+	// StateDir keeps node state that has to survive restarts, e.g. the
+	// NVMe host identity
+	StateDir string
+
+	// orphan connection collection on the node, disabled if the interval
+	// is 0
+	OrphanGCInterval    time.Duration
+	OrphanGCGracePeriod time.Duration
+	OrphanGCDryRun      bool
+
 	IsControllerServer bool
 	IsNodeServer       bool
 }
@@ -0,0 +1,158 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+// nvmfConnectDir keeps the connect parameters of the connected subsystems,
+// replaced by tests
+var nvmfConnectDir = "/var/lib/spdkcsi/nvmf-connect"
+
+// ConnectParams are the controller options of the paths of a volume, zero
+// leaves the default of the driver or the kernel
+type ConnectParams struct {
+	// CtrlLossTmo in seconds, -1 retries forever
+	CtrlLossTmo int `json:"ctrl_loss_tmo,omitempty"`
+	// ReconnectDelay in seconds
+	ReconnectDelay int `json:"reconnect_delay,omitempty"`
+	// FastIOFailTmo in seconds, -1 disables
+	FastIOFailTmo int `json:"fast_io_fail_tmo,omitempty"`
+	// KeepAliveTmo in seconds
+	KeepAliveTmo int `json:"keep_alive_tmo,omitempty"`
+	NrIOQueues   int `json:"nr_io_queues,omitempty"`
+}
+
+// connectParam is a parameter by storage class and volume context key
+type connectParam struct {
+	param, key string
+	value      func(p *ConnectParams) *int
+	// disable is the value allowed below 1, 0 if none
+	disable int
+}
+
+var connectParams = []connectParam{
+	{"ctrl_loss_tmo", "ctrlLossTmo", func(p *ConnectParams) *int { return &p.CtrlLossTmo }, -1},
+	{"reconnect_delay", "reconnectDelay", func(p *ConnectParams) *int { return &p.ReconnectDelay }, 0},
+	{"fast_io_fail_tmo", "fastIoFailTmo", func(p *ConnectParams) *int { return &p.FastIOFailTmo }, -1},
+	{"keep_alive_tmo", "keepAliveTmo", func(p *ConnectParams) *int { return &p.KeepAliveTmo }, 0},
+	{"nr_io_queues", "nrIoQueues", func(p *ConnectParams) *int { return &p.NrIOQueues }, 0},
+}
+
+// ParseConnectParams returns the connect parameters of storage class
+// parameters
+func ParseConnectParams(params map[string]string) (*ConnectParams, error) {
+	p := &ConnectParams{}
+	for _, cp := range connectParams {
+		s, ok := params[cp.param]
+		if !ok {
+			continue
+		}
+		value, err := strconv.Atoi(s)
+		valid := err == nil && (value > 0 || (cp.disable != 0 && value == cp.disable))
+		if !valid {
+			if cp.disable != 0 {
+				return nil, fmt.Errorf("%s must be a positive number of seconds or %d", cp.param, cp.disable)
+			}
+			return nil, fmt.Errorf("%s must be a positive number", cp.param)
+		}
+		*cp.value(p) = value
+	}
+	if p.CtrlLossTmo > 0 && p.ReconnectDelay > p.CtrlLossTmo {
+		return nil, fmt.Errorf("reconnect_delay %d exceeds ctrl_loss_tmo %d", p.ReconnectDelay, p.CtrlLossTmo)
+	}
+	if p.CtrlLossTmo > 0 && p.FastIOFailTmo > p.CtrlLossTmo {
+		return nil, fmt.Errorf("fast_io_fail_tmo %d exceeds ctrl_loss_tmo %d", p.FastIOFailTmo, p.CtrlLossTmo)
+	}
+	return p, nil
+}
+
+// SetVolumeContext overrides the parameters given by the storage cluster in
+// the volume context
+func (p *ConnectParams) SetVolumeContext(volumeContext map[string]string) {
+	for _, cp := range connectParams {
+		if value := *cp.value(p); value != 0 {
+			volumeContext[cp.key] = strconv.Itoa(value)
+		}
+	}
+}
+
+// VolumeConnectParams returns the connect parameters in the volume context,
+// ignoring invalid values
+func VolumeConnectParams(volumeContext map[string]string) *ConnectParams {
+	p := &ConnectParams{}
+	for _, cp := range connectParams {
+		// unset values leave the defaults
+		value, _ := strconv.Atoi(volumeContext[cp.key])
+		*cp.value(p) = value
+	}
+	return p
+}
+
+// apply sets the parameters on the connect options, if set
+func (p *ConnectParams) apply(opts *nvme.ConnectOptions) {
+	set := func(dst *int, value int) {
+		if value != 0 {
+			*dst = value
+		}
+	}
+	set(&opts.CtrlLossTmo, p.CtrlLossTmo)
+	set(&opts.ReconnectDelay, p.ReconnectDelay)
+	set(&opts.FastIOFailTmo, p.FastIOFailTmo)
+	set(&opts.KeepAliveTmo, p.KeepAliveTmo)
+	set(&opts.NrIOQueues, p.NrIOQueues)
+}
+
+// StashConnectParams keeps the connect parameters of a subsystem so paths
+// are reconnected with the same options
+func StashConnectParams(nqn string, p *ConnectParams) error {
+	if nqn == "" || *p == (ConnectParams{}) {
+		return nil
+	}
+	if err := stashNQNState(nvmfConnectDir, nqn, p); err != nil {
+		return fmt.Errorf("failed to stash connect parameters of %s: %w", nqn, err)
+	}
+	return nil
+}
+
+// lookupConnectParams returns the stashed connect parameters of a
+// subsystem, nil if it has none
+func lookupConnectParams(nqn string) (*ConnectParams, error) {
+	var p ConnectParams
+	found, err := lookupNQNState(nvmfConnectDir, nqn, &p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connect parameters of %s: %w", nqn, err)
+	} else if !found {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// CleanUpConnectParams removes the stashed connect parameters of a subsystem
+func CleanUpConnectParams(nqn string) error {
+	if nqn == "" {
+		return nil
+	}
+	if err := cleanUpNQNState(nvmfConnectDir, nqn); err != nil {
+		return fmt.Errorf("failed to clean up connect parameters of %s: %w", nqn, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the per volume connect parameters
+package util
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+func TestParseConnectParams(t *testing.T) {
+	tests := []struct {
+		params  map[string]string
+		want    ConnectParams
+		wantErr bool
+	}{
+		{params: map[string]string{"pool_name": "pool1"}},
+		{
+			params: map[string]string{"ctrl_loss_tmo": "-1", "reconnect_delay": "2", "fast_io_fail_tmo": "-1", "keep_alive_tmo": "5", "nr_io_queues": "4"},
+			want:   ConnectParams{CtrlLossTmo: -1, ReconnectDelay: 2, FastIOFailTmo: -1, KeepAliveTmo: 5, NrIOQueues: 4},
+		},
+		{params: map[string]string{"ctrl_loss_tmo": "0"}, wantErr: true},
+		{params: map[string]string{"reconnect_delay": "-1"}, wantErr: true},
+		{params: map[string]string{"nr_io_queues": "many"}, wantErr: true},
+		{params: map[string]string{"ctrl_loss_tmo": "10", "reconnect_delay": "20"}, wantErr: true},
+		{params: map[string]string{"ctrl_loss_tmo": "10", "fast_io_fail_tmo": "20"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := ParseConnectParams(tt.params)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: error %v", tt.params, err)
+			continue
+		}
+		if err == nil && *p != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.params, *p, tt.want)
+		}
+	}
+}
+
+func TestConnectParamsOnReconnect(t *testing.T) {
+	nvmfConnectDir = filepath.Join(t.TempDir(), "nvmf-connect")
+	t.Cleanup(func() { nvmfConnectDir = "/var/lib/spdkcsi/nvmf-connect" })
+
+	// the storage class overrides the values of the storage cluster
+	vc := map[string]string{"ctrlLossTmo": "0", "reconnectDelay": "10", "nrIoQueues": "6"}
+	(&ConnectParams{CtrlLossTmo: 30, FastIOFailTmo: 5}).SetVolumeContext(vc)
+	params := VolumeConnectParams(vc)
+	want := ConnectParams{CtrlLossTmo: 30, ReconnectDelay: 10, FastIOFailTmo: 5, NrIOQueues: 6}
+	if *params != want {
+		t.Fatalf("volume parameters %+v, want %+v", *params, want)
+	}
+
+	if err := StashConnectParams(healthTestNQN, params); err != nil {
+		t.Fatal(err)
+	}
+	// a reconnect by the path health controller with the defaults
+	opts := &nvme.ConnectOptions{NQN: healthTestNQN, CtrlLossTmo: ctrlLossTimeout(2), ReconnectDelay: 1}
+	if err := prepareConnect(opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.CtrlLossTmo != 30 || opts.ReconnectDelay != 10 || opts.FastIOFailTmo != 5 || opts.KeepAliveTmo != 0 || opts.NrIOQueues != 6 {
+		t.Errorf("reconnect with %+v", opts)
+	}
+
+	if err := CleanUpConnectParams(healthTestNQN); err != nil {
+		t.Fatal(err)
+	}
+	opts = &nvme.ConnectOptions{NQN: healthTestNQN, CtrlLossTmo: 60}
+	if err := prepareConnect(opts); err != nil || opts.CtrlLossTmo != 60 {
+		t.Errorf("parameters left after clean up: %+v, %v", opts, err)
+	}
+}
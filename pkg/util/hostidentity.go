@@ -0,0 +1,153 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"k8s.io/klog"
+)
+
+const (
+	hostIdentityFile = "host-identity.json"
+	hostNQNPrefix    = "nqn.2014-08.org.nvmexpress:uuid:"
+)
+
+// HostIdentity is the NVMe host NQN and host ID the node connects with
+type HostIdentity struct {
+	// NodeID is the Kubernetes node the identity was created for
+	NodeID  string `json:"node_id"`
+	HostNQN string `json:"host_nqn"`
+	HostID  string `json:"host_id"`
+}
+
+// hostIdentity is used on every connect once initialized
+var hostIdentity *HostIdentity
+
+// legacyHostIDDir keeps the host ID node plugins generated before the host
+// identity, replaced by tests
+var legacyHostIDDir = "/var/lib/nvme"
+
+// InitHostIdentity loads the host identity of the node from the state dir,
+// creating a new one if there is none or it was created for another node,
+// e.g. in a cloned VM image. A node upgraded from a plugin without the
+// identity keeps its host ID. The identity is also written to the nvme-cli
+// config so tools on the node agree with the driver. Must be called before
+// anything connects.
+func InitHostIdentity(stateDir, nodeID string) (*HostIdentity, error) {
+	file := filepath.Join(stateDir, hostIdentityFile)
+	identity, err := readHostIdentity(file)
+	if err != nil {
+		klog.Warningf("creating a new host identity: %v", err)
+	}
+	if identity == nil || identity.NodeID != nodeID {
+		id := ""
+		// a cloned identity comes with a cloned legacy host ID
+		if identity == nil {
+			// connections of the previous node plugin still use it
+			id = legacyHostID()
+		}
+		if id == "" {
+			id = uuid.New().String()
+		}
+		identity = &HostIdentity{NodeID: nodeID, HostNQN: hostNQNPrefix + id, HostID: id}
+		if err := writeHostIdentity(file, identity); err != nil {
+			return nil, err
+		}
+		klog.Infof("created host identity %s for node %s", identity.HostNQN, nodeID)
+	}
+	klog.Infof("node %s connects with host NQN %s, host ID %s", nodeID, identity.HostNQN, identity.HostID)
+
+	for name, value := range map[string]string{"hostnqn": identity.HostNQN, "hostid": identity.HostID} {
+		if err := os.WriteFile(filepath.Join(nvmeConfigDir, name), []byte(value+"\n"), 0o644); err != nil { //nolint:gosec // not a secret
+			klog.Warningf("failed to update nvme %s: %v", name, err)
+		}
+	}
+	hostIdentity = identity
+	return identity, nil
+}
+
+// legacyHostID returns the host ID a node plugin before the host identity
+// generated for the node, empty if there is none. The file may also come
+// from a cloned VM image, so it is only trusted if connections of the node
+// use it.
+func legacyHostID() string {
+	file := filepath.Join(legacyHostIDDir, "hostid")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	id := strings.TrimSpace(string(data))
+	if _, err := uuid.Parse(id); err != nil {
+		klog.Warningf("ignoring invalid host ID %q in %s", id, file)
+		return ""
+	}
+	subsystems, err := fabrics.Subsystems()
+	if err != nil {
+		klog.Warningf("ignoring host ID %s of %s, failed to list connections: %v", id, file, err)
+		return ""
+	}
+	for i := range subsystems {
+		for _, path := range subsystems[i].Paths {
+			if strings.EqualFold(path.HostID, id) {
+				klog.Infof("keeping host ID %s of %s, %s is connected with it", id, file, subsystems[i].NQN)
+				return id
+			}
+		}
+	}
+	klog.Infof("ignoring host ID %s of %s, no connection uses it", id, file)
+	return ""
+}
+
+// readHostIdentity returns nil if the file does not exist
+func readHostIdentity(file string) (*HostIdentity, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var identity HostIdentity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("invalid host identity %s: %w", file, err)
+	}
+	if _, err := uuid.Parse(identity.HostID); err != nil || identity.HostNQN == "" {
+		return nil, fmt.Errorf("invalid host identity %s", file)
+	}
+	return &identity, nil
+}
+
+func writeHostIdentity(file string, identity *HostIdentity) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil { //nolint:gosec // not a secret
+		return fmt.Errorf("failed to store host identity: %w", err)
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the persistent host identity
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+func TestInitHostIdentity(t *testing.T) {
+	stateDir := t.TempDir()
+	nvmeConfigDir = t.TempDir()
+	legacyHostIDDir = t.TempDir()
+	t.Cleanup(func() {
+		nvmeConfigDir = "/etc/nvme"
+		legacyHostIDDir = "/var/lib/nvme"
+		hostIdentity = nil
+	})
+
+	first, err := InitHostIdentity(stateDir, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.HostNQN != hostNQNPrefix+first.HostID {
+		t.Errorf("host NQN %s does not match host ID %s", first.HostNQN, first.HostID)
+	}
+	if data, err := os.ReadFile(filepath.Join(nvmeConfigDir, "hostnqn")); err != nil || strings.TrimSpace(string(data)) != first.HostNQN {
+		t.Errorf("nvme hostnqn %q, %v", data, err)
+	}
+
+	// kept across restarts
+	again, err := InitHostIdentity(stateDir, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *again != *first {
+		t.Errorf("identity changed on restart: %+v, was %+v", again, first)
+	}
+	opts := &nvme.ConnectOptions{NQN: healthTestNQN}
+	if err := prepareConnect(opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.HostNQN != first.HostNQN || opts.HostID != first.HostID {
+		t.Errorf("connecting with %s %s", opts.HostNQN, opts.HostID)
+	}
+
+	// a cloned state dir on another node
+	clone, err := InitHostIdentity(stateDir, "node2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.HostID == first.HostID {
+		t.Error("cloned node kept the host identity")
+	}
+
+	mustWrite(t, filepath.Join(stateDir, hostIdentityFile), "{")
+	if _, err := InitHostIdentity(stateDir, "node2"); err != nil {
+		t.Errorf("corrupted identity not replaced: %v", err)
+	}
+}
+
+func TestInitHostIdentityKeepsLegacyHostID(t *testing.T) {
+	const legacyID = "0b3c5d7e-1f2a-4b6c-8d9e-0a1b2c3d4e5f"
+	root := t.TempDir()
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: root}
+	nvmeConfigDir = t.TempDir()
+	legacyHostIDDir = t.TempDir()
+	t.Cleanup(func() {
+		fabrics = oldFabrics
+		nvmeConfigDir = "/etc/nvme"
+		legacyHostIDDir = "/var/lib/nvme"
+		hostIdentity = nil
+	})
+	mustWrite(t, filepath.Join(legacyHostIDDir, "hostid"), legacyID+"\n")
+
+	// a host ID of the image or a cloned VM is not used by any connection
+	mustWrite(t, filepath.Join(nvmeConfigDir, "hostid"), legacyID+"\n")
+	fresh, err := InitHostIdentity(t.TempDir(), "node0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.HostID == legacyID {
+		t.Error("host ID without connections kept")
+	}
+
+	// upgraded from a node plugin that kept the host ID in /var/lib/nvme,
+	// its connections are still up
+	fakePaths(t, root, "live")
+	mustWrite(t, filepath.Join(root, "class", "nvme", "nvme0", "hostid"), legacyID)
+	stateDir := t.TempDir()
+	identity, err := InitHostIdentity(stateDir, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.HostID != legacyID || identity.HostNQN != hostNQNPrefix+legacyID {
+		t.Errorf("legacy host ID not kept: %+v", identity)
+	}
+
+	// a cloned node has a cloned legacy host ID as well
+	clone, err := InitHostIdentity(stateDir, "node2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.HostID == legacyID {
+		t.Error("cloned node kept the legacy host ID")
+	}
+
+	// an invalid legacy host ID is not used
+	mustWrite(t, filepath.Join(legacyHostIDDir, "hostid"), "not-a-uuid\n")
+	identity, err = InitHostIdentity(t.TempDir(), "node3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uuid.Parse(identity.HostID); err != nil {
+		t.Errorf("invalid host ID %s", identity.HostID)
+	}
+}
@@ -21,15 +21,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
 )
 
 const (
@@ -39,6 +43,9 @@ const (
 	// TargetTypeNVMf is the target type for NVMe over Fabrics
 	TargetTypeNVMf = "tcp"
 
+	// TargetTypeRDMA is the target type for NVMe over RDMA
+	TargetTypeRDMA = "rdma"
+
 	// TargetTypeISCSI is the target type for cache
 	TargetTypeCache = "cache"
 )
@@ -56,75 +63,57 @@ type SpdkCsiInitiator interface {
 
 // initiatorNVMf is an implementation of NVMf tcp initiator
 type initiatorNVMf struct {
-	targetType     string
-	connections    []connectionInfo
-	nqn            string
-	reconnectDelay string
-	nrIoQueues     string
-	ctrlLossTmo    string
-	model          string
-	nsId           string
+	targetType  string
+	connections []connectionInfo
+	nqn         string
+	params      *ConnectParams
+	nsId        string
+	nsUUID      string
+	volumeID    string
 }
 
 // initiatorCache is an implementation of NVMf cache initiator
 type initiatorCache struct {
-	lvol   string
-	model  string
-	client RPCClient // TODO: support multi cluster for cache
+	lvol    string
+	model   string
+	backend Backend
+	// nodeID is the CSI node ID of the caching node to use
+	nodeID string
 }
 
-type cachingNodeList struct {
+// CachingNode is a caching node of the cluster
+type CachingNode struct {
 	Hostname string `json:"hostname"`
 	UUID     string `json:"id"`
 }
 
-type lVolCachingNodeConnect struct {
-	LvolID string `json:"lvol_id"`
-}
-
-type path struct {
-	Name      string `json:"Name"`
-	Transport string `json:"Transport"`
-	Address   string `json:"Address"`
-	State     string `json:"State"`
-	ANAState  string `json:"ANAState"`
-}
-
-type subsystem struct {
-	Name  string `json:"Name"`
-	NQN   string `json:"NQN"`
-	Paths []path `json:"Paths"`
-}
-
-type subsystemResponse struct {
-	Subsystems []subsystem `json:"Subsystems"`
-}
-
 type NodeInfo struct {
 	NodeID string   `json:"node_id"`
 	Nodes  []string `json:"nodes"`
 	Status string   `json:"status"`
 }
 
-type nvmeDeviceInfo struct {
-	devicePath   string
-	serialNumber string
-}
-
 // clusterConfig represents the Kubernetes secret structure
 type ClusterConfig struct {
 	ClusterID       string `json:"cluster_id"`
 	ClusterEndpoint string `json:"cluster_endpoint"`
 	ClusterSecret   string `json:"cluster_secret"`
+
+	// Backend selects how the cluster is managed, BackendSimplyBlock if empty
+	Backend string `json:"backend,omitempty"`
+	// SPDK backend only: JSON-RPC socket (unix:///var/tmp/spdk.sock or
+	// tcp://host:port) and the NVMe-oF listener of the target
+	RPCAddress    string `json:"rpc_address,omitempty"`
+	TargetAddress string `json:"target_address,omitempty"`
+	TargetPort    int    `json:"target_port,omitempty"`
 }
 
 type ClustersInfo struct {
 	Clusters []ClusterConfig `json:"clusters"`
 }
 
-// NewsimplyBlockClient create a new Simplyblock client
-// should be called for every CSI driver operation
-func NewsimplyBlockClient(clusterID string) (*NodeNVMf, error) {
+// getClusterConfig returns the configuration of clusterID from the cluster secret
+func getClusterConfig(clusterID string) (*ClusterConfig, error) {
 	secretFile := FromEnv("SPDKCSI_SECRET", "/etc/spdkcsi-secret/secret.json")
 	var clusters ClustersInfo
 	err := ParseJSONFile(secretFile, &clusters)
@@ -132,20 +121,27 @@ func NewsimplyBlockClient(clusterID string) (*NodeNVMf, error) {
 		return nil, fmt.Errorf("failed to parse secret file: %w", err)
 	}
 
-	var clusterConfig *ClusterConfig
-	for _, cluster := range clusters.Clusters {
-		if cluster.ClusterID == clusterID {
-			clusterConfig = &cluster
-			break
+	for i := range clusters.Clusters {
+		if clusters.Clusters[i].ClusterID == clusterID {
+			return &clusters.Clusters[i], nil
 		}
 	}
+	return nil, fmt.Errorf("failed to find secret for clusterID %s", clusterID)
+}
 
-	if clusterConfig == nil {
-		return nil, fmt.Errorf("failed to find secret for clusterID %s", clusterID)
+// NewsimplyBlockClient create a new Simplyblock client
+// should be called for every CSI driver operation
+func NewsimplyBlockClient(clusterID string) (*NodeNVMf, error) {
+	clusterConfig, err := getClusterConfig(clusterID)
+	if err != nil {
+		return nil, err
 	}
+	return newSimplyBlockClient(clusterConfig, RequestClassDefault)
+}
 
+func newSimplyBlockClient(clusterConfig *ClusterConfig, class RequestClass) (*NodeNVMf, error) {
 	if clusterConfig.ClusterEndpoint == "" || clusterConfig.ClusterSecret == "" {
-		return nil, fmt.Errorf("invalid cluster configuration for clusterID %s", clusterID)
+		return nil, fmt.Errorf("invalid cluster configuration for clusterID %s", clusterConfig.ClusterID)
 	}
 
 	// Log and return the newly created Simplyblock client.
@@ -153,14 +149,18 @@ func NewsimplyBlockClient(clusterID string) (*NodeNVMf, error) {
 		clusterConfig.ClusterID,
 		clusterConfig.ClusterEndpoint,
 	)
-	return NewNVMf(clusterID, clusterConfig.ClusterEndpoint, clusterConfig.ClusterSecret), nil
+	node := NewNVMf(clusterConfig.ClusterID, clusterConfig.ClusterEndpoint, clusterConfig.ClusterSecret)
+	node.Client.Class = class
+	return node, nil
 }
 
-// NewSpdkCsiInitiator creates a new SpdkCsiInitiator based on the target type
-func NewSpdkCsiInitiator(volumeContext map[string]string) (SpdkCsiInitiator, error) {
+// NewSpdkCsiInitiator creates a new SpdkCsiInitiator based on the target
+// type. nodeID is the CSI node ID of the node, which cache volumes use to
+// find their caching node.
+func NewSpdkCsiInitiator(volumeContext map[string]string, nodeID string) (SpdkCsiInitiator, error) {
 	targetType := strings.ToLower(volumeContext["targetType"])
 	switch targetType {
-	case TargetTypeNVMf:
+	case TargetTypeNVMf, TargetTypeRDMA:
 		var connections []connectionInfo
 
 		err := json.Unmarshal([]byte(volumeContext["connections"]), &connections)
@@ -169,80 +169,92 @@ func NewSpdkCsiInitiator(volumeContext map[string]string) (SpdkCsiInitiator, err
 		}
 
 		return &initiatorNVMf{
-			targetType:     volumeContext["targetType"],
-			connections:    connections,
-			nqn:            volumeContext["nqn"],
-			reconnectDelay: volumeContext["reconnectDelay"],
-			nrIoQueues:     volumeContext["nrIoQueues"],
-			ctrlLossTmo:    volumeContext["ctrlLossTmo"],
-			model:          volumeContext["model"],
-			nsId:           volumeContext["nsId"],
+			targetType:  targetType,
+			connections: connections,
+			nqn:         volumeContext["nqn"],
+			params:      VolumeConnectParams(volumeContext),
+			nsId:        volumeContext["nsId"],
+			nsUUID:      volumeContext["nsUuid"],
+			volumeID:    SubsystemUser(volumeContext),
 		}, nil
 
-	case "cache":
-		return &initiatorCache{
-			lvol:  volumeContext["uuid"],
-			model: volumeContext["model"],
-		}, nil
+	case TargetTypeCache:
+		return newInitiatorCache(volumeContext, nodeID)
 
 	default:
 		return nil, fmt.Errorf("unknown initiator: %s", targetType)
 	}
 }
 
-func (cache *initiatorCache) Connect() (string, error) {
-	// get the hostname
-	hostname, err := os.Hostname()
-	if err != nil {
-		panic(err)
+// newInitiatorCache creates a cache initiator with the client of the
+// cluster of the volume, for the caching node on nodeID
+func newInitiatorCache(volumeContext map[string]string, nodeID string) (*initiatorCache, error) {
+	clusterID, lvolID := getLvolIDFromNQN(volumeContext["nqn"])
+	if clusterID == "" {
+		return nil, fmt.Errorf("missing cluster ID in volume nqn %q", volumeContext["nqn"])
 	}
-	hostname = strings.Split(hostname, ".")[0]
-	klog.Info("hostname: ", hostname)
-
-	out, err := cache.client.CallSBCLI("GET", "/cachingnode", nil)
-	if err != nil {
-		klog.Error(err)
-		return "", err
+	if volumeContext["uuid"] != "" {
+		lvolID = volumeContext["uuid"]
 	}
-
-	data, err := json.Marshal(out)
-	if err != nil {
-		return "", err
+	if nodeID == "" {
+		return nil, errors.New("node ID unknown")
 	}
-	var cnodes []*cachingNodeList
-	err = json.Unmarshal(data, &cnodes)
+	backend, err := NewBackend(clusterID, RequestClassDefault)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("failed to create client of cluster %s: %w", clusterID, err)
 	}
+	return &initiatorCache{
+		lvol:    lvolID,
+		model:   volumeContext["model"],
+		backend: backend,
+		nodeID:  nodeID,
+	}, nil
+}
 
-	klog.Info("found caching nodes: ", cnodes)
-
-	isCachingNodeConnected := false
+// findCachingNode returns the caching node running on the node, matching
+// the node ID to the hostname of the caching node, or their short names if
+// only one caching node has the short name
+func findCachingNode(cnodes []*CachingNode, nodeID string) (*CachingNode, error) {
+	shortName := func(name string) string {
+		return strings.Split(name, ".")[0]
+	}
+	var matches []*CachingNode
 	for _, cnode := range cnodes {
-		if hostname != cnode.Hostname {
-			continue
+		if cnode.Hostname == nodeID {
+			return cnode, nil
 		}
-
-		var resp interface{}
-		req := lVolCachingNodeConnect{
-			LvolID: cache.lvol,
+		if shortName(cnode.Hostname) == shortName(nodeID) {
+			matches = append(matches, cnode)
 		}
-		klog.Info("connecting caching node: ", cnode.Hostname, " with lvol: ", cache.lvol)
-		resp, err = cache.client.CallSBCLI("PUT", "/cachingnode/connect/"+cnode.UUID, req)
-		if err != nil {
-			klog.Error("caching node connect error:", err)
-			return "", err
-		}
-		klog.Info("caching node connect resp: ", resp)
-		isCachingNodeConnected = true
 	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no caching node found on node %s", nodeID)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d caching nodes match node %s", len(matches), nodeID)
+	}
+}
 
-	if !isCachingNodeConnected {
-		return "", errors.New("failed to find the caching node")
+// cachingNode returns the caching node of this node
+func (cache *initiatorCache) cachingNode() (*CachingNode, error) {
+	cnodes, err := cache.backend.CachingNodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list caching nodes: %w", err)
 	}
+	return findCachingNode(cnodes, cache.nodeID)
+}
 
-	// get the caching node ID associated with the hostname
-	// connect lvol and caching node
+func (cache *initiatorCache) Connect() (string, error) {
+	cnode, err := cache.cachingNode()
+	if err != nil {
+		return "", err
+	}
+	klog.Infof("connecting caching node %s (%s) with lvol %s", cnode.Hostname, cnode.UUID, cache.lvol)
+	if err := cache.backend.ConnectCachingNode(cnode.UUID, cache.lvol); err != nil {
+		return "", fmt.Errorf("failed to connect caching node %s: %w", cnode.UUID, err)
+	}
 
 	deviceGlob := fmt.Sprintf(DevDiskByID, cache.model)
 	devicePath, err := waitForDeviceReady(deviceGlob, 20)
@@ -253,64 +265,35 @@ func (cache *initiatorCache) Connect() (string, error) {
 }
 
 func (cache *initiatorCache) Disconnect() error {
-	// get the hostname
-	// get the caching node ID associated with the hostname
-	// connect lvol and caching node
-
-	hostname, err := os.Hostname()
-	if err != nil {
-		os.Exit(1)
-	}
-	hostname = strings.Split(hostname, ".")[0]
-	klog.Info("hostname: ", hostname)
-
-	out, err := cache.client.CallSBCLI("GET", "/cachingnode", nil)
+	cnode, err := cache.cachingNode()
 	if err != nil {
-		klog.Error(err)
 		return err
 	}
-
-	data, err := json.Marshal(out)
-	if err != nil {
-		return err
-	}
-	var cnodes []*cachingNodeList
-	err = json.Unmarshal(data, &cnodes)
-	if err != nil {
-		return err
-	}
-	klog.Info("found caching nodes: ", cnodes)
-
-	isCachingNodeConnected := false
-	for _, cnode := range cnodes {
-		if hostname != cnode.Hostname {
-			continue
-		}
-		klog.Info("disconnect caching node: ", cnode.Hostname, "with lvol: ", cache.lvol)
-		req := lVolCachingNodeConnect{
-			LvolID: cache.lvol,
-		}
-		resp, err := cache.client.CallSBCLI("PUT", "/cachingnode/disconnect/"+cnode.UUID, req)
-		if err != nil {
-			klog.Error("caching node disconnect error:", err)
-			return err
-		}
-		klog.Info("caching node disconnect resp: ", resp)
-		isCachingNodeConnected = true
-	}
-
-	if !isCachingNodeConnected {
-		return errors.New("failed to find the caching node")
+	klog.Infof("disconnecting caching node %s (%s) from lvol %s", cnode.Hostname, cnode.UUID, cache.lvol)
+	if err := cache.backend.DisconnectCachingNode(cnode.UUID, cache.lvol); err != nil {
+		return fmt.Errorf("failed to disconnect caching node %s: %w", cnode.UUID, err)
 	}
 
 	deviceGlob := fmt.Sprintf(DevDiskByID, cache.model)
 	return waitForDeviceGone(deviceGlob)
 }
 
-func execWithTimeoutRetry(cmdLine []string, timeout, retry int) (err error) {
+// fabrics is the NVMe-oF control interface of the host, replaced by tests
+var fabrics = nvme.New()
+
+// connectRetries is how often a path is tried when a volume is connected
+const connectRetries = 2
+
+// connectWithRetry connects a controller with the host identity and the
+// stashed secrets of the subsystem, an existing controller for the same
+// address counts as connected
+func connectWithRetry(opts *nvme.ConnectOptions, retry int) (err error) {
+	if err := prepareConnect(opts); err != nil {
+		return err
+	}
 	for retry > 0 {
-		err = execWithTimeout(cmdLine, timeout)
-		if err == nil {
+		_, err = fabrics.Connect(opts)
+		if err == nil || errors.Is(err, nvme.ErrAlreadyConnected) {
 			return nil
 		}
 		retry--
@@ -318,14 +301,12 @@ func execWithTimeoutRetry(cmdLine []string, timeout, retry int) (err error) {
 	return err
 }
 
+// Connect connects the subsystem of the volume, if not yet, and records the
+// volume as user of it. Callers hold LockSubsystem.
 func (nvmf *initiatorNVMf) Connect() (string, error) {
 	klog.Info("connections", nvmf.connections)
-	ctrlLossTmo := 60
-	if len(nvmf.connections) == 1 {
-		ctrlLossTmo *= 15
-	}
 
-	alreadyConnected, err := isNqnConnected(nvmf.nqn)
+	alreadyConnected, err := IsNQNConnected(nvmf.nqn)
 	if err != nil {
 		klog.Errorf("Failed to check existing connections: %v", err)
 		return "", err
@@ -333,79 +314,131 @@ func (nvmf *initiatorNVMf) Connect() (string, error) {
 
 	if !alreadyConnected {
 		clusterID, lvolID := getLvolIDFromNQN(nvmf.nqn)
-		sbcClient, err := NewsimplyBlockClient(clusterID)
+		backend, err := NewBackend(clusterID, RequestClassDefault)
 		if err != nil {
 			klog.Errorf("failed to create SPDK client: %v", err)
 			return "", err
 		}
-		connections, err := fetchLvolConnection(sbcClient, lvolID)
+		connections, err := backend.LvolConnections(lvolID)
 		if err != nil {
 			klog.Errorf("Failed to get lvol connection: %v", err)
 			return "", err
 		}
+		if access, ok := backend.(hostAccess); ok {
+			if err := access.AllowHost(lvolID, localHostNQN()); err != nil {
+				return "", fmt.Errorf("failed to allow host to connect to %s: %w", lvolID, err)
+			}
+		}
 
-		for i, conn := range nvmf.connections {
-			cmdLine := []string{
-				"nvme", "connect", "-t", strings.ToLower(nvmf.targetType),
-				"-a", connections[i].IP, "-s", strconv.Itoa(conn.Port), "-n", nvmf.nqn, "-l", strconv.Itoa(ctrlLossTmo),
-				"-c", nvmf.reconnectDelay, "-i", nvmf.nrIoQueues,
+		if len(connections) == 0 {
+			return "", fmt.Errorf("no connections of %s", nvmf.nqn)
+		}
+		var connected int
+		for _, conn := range connections {
+			if conn.Transport == "" {
+				conn.Transport = nvmf.targetType
 			}
-			err := execWithTimeoutRetry(cmdLine, 40, len(nvmf.connections))
-			if err != nil {
-				// go on checking device status in case caused by duplicated request
-				klog.Errorf("command %v failed: %s", cmdLine, err)
-
-				// disconnect the primary connection if secondary connection fails
-				if i == 1 {
-					klog.Warning("Secondary connection failed, disconnecting primary...")
-
-					deviceGlob := fmt.Sprintf(DevDiskByID, fmt.Sprintf("%s*_%s", nvmf.model, nvmf.nsId))
-					devicePath, err := waitForDeviceReady(deviceGlob, 20)
-					if err != nil {
-						return "", err
-					}
-					err = disconnectDevicePath(devicePath)
-					if err != nil {
-						klog.Errorf("Failed to disconnect primary: %v", err)
-						return "", err
-					} else {
-						klog.Infof("Primary connection disconnected due to secondary failure")
-					}
-				}
-
-				return "", err
+			opts := &nvme.ConnectOptions{
+				Transport:   resolveTransport(conn.Transport),
+				TrAddr:      conn.IP,
+				TrSvcID:     strconv.Itoa(conn.Port),
+				NQN:         nvmf.nqn,
+				CtrlLossTmo: ctrlLossTimeout(len(connections)),
 			}
+			nvmf.params.apply(opts)
+			if err = connectWithRetry(opts, connectRetries); err != nil {
+				klog.Errorf("connect %s failed: %s", opts, err)
+				continue
+			}
+			connected++
+		}
+		if connected == 0 {
+			return "", fmt.Errorf("failed to connect any of the %d paths of %s: %w", len(connections), nvmf.nqn, err)
+		}
+		// the PathHealthController connects the missing paths later
+		if connected < len(connections) {
+			klog.Warningf("connected %d of %d paths of %s", connected, len(connections), nvmf.nqn)
 		}
 	}
 
-	deviceGlob := fmt.Sprintf(DevDiskByID, fmt.Sprintf("%s*_%s", nvmf.model, nvmf.nsId))
-	devicePath, err := waitForDeviceReady(deviceGlob, 20)
+	namespace, err := waitForNamespace(nvmf.nqn, nvmf.nsId, nvmf.nsUUID, 20)
 	if err != nil {
 		return "", err
 	}
-	return devicePath, nil
+	if err := addSubsystemUser(nvmf.nqn, nvmf.volumeID); err != nil {
+		return "", err
+	}
+	return namespace.DevicePath(), nil
 }
 
+// Disconnect disconnects the subsystem of the volume and removes its
+// stashed state, unless other staged volumes still use it. Callers hold
+// LockSubsystem, as for Connect.
 func (nvmf *initiatorNVMf) Disconnect() error {
-	//deviceGlob := fmt.Sprintf(DevDiskByID, nvmf.model)
-	deviceGlob := fmt.Sprintf(DevDiskByID, fmt.Sprintf("%s*_[0-9]*", nvmf.model))
-	devicePath, err := filepath.Glob(deviceGlob)
+	subsys, err := fabrics.SubsystemByNQN(nvmf.nqn)
 	if err != nil {
-		return fmt.Errorf("failed to find device paths matching %s: %v", deviceGlob, err)
+		return err
 	}
-
-	if len(devicePath) > 1 {
+	if subsys != nil {
+		if _, err := lookupNamespace(subsys, nvmf.nsId, nvmf.nsUUID); errors.Is(err, nvme.ErrNamespaceMismatch) {
+			// the NSID is another volume now, the subsystem stays connected for
+			// it and only this volume is forgotten, so the unstage completes
+			klog.Warningf("volume %s is gone from %s, not disconnecting it: %v", nvmf.volumeID, nvmf.nqn, err)
+			if _, err := removeSubsystemUser(nvmf.nqn, nvmf.volumeID); err != nil {
+				return err
+			}
+			return untuneNamespace(nvmf.nqn, nvmf.nsId, nvmf.nsUUID)
+		}
+	}
+	users, err := subsystemVolumes(nvmf.nqn)
+	if err != nil {
+		return err
+	}
+	recorded := slices.Contains(users, nvmf.volumeID)
+	if users, err = removeSubsystemUser(nvmf.nqn, nvmf.volumeID); err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		klog.Infof("subsystem %s still used by volumes %v, staying connected", nvmf.nqn, users)
+		return untuneNamespace(nvmf.nqn, nvmf.nsId, nvmf.nsUUID)
+	}
+	// the users of a subsystem staged before they were recorded are unknown
+	if !recorded && subsys != nil && len(subsys.Namespaces) > 1 {
+		klog.Warningf("volume %s is not recorded as user of %s with %d namespaces, leaving its disconnect to the orphan collector",
+			nvmf.volumeID, nvmf.nqn, len(subsys.Namespaces))
 		return nil
+	}
 
-	} else if len(devicePath) == 1 {
-		err = disconnectDevicePath(devicePath[0])
-
-		if err != nil {
+	if subsys != nil {
+		disconnectSubsystem(subsys)
+		if err := waitForDisconnect(nvmf.nqn); err != nil {
 			return err
 		}
 	}
+	disallowHost(nvmf.nqn)
+	if err := CleanUpNVMfAuth(nvmf.nqn); err != nil {
+		return err
+	}
+	if err := CleanUpConnectParams(nvmf.nqn); err != nil {
+		return err
+	}
+	return CleanUpTuning(nvmf.nqn)
+}
 
-	return waitForDeviceGone(deviceGlob)
+// disallowHost removes the node from the hosts of the subsystem if the
+// backend restricts them, failures are only logged
+func disallowHost(nqn string) {
+	clusterID, lvolID := getLvolIDFromNQN(nqn)
+	backend, err := NewBackend(clusterID, RequestClassDefault)
+	if err != nil {
+		klog.Warningf("not removing host from %s: %v", nqn, err)
+		return
+	}
+	if access, ok := backend.(hostAccess); ok {
+		if err := access.DisallowHost(lvolID, localHostNQN()); err != nil {
+			klog.Warningf("failed to remove host from %s: %v", nqn, err)
+		}
+	}
 }
 
 // when timeout is set as 0, try to find the device file immediately
@@ -459,357 +492,227 @@ func execWithTimeout(cmdLine []string, timeout int) error {
 	return err
 }
 
-func disconnectDevicePath(devicePath string) error {
-	var paths []path
-
-	realPath, err := filepath.EvalSymlinks(devicePath)
-	if err != nil {
-		return fmt.Errorf("Failed to resolve device path from %s: %v", devicePath, err)
-	}
-
-	subsystems, err := getSubsystemsForDevice(realPath)
-	if err != nil {
-		return fmt.Errorf("Failed to get subsystems for %s: %v", realPath, err)
-	}
-
-	for _, host := range subsystems {
-		for _, subsystem := range host.Subsystems {
-			for _, p := range subsystem.Paths {
-				paths = append(paths, path{
-					Name:     p.Name,
-					ANAState: p.ANAState,
-				})
-			}
-		}
-	}
-
-	sort.Slice(paths, func(i, j int) bool {
-		if paths[i].ANAState == "optimized" && paths[j].ANAState != "optimized" {
-			return false
-		}
-		return true
+// disconnectSubsystem disconnects all paths of a subsystem, the optimized
+// path last
+func disconnectSubsystem(subsys *nvme.Subsystem) {
+	paths := subsys.Paths
+	sort.SliceStable(paths, func(i, j int) bool {
+		return paths[i].ANAState != "optimized" && paths[j].ANAState == "optimized"
 	})
 
 	for _, p := range paths {
-		klog.Infof("Disconnecting device %s", p.Name)
-		disconnectCmd := []string{"nvme", "disconnect", "-d", p.Name}
-		err := execWithTimeoutRetry(disconnectCmd, 40, 1)
-		if err != nil {
-			klog.Errorf("Failed to disconnect device %s: %v", p.Name, err)
+		klog.Infof("Disconnecting %s from %s", p.Controller, subsys.NQN)
+		if err := fabrics.Disconnect(p.Controller); err != nil {
+			klog.Errorf("Failed to disconnect %s: %v", p.Controller, err)
 		}
 	}
-
-	return nil
 }
 
-func getNVMeDeviceInfos() ([]nvmeDeviceInfo, error) {
-	cmd := exec.Command("nvme", "list", "-o", "json")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute nvme list: %v", err)
-	}
-
-	var response struct {
-		Devices []struct {
-			DevicePath   string `json:"DevicePath"`
-			SerialNumber string `json:"SerialNumber"`
-		} `json:"Devices"`
-	}
-
-	if err := json.Unmarshal(output, &response); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal nvme list output: %v", err)
-	}
-
-	var devices []nvmeDeviceInfo
-	for _, dev := range response.Devices {
-		devices = append(devices, nvmeDeviceInfo{
-			devicePath:   dev.DevicePath,
-			serialNumber: dev.SerialNumber,
-		})
+// wait for the subsystem to be disconnected or timeout
+func waitForDisconnect(nqn string) error {
+	for i := 0; i <= 20; i++ {
+		connected, err := fabrics.IsConnected(nqn)
+		if err != nil || !connected {
+			return err
+		}
+		time.Sleep(time.Second)
 	}
-
-	return devices, nil
+	return fmt.Errorf("timed out waiting for %s to disconnect", nqn)
 }
 
-func isNqnConnected(nqn string) (bool, error) {
-	cmd := exec.Command("nvme", "list-subsys")
-	output, err := cmd.Output()
+// lookupNamespace returns the namespace of a subsystem by NSID and, if
+// known, namespace UUID
+func lookupNamespace(subsys *nvme.Subsystem, nsID, nsUUID string) (*nvme.Namespace, error) {
+	nsid, err := strconv.Atoi(nsID)
 	if err != nil {
-		return false, fmt.Errorf("failed to execute nvme list-subsys: %v", err)
+		return nil, fmt.Errorf("invalid namespace ID %q of %s", nsID, subsys.NQN)
 	}
+	return fabrics.Namespace(subsys, nsid, nsUUID)
+}
 
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, nqn) {
-			parts := strings.Fields(line)
-			if len(parts) > 0 {
-				return true, nil
-			}
+// waitForNamespace waits for the namespace of a connected subsystem to
+// appear or timeout, a namespace with another UUID fails immediately
+func waitForNamespace(nqn, nsID, nsUUID string, seconds int) (*nvme.Namespace, error) {
+	for i := 0; ; i++ {
+		namespace, err := VolumeNamespace(map[string]string{"nqn": nqn, "nsId": nsID, "nsUuid": nsUUID})
+		if err == nil || !errors.Is(err, nvme.ErrNamespaceNotFound) || i >= seconds {
+			return namespace, err
 		}
+		time.Sleep(time.Second)
 	}
-	return false, nil
 }
 
-func getSubsystemsForDevice(devicePath string) ([]subsystemResponse, error) {
-	cmd := exec.Command("nvme", "list-subsys", "-o", "json", devicePath)
-	output, err := cmd.Output()
+// VolumeNamespace resolves the namespace of an NVMe-oF volume from sysfs by
+// subsystem NQN, NSID and, once known, namespace UUID. The block device of
+// a namespace may change across reconnects, so it is resolved again before
+// the device is used.
+func VolumeNamespace(volumeContext map[string]string) (*nvme.Namespace, error) {
+	nqn := volumeContext["nqn"]
+	subsys, err := fabrics.SubsystemByNQN(nqn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute nvme list-subsys: %v", err)
+		return nil, err
+	} else if subsys == nil {
+		return nil, fmt.Errorf("subsystem %s not connected: %w", nqn, nvme.ErrNamespaceNotFound)
 	}
-
-	var subsystems []subsystemResponse
-	if err := json.Unmarshal(output, &subsystems); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal nvme list-subsys output: %v", err)
-	}
-
-	return subsystems, nil
+	return lookupNamespace(subsys, volumeContext["nsId"], volumeContext["nsUuid"])
 }
 
-func getLvolIDFromNQN(nqn string) (clusterID, lvolID string) {
-	parts := strings.Split(nqn, ":lvol:")
-	if len(parts) > 1 {
-		subparts := strings.Split(parts[0], ":")
-		clusterID := subparts[len(subparts)-1]
-		lvolID := parts[1]
-		return clusterID, lvolID
+// VolumeDevicePath returns the block device of a staged volume
+func VolumeDevicePath(volumeContext map[string]string) (string, error) {
+	if IsNVMfTarget(volumeContext["targetType"]) {
+		namespace, err := VolumeNamespace(volumeContext)
+		if err != nil {
+			return "", err
+		}
+		return namespace.DevicePath(), nil
 	}
-	return "", ""
+	if volumeContext["devicePath"] == "" {
+		return "", errors.New("device path of the volume is unknown")
+	}
+	return volumeContext["devicePath"], nil
 }
 
-func parseAddress(address string) string {
-	parts := strings.Split(address, ",")
-	for _, part := range parts {
-		if strings.HasPrefix(part, "traddr=") {
-			return strings.TrimPrefix(part, "traddr=")
-		}
-	}
-	return ""
+// IsNQNConnected returns whether the host has a controller of the subsystem
+func IsNQNConnected(nqn string) (bool, error) {
+	return fabrics.IsConnected(nqn)
 }
 
-func reconnectSubsystems() error {
-	devices, err := getNVMeDeviceInfos()
+// ConnectedVolumeNQNs returns the NQNs of all connected lvol subsystems
+func ConnectedVolumeNQNs() ([]string, error) {
+	subsystems, err := fabrics.Subsystems()
 	if err != nil {
-		return fmt.Errorf("failed to get NVMe device paths: %v", err)
+		return nil, err
 	}
-
-	for _, device := range devices {
-		subsystems, err := getSubsystemsForDevice(device.devicePath)
-		if err != nil {
-			klog.Errorf("failed to get subsystems for device %s: %v", device.devicePath, err)
-			continue
+	var nqns []string
+	for i := range subsystems {
+		if _, lvolID := getLvolIDFromNQN(subsystems[i].NQN); lvolID != "" && len(subsystems[i].Paths) > 0 {
+			nqns = append(nqns, subsystems[i].NQN)
 		}
+	}
+	return nqns, nil
+}
 
-		for _, host := range subsystems {
-			for _, subsystem := range host.Subsystems {
-				clusterID, lvolID := getLvolIDFromNQN(subsystem.NQN)
-				if lvolID == "" {
-					continue
-				}
-
-				if len(subsystem.Paths) == 1 {
-					confirm := confirmSubsystemStillSinglePath(&subsystem, device.devicePath)
-
-					if !confirm {
-						continue
-					}
-					for _, path := range subsystem.Paths {
-						if path.State == "connecting" && device.serialNumber == "single" ||
-							((path.ANAState == "optimized" || path.ANAState == "non-optimized") && device.serialNumber == "ha") {
-							if err := checkOnlineNode(clusterID, lvolID, path); err != nil {
-								klog.Errorf("failed to reconnect subsystem for lvolID %s: %v", lvolID, err)
-							}
-						}
-					}
-				}
-			}
+// DisconnectNQN disconnects all controllers of the subsystem
+func DisconnectNQN(nqn string) error {
+	subsys, err := fabrics.SubsystemByNQN(nqn)
+	if err != nil || subsys == nil {
+		return err
+	}
+	for _, p := range subsys.Paths {
+		klog.Infof("Disconnecting %s from %s", p.Controller, nqn)
+		if err := fabrics.Disconnect(p.Controller); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func checkOnlineNode(clusterID, lvolID string, path path) error {
-	sbcClient, err := NewsimplyBlockClient(clusterID)
-	if err != nil {
-		return fmt.Errorf("failed to create SPDK client: %w", err)
+// VolumeCondition reports whether the NVMe-oF volume behind devicePath can
+// serve I/O. The volume is abnormal if the device is gone or no path is live.
+func VolumeCondition(devicePath string) (abnormal bool, message string) {
+	if _, err := os.Stat(devicePath); err != nil {
+		return true, fmt.Sprintf("device %s not found: %v", devicePath, err)
 	}
-
-	nodeInfo, err := fetchNodeInfo(sbcClient, lvolID)
+	subsys, err := fabrics.SubsystemForDevice(devicePath)
 	if err != nil {
-		return fmt.Errorf("failed to fetch node info: %w", err)
+		klog.Errorf("failed to read path states of %s: %v", devicePath, err)
+		return false, fmt.Sprintf("path states unknown: %v", err)
 	}
+	return pathCondition(subsys.Paths)
+}
 
-	for _, nodeID := range nodeInfo.Nodes {
-		if len(nodeInfo.NodeID) > 1 && !shouldConnectToNode(path.ANAState, nodeInfo.NodeID, nodeID) {
-			continue
-		}
-
-		if !isNodeOnline(sbcClient, nodeID) {
-			klog.Infof("Node %s is not yet online", nodeID)
-			continue
-		}
-
-		connections, err := fetchLvolConnection(sbcClient, lvolID)
-		if err != nil {
-			klog.Errorf("Failed to get lvol connection: %v", err)
-			continue
-		}
-
-		connCount := len(connections)
-		if connCount == 0 {
-			klog.Warningf("No NVMe connection found for lvol %s", lvolID)
-			continue
-		}
-
-		connIndex := 0
-		if path.ANAState == "optimized" && connCount > 1 {
-			connIndex = 1
-		}
-		conn := connections[connIndex]
-
-		targetIP := parseAddress(path.Address)
-		ctrlLossTmo := 60
-		if connCount == 1 && conn.IP != targetIP {
-			ctrlLossTmo *= 15
-
-			if err := disconnectViaNVMe(path); err != nil {
-				return err
-			}
-			if err := connectViaNVMe(conn, ctrlLossTmo); err != nil {
-				return err
-			}
-			return nil
-		}
-
-		if connCount > 1 {
-			if err := connectViaNVMe(conn, ctrlLossTmo); err != nil {
-				return err
-			}
-			return nil
+func pathCondition(paths []nvme.Path) (abnormal bool, message string) {
+	var live int
+	var down []string
+	for _, p := range paths {
+		if p.Live() {
+			live++
+		} else {
+			down = append(down, fmt.Sprintf("%s (%s) %s", p.Controller, p.TrAddr, p.State))
 		}
 	}
 
-	return nil
-}
-
-func shouldConnectToNode(anaState, currentNodeID, targetNodeID string) bool {
-	if anaState == "optimized" {
-		return currentNodeID != targetNodeID
+	switch {
+	case live == 0 && len(down) == 0:
+		return true, "no NVMe paths found"
+	case live == 0:
+		return true, "all paths down: " + strings.Join(down, ", ")
+	case len(down) > 0:
+		return false, fmt.Sprintf("%d of %d paths down: %s", len(down), live+len(down), strings.Join(down, ", "))
 	}
-	return currentNodeID == targetNodeID
+	return false, fmt.Sprintf("%d paths live", live)
 }
 
-func fetchNodeInfo(spdkNode *NodeNVMf, lvolID string) (*NodeInfo, error) {
-	resp, err := spdkNode.Client.CallSBCLI("GET", "/lvol/"+lvolID, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch node info: %v", err)
-	}
-	var info []NodeInfo
-	respBytes, _ := json.Marshal(resp)
-	if err := json.Unmarshal(respBytes, &info); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal node info: %v", err)
+func getLvolIDFromNQN(nqn string) (clusterID, lvolID string) {
+	parts := strings.Split(nqn, ":lvol:")
+	if len(parts) > 1 {
+		subparts := strings.Split(parts[0], ":")
+		clusterID := subparts[len(subparts)-1]
+		lvolID := parts[1]
+		return clusterID, lvolID
 	}
+	return "", ""
+}
 
-	if len(info) == 0 {
-		return nil, fmt.Errorf("empty node info response for lvolID %s", lvolID)
+// ctrlLossTimeout is the controller loss timeout of a path, a volume with
+// a single path waits longer for its target to come back
+func ctrlLossTimeout(paths int) int {
+	if paths == 1 {
+		return 60 * 15
 	}
+	return 60
+}
 
-	return &info[0], nil
+// pathKey identifies a path by transport, address and port
+func pathKey(transport, addr, port string) string {
+	return strings.ToLower(transport) + "://" + net.JoinHostPort(addr, port)
 }
 
-func isNodeOnline(spdkNode *NodeNVMf, nodeID string) bool {
-	resp, err := spdkNode.Client.CallSBCLI("GET", "/storagenode/"+nodeID, nil)
-	if err != nil {
-		klog.Errorf("failed to fetch node status for node %s: %v", nodeID, err)
-		return false
-	}
-	var status []NodeInfo
-	respBytes, _ := json.Marshal(resp)
-	if err := json.Unmarshal(respBytes, &status); err != nil {
-		klog.Errorf("failed to unmarshal node status for node %s: %v", nodeID, err)
-		return false
+// IsNVMfTarget returns whether volumes of the target type are connected
+// over NVMe-oF
+func IsNVMfTarget(targetType string) bool {
+	switch strings.ToLower(targetType) {
+	case TargetTypeNVMf, TargetTypeRDMA:
+		return true
 	}
-	return status[0].Status == "online"
+	return false
 }
 
-func fetchLvolConnection(spdkNode *NodeNVMf, lvolID string) ([]*LvolConnectResp, error) {
-	resp, err := spdkNode.Client.CallSBCLI("GET", "/lvol/connect/"+lvolID, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch connection: %v", err)
-	}
-	var connections []*LvolConnectResp
-	respBytes, _ := json.Marshal(resp)
-	if err := json.Unmarshal(respBytes, &connections); err != nil || len(connections) == 0 {
-		return nil, fmt.Errorf("invalid or empty connection response")
+// resolveTransport returns the transport to connect a path with, TCP if
+// none is given or the node has no RDMA device for an RDMA target
+func resolveTransport(transport string) string {
+	transport = strings.ToLower(transport)
+	switch {
+	case transport == "":
+		return TargetTypeNVMf
+	case transport == TargetTypeRDMA && !fabrics.RDMAAvailable():
+		klog.Warningf("no RDMA device found on the node, connecting over %s", TargetTypeNVMf)
+		return TargetTypeNVMf
 	}
-	return connections, nil
+	return transport
 }
 
 func connectViaNVMe(conn *LvolConnectResp, ctrlLossTmo int) error {
-	cmd := []string{
-		"nvme", "connect", "-t", "tcp",
-		"-a", conn.IP, "-s", strconv.Itoa(conn.Port),
-		"-n", conn.Nqn,
-		"-l", strconv.Itoa(ctrlLossTmo),
-		"-c", strconv.Itoa(conn.ReconnectDelay),
-		"-i", strconv.Itoa(conn.NrIoQueues),
-	}
-	if err := execWithTimeoutRetry(cmd, 40, 1); err != nil {
+	opts := &nvme.ConnectOptions{
+		Transport:      resolveTransport(conn.Transport),
+		TrAddr:         conn.IP,
+		TrSvcID:        strconv.Itoa(conn.Port),
+		NQN:            conn.Nqn,
+		CtrlLossTmo:    ctrlLossTmo,
+		ReconnectDelay: conn.ReconnectDelay,
+		NrIOQueues:     conn.NrIoQueues,
+	}
+	if err := connectWithRetry(opts, 1); err != nil {
 		klog.Errorf("nvme connect failed: %v", err)
 		return err
 	}
 	return nil
 }
 
-func disconnectViaNVMe(path path) error {
-	cmd := []string{
-		"nvme", "disconnect", "-d", path.Name,
-	}
-	if err := execWithTimeoutRetry(cmd, 40, 1); err != nil {
+func disconnectViaNVMe(path nvme.Path) error {
+	if err := fabrics.Disconnect(path.Controller); err != nil {
 		klog.Errorf("nvme disconnect failed: %v", err)
 		return err
 	}
 	return nil
 }
-
-func confirmSubsystemStillSinglePath(subsystem *subsystem, devicePath string) bool {
-	for i := 0; i < 5; i++ {
-		recheck, err := getSubsystemsForDevice(devicePath)
-		if err != nil {
-			klog.Errorf("failed to recheck subsystems for device %s: %v", devicePath, err)
-			continue
-		}
-
-		found := false
-		for _, h := range recheck {
-			for _, s := range h.Subsystems {
-				if s.NQN == subsystem.NQN {
-					found = true
-					if len(s.Paths) != 1 {
-						return false
-					}
-				}
-			}
-		}
-
-		if !found {
-			klog.Warningf("Subsystem %s not found during recheck, assuming it's gone", subsystem.NQN)
-			return false
-		}
-
-		time.Sleep(1 * time.Second)
-	}
-	return true
-}
-
-// MonitorConnection monitors the connection to the SPDK node and reconnects if necessary
-// TODO: make this monitoring multiple connections
-func MonitorConnection() {
-	for {
-		if err := reconnectSubsystems(); err != nil {
-			klog.Errorf("Error: %v\n", err)
-			continue
-		}
-
-		time.Sleep(3 * time.Second)
-	}
-}
@@ -18,8 +18,15 @@ limitations under the License.
 package util
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
 )
 
 func TestExecWithTimeoutPositive(t *testing.T) {
@@ -58,3 +65,192 @@ func runExecWithTimeout(cmdLine []string, timeout int) (int, error) {
 	elapsed := int(time.Since(start) / time.Second)
 	return elapsed, err
 }
+
+func TestPathCondition(t *testing.T) {
+	paths := func(states ...string) []nvme.Path {
+		var p []nvme.Path
+		for i, state := range states {
+			p = append(p, nvme.Path{Controller: "nvme" + strconv.Itoa(i), TrAddr: "10.0.0." + strconv.Itoa(i), State: state})
+		}
+		return p
+	}
+
+	tests := []struct {
+		name     string
+		states   []string
+		abnormal bool
+		message  string
+	}{
+		{"all live", []string{"live", "live"}, false, "2 paths live"},
+		{"degraded", []string{"live", "connecting"}, false, "1 of 2 paths down: nvme1 (10.0.0.1) connecting"},
+		{"all down", []string{"connecting", "resetting"}, true, "all paths down"},
+		{"no paths", nil, true, "no NVMe paths found"},
+	}
+	for _, tt := range tests {
+		abnormal, message := pathCondition(paths(tt.states...))
+		if abnormal != tt.abnormal || !strings.HasPrefix(message, tt.message) {
+			t.Errorf("%s: got %v %q, want %v %q", tt.name, abnormal, message, tt.abnormal, tt.message)
+		}
+	}
+}
+
+func TestVolumeNamespace(t *testing.T) {
+	root := t.TempDir()
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: root}
+	t.Cleanup(func() { fabrics = oldFabrics })
+
+	// two volumes share the subsystem
+	fakePaths(t, root, "live")
+	subsys := filepath.Join(root, "class", "nvme-subsystem", "nvme-subsys0")
+	for nsid, uuid := range map[int]string{1: "11111111-2222-3333-4444-555555555555", 2: "66666666-7777-8888-9999-000000000000"} {
+		dir := filepath.Join(subsys, "nvme0n"+strconv.Itoa(nsid))
+		mustMkdir(t, dir)
+		mustWrite(t, filepath.Join(dir, "nsid"), strconv.Itoa(nsid))
+		mustWrite(t, filepath.Join(dir, "uuid"), uuid)
+	}
+
+	vc := map[string]string{"targetType": "tcp", "nqn": healthTestNQN, "nsId": "2", "devicePath": "/dev/disk/by-id/nvme-lvol1_2"}
+	if devicePath, err := VolumeDevicePath(vc); err != nil || devicePath != "/dev/nvme0n2" {
+		t.Errorf("device path %s, %v", devicePath, err)
+	}
+	vc["nsUuid"] = "11111111-2222-3333-4444-555555555555"
+	if _, err := VolumeDevicePath(vc); !errors.Is(err, nvme.ErrNamespaceMismatch) {
+		t.Errorf("namespace of another volume used: %v", err)
+	}
+
+	nvmfUsersDir = t.TempDir()
+	t.Cleanup(func() { nvmfUsersDir = "/var/lib/spdkcsi/nvmf-users" })
+	for _, volumeID := range []string{"vol1", "vol2"} {
+		if err := addSubsystemUser(healthTestNQN, volumeID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	initiator := &initiatorNVMf{nqn: healthTestNQN, nsId: "1", nsUUID: vc["nsUuid"], volumeID: "vol1"}
+	if err := initiator.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(subsys, "nvme0")); err != nil {
+		t.Errorf("subsystem still used by another volume disconnected: %v", err)
+	}
+
+	// the namespace of vol2 was replaced by another volume, which was tuned
+	nvmfTuningDir = t.TempDir()
+	t.Cleanup(func() { nvmfTuningDir = "/var/lib/spdkcsi/nvmf-tuning" })
+	if err := stashNQNState(nvmfTuningDir, healthTestNQN, &tuningState{
+		Profile:    "default",
+		Namespaces: map[string]namespaceTuning{"1": {Profile: "streaming", UUID: "11111111-2222-3333-4444-555555555555"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	initiator.nsUUID = "66666666-7777-8888-9999-000000000000"
+	initiator.volumeID = "vol2"
+	if err := initiator.Disconnect(); err != nil {
+		t.Fatalf("disconnect of a replaced namespace: %v", err)
+	}
+	if users, err := subsystemVolumes(healthTestNQN); err != nil || len(users) != 0 {
+		t.Errorf("volumes using the subsystem %v, %v", users, err)
+	}
+	if _, err := os.Stat(filepath.Join(subsys, "nvme0")); err != nil {
+		t.Errorf("subsystem of the other namespace disconnected: %v", err)
+	}
+	var state tuningState
+	if _, err := lookupNQNState(nvmfTuningDir, healthTestNQN, &state); err != nil || state.Namespaces["1"].Profile != "streaming" {
+		t.Errorf("tuning of the other namespace removed: %+v, %v", state, err)
+	}
+}
+
+func TestDisconnectLegacyVolumes(t *testing.T) {
+	root := t.TempDir()
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: root}
+	nvmfUsersDir = t.TempDir()
+	t.Cleanup(func() {
+		fabrics = oldFabrics
+		nvmfUsersDir = "/var/lib/spdkcsi/nvmf-users"
+	})
+
+	// two volumes of a shared subsystem staged by a version that kept
+	// neither their volume IDs nor the users of the subsystem
+	fakePaths(t, root, "live")
+	subsys := filepath.Join(root, "class", "nvme-subsystem", "nvme-subsys0")
+	legacy := make([]map[string]string, 2)
+	users := make(map[string][]string)
+	for i := range legacy {
+		nsid := strconv.Itoa(i + 1)
+		mustMkdir(t, filepath.Join(subsys, "nvme0n"+nsid))
+		mustWrite(t, filepath.Join(subsys, "nvme0n"+nsid, "nsid"), nsid)
+		legacy[i] = map[string]string{
+			"targetType":        "tcp",
+			"nqn":               healthTestNQN,
+			"nsId":              nsid,
+			"connections":       `[{"ip":"10.0.0.0","port":4420}]`,
+			"stagingParentPath": "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv" + nsid + "/globalmount",
+		}
+		users[healthTestNQN] = append(users[healthTestNQN], SubsystemUser(legacy[i]))
+	}
+	// as the startup reconciliation after the upgrade
+	if err := RestoreSubsystemUsers(users, true); err != nil {
+		t.Fatal(err)
+	}
+
+	initiator, err := NewSpdkCsiInitiator(legacy[0], "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(subsys, "nvme0")); err != nil {
+		t.Fatalf("subsystem still used by the other legacy volume disconnected: %v", err)
+	}
+	if remaining, err := subsystemVolumes(healthTestNQN); err != nil || len(remaining) != 1 || remaining[0] != SubsystemUser(legacy[1]) {
+		t.Fatalf("users %v, %v after the first unstage", remaining, err)
+	}
+
+	// not recorded at all, e.g. the reconciliation could not read it
+	if err := setSubsystemVolumes(healthTestNQN, nil); err != nil {
+		t.Fatal(err)
+	}
+	initiator, err = NewSpdkCsiInitiator(legacy[1], "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(subsys, "nvme0")); err != nil {
+		t.Fatalf("subsystem with unknown users disconnected: %v", err)
+	}
+}
+
+func TestFindCachingNode(t *testing.T) {
+	cnodes := []*CachingNode{
+		{Hostname: "worker-1", UUID: "cn1"},
+		{Hostname: "worker-2.us-east-2.compute.internal", UUID: "cn2"},
+		{Hostname: "worker-3.a.example", UUID: "cn3a"},
+		{Hostname: "worker-3.b.example", UUID: "cn3b"},
+	}
+	testCases := []struct {
+		nodeID, want string
+	}{
+		{"worker-1", "cn1"},
+		{"worker-1.us-east-2.compute.internal", "cn1"},
+		{"worker-2", "cn2"},
+		{"worker-3.b.example", "cn3b"},
+		{"worker-3", ""},
+		{"worker-4", ""},
+	}
+	for _, tc := range testCases {
+		cnode, err := findCachingNode(cnodes, tc.nodeID)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: found caching node %s", tc.nodeID, cnode.UUID)
+			}
+			continue
+		}
+		if err != nil || cnode.UUID != tc.want {
+			t.Errorf("%s: got %v, %v, want %s", tc.nodeID, cnode, err, tc.want)
+		}
+	}
+}
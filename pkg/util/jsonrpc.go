@@ -24,57 +24,11 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"k8s.io/klog"
 )
 
-// SpdkNode defines interface for SPDK storage node
-//
-//   - Info returns node info(rpc url) for debugging purpose
-//   - LvStores returns available volume stores(name, size, etc) on that node.
-//   - VolumeInfo returns a string map to be passed to client node. Client node
-//     needs these info to mount the target. E.g, target IP, service port, nqn.
-//   - Create/Delete/Publish/UnpublishVolume per CSI controller service spec.
-//
-// NOTE: concurrency, idempotency, message ordering
-//
-// In below text, "implementation" refers to the code implements this interface,
-// and "caller" is the code uses the implementation.
-//
-// Concurrency requirements for implementation and caller:
-//   - Implementation should make sure CreateVolume is thread
-//     safe. Caller is free to request creating multiple volumes in
-//     same volume store concurrently, no data race should happen.
-//   - Implementation should make sure
-//     PublishVolume/UnpublishVolume/DeleteVolume for *different
-//     volumes* thread safe. Caller may issue these requests to
-//     *different volumes", in same volume store or not, concurrently.
-//   - PublishVolume/UnpublishVolume/DeleteVolume for *same volume* is
-//     not thread safe, concurrent access may lead to data
-//     race. Caller must serialize these calls to *same volume*,
-//     possibly by mutex or message queue per volume.
-//   - Implementation should make sure LvStores and VolumeInfo are
-//     thread safe, but it doesn't lock the returned resources. It
-//     means caller should adopt optimistic concurrency control and
-//     retry on specific failures.  E.g, caller calls LvStores and
-//     finds a volume store with enough free space, it calls
-//     CreateVolume but fails with "not enough space" because another
-//     caller may issue similar request at same time. The failed
-//     caller may redo above steps(call LvStores, pick volume store,
-//     CreateVolume) under this condition, or it can simply fail.
-//
-// Idempotent requirements for implementation:
-// Per CSI spec, it's possible that same request been sent multiple times due to
-// issues such as a temporary network failure. Implementation should have basic
-// logic to deal with idempotency.
-// E.g, ignore publishing an already published volume.
-//
-// Out of order messages handling for implementation:
-// Out of order message may happen in kubernetes CSI framework. E.g, unpublish
-// an already deleted volume. The baseline is there should be no code crash or
-// data corruption under these conditions. Implementation may try to detect and
-// report errors if possible.
-
 // errors deserve special care
 var (
 	ErrJSONNoSpaceLeft  = errors.New("json: No space left")
@@ -85,19 +39,6 @@ var (
 	ErrVolumeUnpublished = errors.New("volume not published")
 )
 
-type SpdkNode interface {
-	Info() string
-	LvStores() ([]LvStore, error)
-	VolumeInfo(lvolID string) (map[string]string, error)
-	CreateVolume(lvolName, lvsName string, sizeMiB int64) (string, error)
-	GetVolume(lvolName, lvsName string) (string, error)
-	DeleteVolume(lvolID string) error
-	PublishVolume(lvolID string) error
-	UnpublishVolume(lvolID string) error
-	CreateSnapshot(lvolName, snapshotName string) (string, error)
-	DeleteSnapshot(snapshotID string) error
-}
-
 // logical volume store
 type LvStore struct {
 	Name         string
@@ -115,6 +56,8 @@ type LvolConnectResp struct {
 	IP             string `json:"ip"`
 	Connect        string `json:"connect"`
 	NSID           int    `json:"ns_id"`
+	// Transport is tcp or rdma, tcp if not set
+	Transport string `json:"transport"`
 }
 
 type connectionInfo struct {
@@ -135,6 +78,7 @@ type RPCClient struct {
 	ClusterIP     string
 	ClusterSecret string
 	HTTPClient    *http.Client
+	Class         RequestClass // request budget to draw from
 }
 
 // CSIPoolsResp is the response of /pool/get_pools
@@ -189,9 +133,14 @@ func (client *RPCClient) lvStores() ([]LvStore, error) {
 		return nil, err
 	}
 
-	result, ok := out.([]CSIPoolsResp)
-	if !ok {
-		return nil, fmt.Errorf("failed to convert the response to CSIPoolsResp type. Interface: %v", out)
+	// the decoded response is a generic []interface{}, not []CSIPoolsResp
+	b, err := json.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the response: %w", err)
+	}
+	err = json.Unmarshal(b, &result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert the response to CSIPoolsResp type: %w", err)
 	}
 
 	lvs := make([]LvStore, len(result))
@@ -302,6 +251,11 @@ func (client *RPCClient) getVolumeInfo(lvolID string) (map[string]string, error)
 		return nil, err
 	}
 
+	targetType := TargetTypeNVMf
+	if result[0].Transport != "" {
+		targetType = strings.ToLower(result[0].Transport)
+	}
+
 	return map[string]string{
 		"name":           lvolID,
 		"uuid":           lvolID,
@@ -310,7 +264,7 @@ func (client *RPCClient) getVolumeInfo(lvolID string) (map[string]string, error)
 		"nrIoQueues":     strconv.Itoa(result[0].NrIoQueues),
 		"ctrlLossTmo":    strconv.Itoa(result[0].CtrlLossTmo),
 		"model":          model,
-		"targetType":     "tcp",
+		"targetType":     targetType,
 		"connections":    string(connectionsData),
 		"nsId":           strconv.Itoa(result[0].NSID),
 	}, nil
@@ -431,13 +385,37 @@ func (client *RPCClient) deleteSnapshot(snapshotID string) error {
 
 // CallSBCLI is a generic function to call the SimplyBlock API
 func (client *RPCClient) CallSBCLI(method, path string, args interface{}) (interface{}, error) {
+	cb := clusterBreaker(client)
+	if err := cb.allow(); err != nil {
+		return nil, fmt.Errorf("%s: %w", method, err)
+	}
+
+	release, err := clientLimiter(client).acquire(cfgRPCTimeoutSeconds * time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	inFlight := requestsInFlightGauge.WithLabelValues(client.ClusterID, client.Class.String())
+	inFlight.Inc()
+	defer func() {
+		inFlight.Dec()
+		release()
+	}()
+
+	out, serverErr, err := client.callSBCLI(method, path, args)
+	cb.record(serverErr, err)
+	return out, err
+}
+
+// callSBCLI sends the request to the SimplyBlock API. serverErr reports
+// whether a failure was caused by the cluster (unreachable or 5xx) rather
+// than by the request itself.
+func (client *RPCClient) callSBCLI(method, path string, args interface{}) (out interface{}, serverErr bool, err error) {
 	data := []byte(`{}`)
-	var err error
 
 	if args != nil {
 		data, err = json.Marshal(args)
 		if err != nil {
-			return nil, fmt.Errorf("%s: %w", method, err)
+			return nil, false, fmt.Errorf("%s: %w", method, err)
 		}
 	} else {
 		data = nil
@@ -447,7 +425,7 @@ func (client *RPCClient) CallSBCLI(method, path string, args interface{}) (inter
 	klog.Infof("Calling Simplyblock API: Method: %s: RequestURL: %s: Body: %s\n", method, requestURL, string(data))
 	req, err := http.NewRequest(method, requestURL, bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", method, err)
+		return nil, false, fmt.Errorf("%s: %w", method, err)
 	}
 
 	authHeader := fmt.Sprintf("%s %s", client.ClusterID, client.ClusterSecret)
@@ -459,12 +437,12 @@ func (client *RPCClient) CallSBCLI(method, path string, args interface{}) (inter
 
 	resp, err := client.HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", method, err)
+		return nil, true, fmt.Errorf("%s: %w", method, err)
 	}
 
 	defer resp.Body.Close()
 	if resp.StatusCode >= http.StatusInternalServerError {
-		return nil, fmt.Errorf("%s: HTTP error code: %d", method, resp.StatusCode)
+		return nil, true, fmt.Errorf("%s: HTTP error code: %d", method, resp.StatusCode)
 	}
 
 	var response struct {
@@ -475,17 +453,17 @@ func (client *RPCClient) CallSBCLI(method, path string, args interface{}) (inter
 
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
-		return nil, fmt.Errorf("%s: HTTP error code: %d Error: %w", method, resp.StatusCode, err)
+		return nil, false, fmt.Errorf("%s: HTTP error code: %d Error: %w", method, resp.StatusCode, err)
 	}
 
 	if resp.StatusCode >= http.StatusBadRequest {
-		return nil, fmt.Errorf("%s: HTTP error code: %d Error: %s", method, resp.StatusCode, response.Error)
+		return nil, false, fmt.Errorf("%s: HTTP error code: %d Error: %s", method, resp.StatusCode, response.Error)
 	}
 
 	if response.Result != nil {
-		return response.Result, nil
+		return response.Result, false, nil
 	}
-	return response.Results, nil
+	return response.Results, false, nil
 }
 
 // errorMatches checks if the error message from the full error
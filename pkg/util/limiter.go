@@ -0,0 +1,144 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RequestClass selects the request budget a client draws from. Each class
+// has its own budget per cluster, so a burst of provisioning requests cannot
+// starve the node-side reconnect monitor and vice versa.
+type RequestClass int
+
+const (
+	// RequestClassDefault is used by CSI operations (provisioning, staging, ...)
+	RequestClassDefault RequestClass = iota
+	// RequestClassMonitor is used by the node-side connection monitor
+	RequestClassMonitor
+)
+
+func (c RequestClass) String() string {
+	if c == RequestClassMonitor {
+		return "monitor"
+	}
+	return "default"
+}
+
+// RequestBudget limits the requests sent to one cluster by one request class.
+// Zero values mean unlimited.
+type RequestBudget struct {
+	QPS         float64 // sustained requests per second
+	Burst       int     // requests allowed above QPS in a burst
+	MaxInFlight int     // requests waiting for a response at the same time
+}
+
+// ErrClusterBusy is returned when a request could not get a slot in its
+// budget before the RPC timeout.
+var ErrClusterBusy = errors.New("too many requests to cluster")
+
+var (
+	// DefaultRequestBudget is the budget of RequestClassDefault unless set
+	DefaultRequestBudget = RequestBudget{QPS: 20, Burst: 40, MaxInFlight: 16}
+	// DefaultMonitorRequestBudget is the budget of RequestClassMonitor
+	// unless set
+	DefaultMonitorRequestBudget = RequestBudget{QPS: 5, Burst: 10, MaxInFlight: 4}
+)
+
+var (
+	budgetsMtx sync.RWMutex
+	budgets    = map[RequestClass]RequestBudget{
+		RequestClassDefault: DefaultRequestBudget,
+		RequestClassMonitor: DefaultMonitorRequestBudget,
+	}
+
+	limiters sync.Map // "clusterID/class" -> *clusterLimiter
+)
+
+// SetRequestBudget sets the budget of a request class. It must be called
+// before any request is sent, budgets of clusters already contacted are kept.
+func SetRequestBudget(class RequestClass, budget RequestBudget) {
+	budgetsMtx.Lock()
+	defer budgetsMtx.Unlock()
+	budgets[class] = budget
+}
+
+// clusterLimiter enforces a RequestBudget with a token bucket for the rate
+// and a semaphore for the requests in flight.
+type clusterLimiter struct {
+	rate     *rate.Limiter
+	inFlight chan struct{}
+}
+
+func newClusterLimiter(budget RequestBudget) *clusterLimiter {
+	limit := rate.Inf
+	if budget.QPS > 0 {
+		limit = rate.Limit(budget.QPS)
+	}
+	burst := budget.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	cl := &clusterLimiter{rate: rate.NewLimiter(limit, burst)}
+	if budget.MaxInFlight > 0 {
+		cl.inFlight = make(chan struct{}, budget.MaxInFlight)
+	}
+	return cl
+}
+
+// clientLimiter returns the limiter of client's cluster and request class
+func clientLimiter(client *RPCClient) *clusterLimiter {
+	key := fmt.Sprintf("%s/%s", client.ClusterID, client.Class)
+	if value, ok := limiters.Load(key); ok {
+		cl, _ := value.(*clusterLimiter) //nolint:errcheck // will not fail to convert
+		return cl
+	}
+
+	budgetsMtx.RLock()
+	budget := budgets[client.Class]
+	budgetsMtx.RUnlock()
+
+	value, _ := limiters.LoadOrStore(key, newClusterLimiter(budget))
+	cl, _ := value.(*clusterLimiter) //nolint:errcheck // will not fail to convert
+	return cl
+}
+
+// acquire waits for a token and a free in-flight slot. The returned function
+// releases the slot and must be called once the request completed.
+func (cl *clusterLimiter) acquire(timeout time.Duration) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := cl.rate.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("%w: rate limit: %v", ErrClusterBusy, err)
+	}
+	if cl.inFlight == nil {
+		return func() {}, nil
+	}
+	select {
+	case cl.inFlight <- struct{}{}:
+		return func() { <-cl.inFlight }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %d requests in flight", ErrClusterBusy, cap(cl.inFlight))
+	}
+}
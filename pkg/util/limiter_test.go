@@ -0,0 +1,78 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterMaxInFlight(t *testing.T) {
+	cl := newClusterLimiter(RequestBudget{MaxInFlight: 2})
+
+	release1, err := cl.acquire(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := cl.acquire(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// third request has to wait for a free slot
+	_, err = cl.acquire(100 * time.Millisecond)
+	if !errors.Is(err, ErrClusterBusy) {
+		t.Fatalf("expected ErrClusterBusy, got %v", err)
+	}
+
+	release1()
+	release3, err := cl.acquire(time.Second)
+	if err != nil {
+		t.Fatalf("slot should be free after release: %v", err)
+	}
+	release2()
+	release3()
+}
+
+func TestLimiterRate(t *testing.T) {
+	cl := newClusterLimiter(RequestBudget{QPS: 1, Burst: 2})
+
+	for i := 0; i < 2; i++ {
+		release, err := cl.acquire(time.Second)
+		if err != nil {
+			t.Fatalf("request %d within burst failed: %v", i, err)
+		}
+		release()
+	}
+	// the bucket is empty and the next token comes in one second
+	_, err := cl.acquire(100 * time.Millisecond)
+	if !errors.Is(err, ErrClusterBusy) {
+		t.Fatalf("expected ErrClusterBusy, got %v", err)
+	}
+}
+
+func TestLimiterClassesAreSeparate(t *testing.T) {
+	controller := clientLimiter(&RPCClient{ClusterID: "limiter-classes"})
+	monitor := clientLimiter(&RPCClient{ClusterID: "limiter-classes", Class: RequestClassMonitor})
+	if controller == monitor {
+		t.Fatal("request classes must not share a budget")
+	}
+	if controller != clientLimiter(&RPCClient{ClusterID: "limiter-classes"}) {
+		t.Fatal("clients of the same cluster and class must share a budget")
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+)
+
+const metricsNamespace = "simplyblock_csi"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cluster_circuit_state",
+		Help:      "Circuit breaker state of the cluster management API (0=closed, 1=half-open, 2=open).",
+	}, []string{"cluster_id"})
+
+	breakerRejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cluster_requests_rejected_total",
+		Help:      "Number of requests rejected because the cluster circuit was not closed.",
+	}, []string{"cluster_id"})
+
+	requestsInFlightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cluster_requests_in_flight",
+		Help:      "Number of requests to the cluster management API waiting for a response.",
+	}, []string{"cluster_id", "class"})
+
+	orphanConnectionsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphan_connections",
+		Help:      "Number of connected lvol subsystems no staged volume uses.",
+	})
+
+	orphansDisconnectedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphan_connections_disconnected_total",
+		Help:      "Number of orphan connections the node disconnected.",
+	})
+
+	xpuHealthyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "xpu_healthy",
+		Help:      "Whether the xPU answered its last health check (0=unhealthy, 1=healthy).",
+	}, []string{"xpu"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(breakerStateGauge, breakerRejectedCounter, requestsInFlightGauge,
+		orphanConnectionsGauge, orphansDisconnectedCounter, xpuHealthyGauge)
+}
+
+// ServeMetrics serves prometheus metrics at /metrics on the given address.
+// It returns immediately, an empty address disables the metrics server.
+func ServeMetrics(address string) {
+	if address == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	go func() {
+		klog.Infof("serving metrics on %s", address)
+		//nolint:gosec // metrics endpoint has no timeouts to tune
+		if err := http.ListenAndServe(address, mux); err != nil {
+			klog.Errorf("metrics server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// per subsystem state of the node, kept in a dir per kind of state with one
+// JSON file per NQN, readable by root only
+
+func nqnStateFile(dir, nqn string) string {
+	return filepath.Join(dir, url.PathEscape(nqn)+".json")
+}
+
+// stashNQNState stores the state of a subsystem
+func stashNQNState(dir, nqn string, state any) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	file := nqnStateFile(dir, nqn)
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// lookupNQNState reads the state of a subsystem, returns false if it has
+// none
+func lookupNQNState(dir, nqn string, state any) (bool, error) {
+	data, err := os.ReadFile(nqnStateFile(dir, nqn))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, state)
+}
+
+// cleanUpNQNState removes the state of a subsystem
+func cleanUpNQNState(dir, nqn string) error {
+	if err := os.Remove(nqnStateFile(dir, nqn)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// listNQNStates returns the NQNs with state in dir
+func listNQNStates(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var nqns []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if nqn, err := url.PathUnescape(name); err == nil {
+			nqns = append(nqns, nqn)
+		}
+	}
+	return nqns, nil
+}
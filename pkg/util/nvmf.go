@@ -17,6 +17,7 @@ limitations under the License.
 package util
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -42,6 +43,11 @@ func NewNVMf(clusterID, clusterIP, clusterSecret string) *NodeNVMf {
 	}
 }
 
+// ClusterID returns the ID of the cluster the client talks to
+func (node *NodeNVMf) ClusterID() string {
+	return node.Client.ClusterID
+}
+
 func (node *NodeNVMf) Info() string {
 	return node.Client.info()
 }
@@ -76,6 +82,7 @@ type CreateLVolData struct {
 	MaxNamespace int    `json:"max_namespace_per_subsys"`
 	DistNdcs     int    `json:"distr_ndcs"`
 	DistNpcs     int    `json:"distr_npcs"`
+	DistChunkBs  int    `json:"distr_chunk_bs,omitempty"`
 	PriorClass   int    `json:"lvol_priority_class"`
 	CryptoKey1   string `json:"crypto_key1"`
 	CryptoKey2   string `json:"crypto_key2"`
@@ -191,3 +198,94 @@ func (node *NodeNVMf) UnpublishVolume(lvolID string) error {
 	klog.V(5).Infof("volume unpublished: %s", lvolID)
 	return nil
 }
+
+// LvolNodes returns the storage nodes hosting the volume
+func (node *NodeNVMf) LvolNodes(lvolID string) (*NodeInfo, error) {
+	resp, err := node.Client.CallSBCLI("GET", "/lvol/"+lvolID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch node info: %w", err)
+	}
+	var info []NodeInfo
+	respBytes, _ := json.Marshal(resp)
+	if err := json.Unmarshal(respBytes, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal node info: %w", err)
+	}
+
+	if len(info) == 0 {
+		return nil, fmt.Errorf("empty node info response for lvolID %s", lvolID)
+	}
+
+	return &info[0], nil
+}
+
+// IsNodeOnline returns whether the storage node is online
+func (node *NodeNVMf) IsNodeOnline(nodeID string) bool {
+	resp, err := node.Client.CallSBCLI("GET", "/storagenode/"+nodeID, nil)
+	if err != nil {
+		klog.Errorf("failed to fetch node status for node %s: %v", nodeID, err)
+		return false
+	}
+	var status []NodeInfo
+	respBytes, _ := json.Marshal(resp)
+	if err := json.Unmarshal(respBytes, &status); err != nil {
+		klog.Errorf("failed to unmarshal node status for node %s: %v", nodeID, err)
+		return false
+	}
+	return len(status) > 0 && status[0].Status == "online"
+}
+
+// LvolConnections returns the NVMe-oF connections of the volume
+func (node *NodeNVMf) LvolConnections(lvolID string) ([]*LvolConnectResp, error) {
+	resp, err := node.Client.CallSBCLI("GET", "/lvol/connect/"+lvolID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch connection: %w", err)
+	}
+	var connections []*LvolConnectResp
+	respBytes, _ := json.Marshal(resp)
+	if err := json.Unmarshal(respBytes, &connections); err != nil || len(connections) == 0 {
+		return nil, fmt.Errorf("invalid or empty connection response")
+	}
+	return connections, nil
+}
+
+// CachingNodes returns the caching nodes of the cluster
+func (node *NodeNVMf) CachingNodes() ([]*CachingNode, error) {
+	out, err := node.Client.CallSBCLI("GET", "/cachingnode", nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	var cnodes []*CachingNode
+	err = json.Unmarshal(data, &cnodes)
+	if err != nil {
+		return nil, err
+	}
+	return cnodes, nil
+}
+
+type lVolCachingNodeConnect struct {
+	LvolID string `json:"lvol_id"`
+}
+
+// ConnectCachingNode connects the volume to the caching node
+func (node *NodeNVMf) ConnectCachingNode(nodeID, lvolID string) error {
+	resp, err := node.Client.CallSBCLI("PUT", "/cachingnode/connect/"+nodeID, lVolCachingNodeConnect{LvolID: lvolID})
+	if err != nil {
+		return err
+	}
+	klog.Info("caching node connect resp: ", resp)
+	return nil
+}
+
+// DisconnectCachingNode disconnects the volume from the caching node
+func (node *NodeNVMf) DisconnectCachingNode(nodeID, lvolID string) error {
+	resp, err := node.Client.CallSBCLI("PUT", "/cachingnode/disconnect/"+nodeID, lVolCachingNodeConnect{LvolID: lvolID})
+	if err != nil {
+		return err
+	}
+	klog.Info("caching node disconnect resp: ", resp)
+	return nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// blackbox test of the SimplyBlock client against the API simulator
+package util_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/simulator"
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+func newSimulatedNode(t *testing.T, clusterID string) (*simulator.Simulator, *util.NodeNVMf) {
+	t.Helper()
+	sim := simulator.New(clusterID, "secret")
+	sim.AddPool("pool01", 10<<30)
+	server := httptest.NewServer(sim)
+	t.Cleanup(server.Close)
+	return sim, util.NewNVMf(clusterID, server.URL, "secret")
+}
+
+func TestNVMfVolumeLifecycle(t *testing.T) {
+	sim, node := newSimulatedNode(t, "nvmf-lifecycle")
+
+	lvolID, err := node.CreateVolume(&util.CreateLVolData{LvolName: "vol01", Size: "1024M", LvsName: "pool01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := node.GetVolume("vol01", "pool01"); err != nil || id != lvolID {
+		t.Fatalf("GetVolume returned %q, %v, want %q", id, err, lvolID)
+	}
+	if size, err := node.GetVolumeSize(lvolID); err != nil || size != "1073741824" {
+		t.Fatalf("GetVolumeSize returned %q, %v", size, err)
+	}
+
+	info, err := node.VolumeInfo(lvolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(info["nqn"], ":lvol:"+lvolID) || info["model"] != lvolID {
+		t.Fatalf("unexpected volume info %v", info)
+	}
+
+	if _, err := node.ResizeVolume(lvolID, 2<<30); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := node.GetVolumeSize(lvolID); size != "2147483648" {
+		t.Fatalf("volume not resized, size %s", size)
+	}
+
+	snapshotID, err := node.CreateSnapshot(lvolID, "snap01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := node.ListSnapshots()
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("ListSnapshots returned %d snapshots, %v", len(snapshots), err)
+	}
+	cloneID, err := node.CloneSnapshot(snapshots[0].UUID, "clone01", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(snapshotID, "nvmf-lifecycle:") {
+		t.Fatalf("snapshot ID %s is not prefixed with the cluster ID", snapshotID)
+	}
+
+	for _, id := range []string{cloneID, lvolID} {
+		if err := node.DeleteVolume(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := node.DeleteSnapshot(snapshots[0].UUID); err != nil {
+		t.Fatal(err)
+	}
+	if sim.LvolCount() != 0 {
+		t.Fatalf("%d volumes left after delete", sim.LvolCount())
+	}
+	if _, err := node.GetVolume("vol01", "pool01"); err == nil {
+		t.Fatal("deleted volume should not be found")
+	}
+}
+
+func TestNVMfPoolFull(t *testing.T) {
+	sim, node := newSimulatedNode(t, "nvmf-pool-full")
+	sim.SetPoolFull("pool01", true)
+
+	_, err := node.CreateVolume(&util.CreateLVolData{LvolName: "vol01", Size: "1024M", LvsName: "pool01"})
+	if err == nil || !strings.Contains(err.Error(), "No space left") {
+		t.Fatalf("expected no space error, got %v", err)
+	}
+}
+
+func TestNVMfInjectedFault(t *testing.T) {
+	sim, node := newSimulatedNode(t, "nvmf-fault")
+	sim.InjectFault(simulator.Fault{Method: http.MethodGet, Path: "pool", StatusCode: http.StatusServiceUnavailable, Message: "busy", Count: 1})
+
+	if _, err := node.LvStores(); err == nil {
+		t.Fatal("injected fault should fail the request")
+	}
+	lvs, err := node.LvStores()
+	if err != nil || len(lvs) != 1 || lvs[0].Name != "pool01" {
+		t.Fatalf("LvStores returned %v, %v after the fault was consumed", lvs, err)
+	}
+}
+
+func TestNVMfLvStores(t *testing.T) {
+	sim, node := newSimulatedNode(t, "nvmf-lvstores")
+	poolID := sim.AddPool("pool02", 2<<30)
+
+	lvs, err := node.LvStores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lvs) != 2 {
+		t.Fatalf("LvStores returned %d pools, expected 2", len(lvs))
+	}
+	for _, lvStore := range lvs {
+		if lvStore.Name != "pool02" {
+			continue
+		}
+		if lvStore.UUID != poolID || lvStore.TotalSizeMiB != 2048 || lvStore.FreeSizeMiB != 2048 {
+			t.Fatalf("unexpected pool %+v", lvStore)
+		}
+		return
+	}
+	t.Fatalf("pool02 missing from %+v", lvs)
+}
+
+func TestNVMfCloneReleasesNoSpace(t *testing.T) {
+	_, node := newSimulatedNode(t, "nvmf-clone-space")
+	freeMiB := func() int64 {
+		t.Helper()
+		lvs, err := node.LvStores()
+		if err != nil || len(lvs) != 1 {
+			t.Fatalf("LvStores returned %v, %v", lvs, err)
+		}
+		return lvs[0].FreeSizeMiB
+	}
+
+	lvolID, err := node.CreateVolume(&util.CreateLVolData{LvolName: "vol01", Size: "1024M", LvsName: "pool01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withVolume := freeMiB()
+	if _, err := node.CreateSnapshot(lvolID, "snap01"); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := node.ListSnapshots()
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("ListSnapshots returned %d snapshots, %v", len(snapshots), err)
+	}
+	cloneID, err := node.CloneSnapshot(snapshots[0].UUID, "clone01", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free := freeMiB(); free != withVolume {
+		t.Fatalf("clone allocated %d MiB", withVolume-free)
+	}
+	if err := node.DeleteVolume(cloneID); err != nil {
+		t.Fatal(err)
+	}
+	if free := freeMiB(); free != withVolume {
+		t.Fatalf("deleting the clone changed the free space from %d to %d MiB", withVolume, free)
+	}
+	if err := node.DeleteVolume(lvolID); err != nil {
+		t.Fatal(err)
+	}
+	if free := freeMiB(); free != 10<<10 {
+		t.Fatalf("%d MiB free after deleting all volumes, want %d", free, 10<<10)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+// keys of the NVMe-oF secrets in node stage secrets and volume context
+const (
+	KeyDHChapSecret     = "dhchap_secret"
+	KeyDHChapCtrlSecret = "dhchap_ctrl_secret"
+	KeyTLSPSK           = "tls_psk"
+)
+
+var (
+	// nvmfAuthDir keeps the secrets of the connected subsystems, readable by
+	// root only, replaced by tests
+	nvmfAuthDir = "/var/lib/spdkcsi/nvmf-auth"
+	// nvmeConfigDir holds the hostnqn and hostid files of nvme-cli
+	nvmeConfigDir = "/etc/nvme"
+	// removeTLSKey is replaced by tests
+	removeTLSKey = nvme.RemoveTLSKey
+)
+
+// NVMfAuth are the in-band authentication and TLS secrets of a subsystem
+type NVMfAuth struct {
+	DHChapSecret     string `json:"dhchap_secret,omitempty"`
+	DHChapCtrlSecret string `json:"dhchap_ctrl_secret,omitempty"`
+	TLSPSK           string `json:"tls_psk,omitempty"`
+}
+
+// TakeNVMfAuth returns the NVMe-oF secrets of a volume from the node stage
+// secrets or, if not given there, the volume context. The secrets are
+// removed from the volume context so they are not stashed with it. Returns
+// nil if the volume has no secrets.
+func TakeNVMfAuth(secrets, volumeContext map[string]string) (*NVMfAuth, error) {
+	take := func(key string) string {
+		value := volumeContext[key]
+		delete(volumeContext, key)
+		if secret := secrets[key]; secret != "" {
+			value = secret
+		}
+		return strings.TrimSpace(value)
+	}
+	auth := &NVMfAuth{
+		DHChapSecret:     take(KeyDHChapSecret),
+		DHChapCtrlSecret: take(KeyDHChapCtrlSecret),
+		TLSPSK:           take(KeyTLSPSK),
+	}
+
+	switch {
+	case *auth == NVMfAuth{}:
+		return nil, nil
+	case auth.DHChapSecret != "" && !strings.HasPrefix(auth.DHChapSecret, "DHHC-1:"):
+		return nil, fmt.Errorf("%s is not a DHHC-1 secret", KeyDHChapSecret)
+	case auth.DHChapCtrlSecret != "" && !strings.HasPrefix(auth.DHChapCtrlSecret, "DHHC-1:"):
+		return nil, fmt.Errorf("%s is not a DHHC-1 secret", KeyDHChapCtrlSecret)
+	case auth.DHChapCtrlSecret != "" && auth.DHChapSecret == "":
+		return nil, fmt.Errorf("%s needs %s", KeyDHChapCtrlSecret, KeyDHChapSecret)
+	case auth.TLSPSK != "" && !strings.HasPrefix(auth.TLSPSK, "NVMeTLSkey-1:"):
+		return nil, fmt.Errorf("%s is not in NVMeTLSkey-1 format", KeyTLSPSK)
+	}
+	return auth, nil
+}
+
+// StashNVMfAuth keeps the secrets of a subsystem for connects and reconnects
+func StashNVMfAuth(nqn string, auth *NVMfAuth) error {
+	if nqn == "" {
+		return errors.New("NVMe-oF secrets given for a volume without NQN")
+	}
+	if err := stashNQNState(nvmfAuthDir, nqn, auth); err != nil {
+		return fmt.Errorf("failed to stash secrets of %s: %w", nqn, err)
+	}
+	return nil
+}
+
+// lookupNVMfAuth returns the stashed secrets of a subsystem, nil if it has
+// none
+func lookupNVMfAuth(nqn string) (*NVMfAuth, error) {
+	var auth NVMfAuth
+	found, err := lookupNQNState(nvmfAuthDir, nqn, &auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets of %s: %w", nqn, err)
+	} else if !found {
+		return nil, nil
+	}
+	return &auth, nil
+}
+
+// CleanUpNVMfAuth removes the stashed secrets of a subsystem and its TLS
+// PSK from the keyring
+func CleanUpNVMfAuth(nqn string) error {
+	if nqn == "" {
+		return nil
+	}
+	auth, err := lookupNVMfAuth(nqn)
+	if err != nil {
+		return err
+	}
+	if auth != nil && auth.TLSPSK != "" {
+		if err := removeTLSKey(localHostNQN(), nqn); err != nil {
+			return err
+		}
+	}
+	if err := cleanUpNQNState(nvmfAuthDir, nqn); err != nil {
+		return fmt.Errorf("failed to clean up secrets of %s: %w", nqn, err)
+	}
+	return nil
+}
+
+// prepareConnect sets the host identity, the stashed connect parameters and
+// the stashed secrets of the subsystem on the connect options
+func prepareConnect(opts *nvme.ConnectOptions) error {
+	opts.HostNQN = localHostNQN()
+	if hostIdentity != nil {
+		opts.HostID = hostIdentity.HostID
+	}
+	if opts.HostID == "" {
+		opts.HostID = readConfigFile("hostid")
+	}
+
+	params, err := lookupConnectParams(opts.NQN)
+	if err != nil {
+		return err
+	} else if params != nil {
+		params.apply(opts)
+	}
+
+	auth, err := lookupNVMfAuth(opts.NQN)
+	if err != nil || auth == nil {
+		return err
+	}
+	opts.DHChapSecret = auth.DHChapSecret
+	opts.DHChapCtrlSecret = auth.DHChapCtrlSecret
+	if auth.TLSPSK != "" {
+		key, err := nvme.InsertTLSKey(opts.HostNQN, opts.NQN, auth.TLSPSK)
+		if err != nil {
+			return err
+		}
+		opts.TLS = true
+		opts.TLSKey = key
+	}
+	return nil
+}
+
+// localHostNQN returns the host NQN the node connects with
+func localHostNQN() string {
+	if hostIdentity != nil {
+		return hostIdentity.HostNQN
+	}
+	return readConfigFile("hostnqn")
+}
+
+func readConfigFile(name string) string {
+	data, err := os.ReadFile(filepath.Join(nvmeConfigDir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,168 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the NVMe-oF secret store
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+func TestTakeNVMfAuth(t *testing.T) {
+	volumeContext := map[string]string{
+		"nqn":               healthTestNQN,
+		KeyDHChapSecret:     "DHHC-1:00:fromcontext:",
+		KeyDHChapCtrlSecret: "DHHC-1:00:ctrl:",
+	}
+	auth, err := TakeNVMfAuth(map[string]string{KeyDHChapSecret: "DHHC-1:00:fromsecret:"}, volumeContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.DHChapSecret != "DHHC-1:00:fromsecret:" || auth.DHChapCtrlSecret != "DHHC-1:00:ctrl:" {
+		t.Errorf("unexpected secrets %+v", auth)
+	}
+	if len(volumeContext) != 1 {
+		t.Errorf("secrets left in volume context %v", volumeContext)
+	}
+
+	if auth, err := TakeNVMfAuth(nil, map[string]string{"nqn": healthTestNQN}); auth != nil || err != nil {
+		t.Errorf("volume without secrets: %v, %v", auth, err)
+	}
+	for _, secrets := range []map[string]string{
+		{KeyDHChapSecret: "plain"},
+		{KeyDHChapCtrlSecret: "DHHC-1:00:ctrl:"},
+		{KeyTLSPSK: "secret"},
+	} {
+		if _, err := TakeNVMfAuth(secrets, map[string]string{}); err == nil {
+			t.Errorf("secrets %v should be rejected", secrets)
+		}
+	}
+}
+
+func TestNVMfAuthStash(t *testing.T) {
+	nvmfAuthDir = filepath.Join(t.TempDir(), "nvmf-auth")
+	nvmeConfigDir = t.TempDir()
+	t.Cleanup(func() {
+		nvmfAuthDir = "/var/lib/spdkcsi/nvmf-auth"
+		nvmeConfigDir = "/etc/nvme"
+	})
+	mustWrite(t, filepath.Join(nvmeConfigDir, "hostnqn"), "nqn.2014-08.org.nvmexpress:uuid:host1\n")
+
+	auth := &NVMfAuth{DHChapSecret: "DHHC-1:00:host:", DHChapCtrlSecret: "DHHC-1:00:ctrl:"}
+	if err := StashNVMfAuth(healthTestNQN, auth); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(nvmfAuthDir)
+	if err != nil || info.Mode().Perm() != 0o700 {
+		t.Fatalf("secret store %v, %v", info, err)
+	}
+	info, err = os.Stat(nqnStateFile(nvmfAuthDir, healthTestNQN))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("secret file %v, %v", info, err)
+	}
+
+	opts := &nvme.ConnectOptions{NQN: healthTestNQN}
+	if err := prepareConnect(opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.HostNQN != "nqn.2014-08.org.nvmexpress:uuid:host1" || opts.DHChapSecret != auth.DHChapSecret || opts.DHChapCtrlSecret != auth.DHChapCtrlSecret {
+		t.Errorf("unexpected connect options %+v", opts)
+	}
+
+	if err := CleanUpNVMfAuth(healthTestNQN); err != nil {
+		t.Fatal(err)
+	}
+	opts = &nvme.ConnectOptions{NQN: healthTestNQN}
+	if err := prepareConnect(opts); err != nil || opts.DHChapSecret != "" {
+		t.Errorf("secrets left after clean up: %+v, %v", opts, err)
+	}
+}
+
+func TestNVMfAuthRemovesTLSKey(t *testing.T) {
+	nvmfAuthDir = filepath.Join(t.TempDir(), "nvmf-auth")
+	nvmeConfigDir = t.TempDir()
+	var removed []string
+	removeTLSKey = func(hostNQN, subsysNQN string) error {
+		removed = append(removed, hostNQN+" "+subsysNQN)
+		return nil
+	}
+	t.Cleanup(func() {
+		nvmfAuthDir = "/var/lib/spdkcsi/nvmf-auth"
+		nvmeConfigDir = "/etc/nvme"
+		removeTLSKey = nvme.RemoveTLSKey
+	})
+	mustWrite(t, filepath.Join(nvmeConfigDir, "hostnqn"), "nqn.2014-08.org.nvmexpress:uuid:host1\n")
+
+	if err := StashNVMfAuth(healthTestNQN, &NVMfAuth{TLSPSK: "NVMeTLSkey-1:01:key:"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CleanUpNVMfAuth(healthTestNQN); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "nqn.2014-08.org.nvmexpress:uuid:host1 "+healthTestNQN {
+		t.Errorf("removed TLS keys %v", removed)
+	}
+	// nothing left to remove
+	if err := CleanUpNVMfAuth(healthTestNQN); err != nil || len(removed) != 1 {
+		t.Errorf("second clean up removed %v, %v", removed, err)
+	}
+}
+
+func TestCleanUpUnusedSubsystem(t *testing.T) {
+	nvmfAuthDir = filepath.Join(t.TempDir(), "nvmf-auth")
+	nvmfUsersDir = t.TempDir()
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: t.TempDir()}
+	t.Cleanup(func() {
+		nvmfAuthDir = "/var/lib/spdkcsi/nvmf-auth"
+		nvmfUsersDir = "/var/lib/spdkcsi/nvmf-users"
+		fabrics = oldFabrics
+	})
+	auth := &NVMfAuth{DHChapSecret: "DHHC-1:00:host:"}
+	stashed := func() bool {
+		t.Helper()
+		found, err := lookupNVMfAuth(healthTestNQN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found != nil
+	}
+
+	// the first stage of a volume of a subsystem another volume uses
+	if err := StashNVMfAuth(healthTestNQN, auth); err != nil {
+		t.Fatal(err)
+	}
+	if err := addSubsystemUser(healthTestNQN, "vol1"); err != nil {
+		t.Fatal(err)
+	}
+	CleanUpUnusedSubsystem(healthTestNQN)
+	if !stashed() {
+		t.Fatal("secrets of a used subsystem removed")
+	}
+
+	// the first stage of the only volume
+	if _, err := removeSubsystemUser(healthTestNQN, "vol1"); err != nil {
+		t.Fatal(err)
+	}
+	CleanUpUnusedSubsystem(healthTestNQN)
+	if stashed() {
+		t.Fatal("secrets left after a failed first stage")
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+	mount "k8s.io/mount-utils"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+// OrphanCollector disconnects lvol subsystems that no staged volume uses,
+// left behind by failed stages, crashes between connecting and stashing the
+// volume context, or manual debugging. An orphan is disconnected once it was
+// found for the whole grace period and none of its namespaces is mounted.
+type OrphanCollector struct {
+	kubeletPluginDir string
+	mounter          mount.Interface
+	gracePeriod      time.Duration
+	// dryRun only reports the orphans
+	dryRun bool
+
+	// firstSeen is when each orphan was found
+	firstSeen map[string]time.Time
+	// replaced by tests
+	now func() time.Time
+}
+
+// NewOrphanCollector creates an orphan collector for the volumes staged
+// below kubeletPluginDir
+func NewOrphanCollector(kubeletPluginDir string, mounter mount.Interface, gracePeriod time.Duration, dryRun bool) *OrphanCollector {
+	return &OrphanCollector{
+		kubeletPluginDir: kubeletPluginDir,
+		mounter:          mounter,
+		gracePeriod:      gracePeriod,
+		dryRun:           dryRun,
+		firstSeen:        make(map[string]time.Time),
+		now:              time.Now,
+	}
+}
+
+// Run collects orphans every interval until ctx is done. The first round
+// runs right away, so the grace period of orphans kept by CollectStartup,
+// e.g. in dry run, goes on.
+func (c *OrphanCollector) Run(ctx context.Context, interval time.Duration) {
+	klog.Infof("collecting orphan connections every %s, grace period %s, dry run %t", interval, c.gracePeriod, c.dryRun)
+	c.collect()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.collect()
+		}
+	}
+}
+
+// CollectStartup runs one round without grace period, for the startup of
+// the node plugin: no volume is being staged before it serves requests, so
+// orphans left by its previous run are disconnected right away. Returns the
+// number of orphans found and the disconnected subsystems.
+func (c *OrphanCollector) CollectStartup() (int, []string) {
+	return c.round(0)
+}
+
+// collect runs one round, returns the disconnected subsystems
+func (c *OrphanCollector) collect() []string {
+	_, disconnected := c.round(c.gracePeriod)
+	return disconnected
+}
+
+// round disconnects the orphans found for gracePeriod, returns the number of
+// orphans found and the disconnected subsystems
+func (c *OrphanCollector) round(gracePeriod time.Duration) (int, []string) {
+	inUse, err := c.subsystemsInUse()
+	if err != nil {
+		klog.Errorf("skipping orphan collection: %v", err)
+		return 0, nil
+	}
+	connected, err := ConnectedVolumeNQNs()
+	if err != nil {
+		klog.Errorf("skipping orphan collection, failed to list connected volumes: %v", err)
+		return 0, nil
+	}
+
+	now := c.now()
+	orphans := make(map[string]time.Time)
+	var disconnected []string
+	for _, nqn := range connected {
+		if _, ok := inUse[nqn]; ok {
+			continue
+		}
+		found, ok := c.firstSeen[nqn]
+		if !ok {
+			klog.Infof("found orphan connection %s, collecting it after %s", nqn, gracePeriod)
+			found = now
+		}
+		if now.Sub(found) >= gracePeriod && c.collectOrphan(nqn) {
+			disconnected = append(disconnected, nqn)
+			continue
+		}
+		orphans[nqn] = found
+	}
+	c.firstSeen = orphans
+	orphanConnectionsGauge.Set(float64(len(orphans)))
+	return len(orphans) + len(disconnected), disconnected
+}
+
+// subsystemsInUse returns the NQNs of the staged volumes and of the
+// subsystems with volumes being staged
+func (c *OrphanCollector) subsystemsInUse() (map[string]struct{}, error) {
+	stagingPaths, err := FindVolumeContexts(c.kubeletPluginDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find staged volumes: %w", err)
+	}
+	inUse := make(map[string]struct{}, len(stagingPaths))
+	for _, stagingParentPath := range stagingPaths {
+		volumeContext, err := LookupVolumeContext(stagingParentPath)
+		if err != nil {
+			// it may belong to any connection
+			return nil, fmt.Errorf("failed to read volume context in %s: %w", stagingParentPath, err)
+		}
+		inUse[volumeContext["nqn"]] = struct{}{}
+	}
+	nqns, err := listNQNStates(nvmfUsersDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the volumes using each subsystem: %w", err)
+	}
+	for _, nqn := range nqns {
+		inUse[nqn] = struct{}{}
+	}
+	return inUse, nil
+}
+
+// collectOrphan disconnects an orphan unless a volume was staged meanwhile
+// or its namespaces are mounted, returns whether it was disconnected
+func (c *OrphanCollector) collectOrphan(nqn string) bool {
+	unlock := LockSubsystem(nqn)
+	defer unlock()
+
+	if volumes, err := subsystemVolumes(nqn); err != nil || len(volumes) > 0 {
+		return false
+	}
+	subsys, err := fabrics.SubsystemByNQN(nqn)
+	if err != nil || subsys == nil {
+		return false
+	}
+	mounted, err := c.mountedNamespaces(subsys)
+	if err != nil {
+		klog.Errorf("keeping orphan connection %s, failed to check its mounts: %v", nqn, err)
+		return false
+	} else if len(mounted) > 0 {
+		klog.Warningf("keeping orphan connection %s, no staged volume uses it but %v are mounted", nqn, mounted)
+		return false
+	}
+
+	if c.dryRun {
+		klog.Infof("dry run: would disconnect orphan connection %s", nqn)
+		return false
+	}
+	klog.Infof("disconnecting orphan connection %s", nqn)
+	disconnectSubsystem(subsys)
+	if err := CleanUpNVMfAuth(nqn); err != nil {
+		klog.Error(err)
+	}
+	if err := CleanUpConnectParams(nqn); err != nil {
+		klog.Error(err)
+	}
+	if err := CleanUpTuning(nqn); err != nil {
+		klog.Error(err)
+	}
+	orphansDisconnectedCounter.Inc()
+	return true
+}
+
+// mountedNamespaces returns the mounted namespaces and partitions of a
+// subsystem
+func (c *OrphanCollector) mountedNamespaces(subsys *nvme.Subsystem) ([]string, error) {
+	mountPoints, err := c.mounter.List()
+	if err != nil {
+		return nil, err
+	}
+	var mounted []string
+	for _, mp := range mountPoints {
+		device := filepath.Base(mp.Device)
+		for _, ns := range subsys.Namespaces {
+			if strings.HasPrefix(mp.Device, "/dev/") && (device == ns || strings.HasPrefix(device, ns+"p")) {
+				mounted = append(mounted, mp.Device+" on "+mp.Path)
+			}
+		}
+	}
+	return mounted, nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the orphan connection collector against a fake sysfs tree
+package util
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	mount "k8s.io/mount-utils"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+func TestOrphanCollector(t *testing.T) {
+	root := t.TempDir()
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: root}
+	nvmfUsersDir = t.TempDir()
+	t.Cleanup(func() {
+		fabrics = oldFabrics
+		nvmfUsersDir = "/var/lib/spdkcsi/nvmf-users"
+	})
+	fakePaths(t, root, "live")
+	mustMkdir(t, filepath.Join(root, "class", "nvme-subsystem", "nvme-subsys0", "nvme0n1"))
+
+	pluginDir := t.TempDir()
+	stagingParentPath := filepath.Join(pluginDir, "kubernetes.io", "csi", "csi.simplyblock.io", "hash1", "globalmount")
+	mustMkdir(t, stagingParentPath)
+	if err := StashVolumeContext(map[string]string{"nqn": "nqn.2023-02.io.simplyblock:cluster1:lvol:lvol2"}, stagingParentPath); err != nil {
+		t.Fatal(err)
+	}
+
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "/dev/nvme0n1p1", Path: "/mnt/debug"}})
+	now := time.Unix(0, 0)
+	c := NewOrphanCollector(pluginDir, mounter, 10*time.Minute, true)
+	c.now = func() time.Time { return now }
+	step := func(d time.Duration, want ...string) {
+		t.Helper()
+		now = now.Add(d)
+		if got := c.collect(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("after %s: disconnected %v, want %v", now.Sub(time.Unix(0, 0)), got, want)
+		}
+	}
+
+	// grace period
+	step(0)
+	step(9 * time.Minute)
+	// a partition is mounted
+	step(time.Minute)
+	if err := mounter.Unmount("/mnt/debug"); err != nil {
+		t.Fatal(err)
+	}
+	// dry run
+	step(time.Minute)
+	if _, ok := c.firstSeen[healthTestNQN]; !ok {
+		t.Fatal("orphan not reported in dry run")
+	}
+	// a volume of the subsystem is being staged
+	if err := addSubsystemUser(healthTestNQN, "vol1"); err != nil {
+		t.Fatal(err)
+	}
+	c.dryRun = false
+	step(time.Minute)
+	if _, ok := c.firstSeen[healthTestNQN]; ok {
+		t.Fatal("subsystem in use still an orphan")
+	}
+	if _, err := removeSubsystemUser(healthTestNQN, "vol1"); err != nil {
+		t.Fatal(err)
+	}
+	step(time.Minute)
+	step(10*time.Minute, healthTestNQN)
+}
+
+func TestOrphanCollectorStartup(t *testing.T) {
+	root := t.TempDir()
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: root}
+	nvmfUsersDir = t.TempDir()
+	t.Cleanup(func() {
+		fabrics = oldFabrics
+		nvmfUsersDir = "/var/lib/spdkcsi/nvmf-users"
+	})
+	fakePaths(t, root, "live")
+	mustMkdir(t, filepath.Join(root, "class", "nvme-subsystem", "nvme-subsys0", "nvme0n1"))
+
+	c := NewOrphanCollector(t.TempDir(), mount.NewFakeMounter(nil), 10*time.Minute, true)
+	if found, disconnected := c.CollectStartup(); found != 1 || len(disconnected) != 0 {
+		t.Fatalf("dry run: found %d, disconnected %v", found, disconnected)
+	}
+	c.dryRun = false
+	if found, disconnected := c.CollectStartup(); found != 1 || !reflect.DeepEqual(disconnected, []string{healthTestNQN}) {
+		t.Fatalf("found %d, disconnected %v, want %s without grace period", found, disconnected, healthTestNQN)
+	}
+}
@@ -0,0 +1,401 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+// HealthState is the path health of a connected subsystem
+type HealthState string
+
+const (
+	// HealthHealthy: all expected paths are live
+	HealthHealthy HealthState = "healthy"
+	// HealthDegraded: some paths are down or missing, at least one is live
+	HealthDegraded HealthState = "degraded"
+	// HealthReconnecting: a repair of the paths is in progress
+	HealthReconnecting HealthState = "reconnecting"
+	// HealthFailed: no path is live
+	HealthFailed HealthState = "failed"
+)
+
+const (
+	// pathSettleTime lets the kernel finish its own reconnect attempts
+	// before a changed subsystem is repaired
+	pathSettleTime = 5 * time.Second
+	// pathResyncInterval rescans sysfs in case uevents were missed
+	pathResyncInterval = 30 * time.Second
+	pathBackoffBase    = 5 * time.Second
+	pathBackoffMax     = 5 * time.Minute
+)
+
+// subsystemHealth is the state machine of one subsystem
+type subsystemHealth struct {
+	state HealthState
+	// expected is the number of paths the lvol should have
+	expected int
+	// paths is the path signature the state was derived from
+	paths string
+	// attempts counts the repairs since the paths last changed
+	attempts    int
+	nextAttempt time.Time
+}
+
+// PathHealthController watches the paths of all connected lvols and repairs
+// subsystems that lost paths. It reacts to kernel uevents and resyncs
+// periodically; the management API is only asked after the paths of a
+// subsystem changed, with an exponential backoff per subsystem while the
+// repair does not succeed.
+type PathHealthController struct {
+	mu         sync.Mutex
+	subsystems map[string]*subsystemHealth
+	trigger    chan struct{}
+
+	// replaced by tests
+	now    func() time.Time
+	repair func(subsys *nvme.Subsystem) (int, error)
+}
+
+// NewPathHealthController creates a path health controller
+func NewPathHealthController() *PathHealthController {
+	return &PathHealthController{
+		subsystems: make(map[string]*subsystemHealth),
+		trigger:    make(chan struct{}, 1),
+		now:        time.Now,
+		repair:     repairSubsystem,
+	}
+}
+
+// Run watches the paths until ctx is done
+func (c *PathHealthController) Run(ctx context.Context) {
+	go func() {
+		err := nvme.WatchUevents(ctx, func(*nvme.Uevent) { c.Trigger() })
+		if err != nil {
+			klog.Warningf("not watching nvme uevents, resyncing every %s only: %v", pathResyncInterval, err)
+		}
+	}()
+
+	for {
+		wait := c.sync()
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.trigger:
+			// uevents come in bursts, e.g. one per controller and namespace
+			time.Sleep(100 * time.Millisecond)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Trigger makes the controller resync
+func (c *PathHealthController) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// States returns the health state of every connected lvol subsystem by NQN
+func (c *PathHealthController) States() map[string]HealthState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make(map[string]HealthState, len(c.subsystems))
+	for nqn, h := range c.subsystems {
+		states[nqn] = h.state
+	}
+	return states
+}
+
+// pathWork is what a sync found to do for a subsystem, done without
+// holding the lock of the controller
+type pathWork struct {
+	// tune the new paths
+	tune bool
+	// repair the paths
+	repair bool
+}
+
+// sync updates the state of all subsystems, repairs those that are due and
+// returns when the next sync is needed
+func (c *PathHealthController) sync() time.Duration {
+	subsystems, err := fabrics.Subsystems()
+	if err != nil {
+		klog.Errorf("failed to list nvme subsystems: %v", err)
+		return pathBackoffBase
+	}
+
+	c.mu.Lock()
+	now := c.now()
+	wait := pathResyncInterval
+	seen := make(map[string]struct{}, len(subsystems))
+	work := make([]pathWork, len(subsystems))
+	for i := range subsystems {
+		subsys := &subsystems[i]
+		if _, lvolID := getLvolIDFromNQN(subsys.NQN); lvolID == "" {
+			continue
+		}
+		seen[subsys.NQN] = struct{}{}
+
+		next, w := c.syncSubsystem(subsys, now)
+		if next > 0 && next < wait {
+			wait = next
+		}
+		work[i] = w
+	}
+	for nqn := range c.subsystems {
+		if _, ok := seen[nqn]; !ok {
+			klog.Infof("subsystem %s disconnected, no longer watching its paths", nqn)
+			delete(c.subsystems, nqn)
+		}
+	}
+	c.mu.Unlock()
+
+	// repairs call the management API and connect paths, States must not
+	// wait for them
+	for i := range subsystems {
+		subsys := &subsystems[i]
+		if work[i].tune {
+			// new paths come with the default attributes
+			tuneSubsystem(subsys)
+		}
+		if work[i].repair {
+			expected, err := c.repair(subsys)
+			c.repaired(subsys, expected, err)
+		}
+	}
+	return wait
+}
+
+// syncSubsystem runs the state machine of a subsystem, returns when it
+// wants to be synced again, 0 if only on change, and the work to do
+func (c *PathHealthController) syncSubsystem(subsys *nvme.Subsystem, now time.Time) (time.Duration, pathWork) {
+	h, ok := c.subsystems[subsys.NQN]
+	if !ok {
+		h = &subsystemHealth{state: HealthHealthy, expected: len(subsys.Paths)}
+		if subsys.Serial == "ha" && h.expected < 2 {
+			h.expected = 2
+		}
+		c.subsystems[subsys.NQN] = h
+	}
+
+	var work pathWork
+	paths := pathSignature(subsys.Paths)
+	if paths != h.paths {
+		klog.Infof("paths of %s changed: [%s]", subsys.NQN, paths)
+		h.paths = paths
+		h.attempts = 0
+		h.nextAttempt = now.Add(pathSettleTime)
+		work.tune = true
+	}
+
+	observed := observedHealth(subsys, h.expected)
+	if observed == HealthHealthy {
+		c.setState(subsys.NQN, h, HealthHealthy)
+		return 0, work
+	}
+	if now.Before(h.nextAttempt) {
+		// a repair stays in progress until the paths change or it is retried
+		if h.attempts == 0 || observed == HealthFailed {
+			c.setState(subsys.NQN, h, observed)
+		}
+		return h.nextAttempt.Sub(now), work
+	}
+
+	c.setState(subsys.NQN, h, HealthReconnecting)
+	// the kernel reports a successful repair as a path change, anything
+	// else is retried with backoff
+	h.attempts++
+	backoff := pathBackoff(h.attempts)
+	h.nextAttempt = now.Add(backoff)
+	work.repair = true
+	return backoff, work
+}
+
+// repaired records the result of a repair of the subsystem
+func (c *PathHealthController) repaired(subsys *nvme.Subsystem, expected int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.subsystems[subsys.NQN]
+	if !ok {
+		return
+	}
+	if err != nil {
+		klog.Errorf("failed to repair paths of %s: %v", subsys.NQN, err)
+	} else if expected > 0 {
+		h.expected = expected
+	}
+	if observedHealth(subsys, h.expected) == HealthFailed {
+		c.setState(subsys.NQN, h, HealthFailed)
+	}
+}
+
+func (c *PathHealthController) setState(nqn string, h *subsystemHealth, state HealthState) {
+	if h.state != state {
+		klog.Infof("subsystem %s: %s -> %s", nqn, h.state, state)
+		h.state = state
+	}
+}
+
+// observedHealth derives the health of a subsystem from its paths
+func observedHealth(subsys *nvme.Subsystem, expected int) HealthState {
+	live := 0
+	for i := range subsys.Paths {
+		if subsys.Paths[i].Live() {
+			live++
+		}
+	}
+	switch {
+	case live == 0:
+		return HealthFailed
+	case live < expected || live < len(subsys.Paths):
+		return HealthDegraded
+	}
+	return HealthHealthy
+}
+
+func pathSignature(paths []nvme.Path) string {
+	parts := make([]string, 0, len(paths))
+	for _, p := range paths {
+		parts = append(parts, fmt.Sprintf("%s %s:%s %s/%s", p.Controller, p.TrAddr, p.TrSvcID, p.State, p.ANAState))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func pathBackoff(attempts int) time.Duration {
+	backoff := pathBackoffBase
+	for i := 1; i < attempts && backoff < pathBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > pathBackoffMax {
+		backoff = pathBackoffMax
+	}
+	return backoff
+}
+
+// repairSubsystem connects the paths of the lvol that the host is missing
+// and disconnects paths to targets no longer serving it, never the last live
+// path. It returns the number of paths the lvol should have.
+func repairSubsystem(subsys *nvme.Subsystem) (int, error) {
+	clusterID, lvolID := getLvolIDFromNQN(subsys.NQN)
+	backend, err := NewBackend(clusterID, RequestClassMonitor)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create SPDK client: %w", err)
+	}
+
+	connections, err := backend.LvolConnections(lvolID)
+	if err != nil {
+		return 0, err
+	}
+	online := make([]bool, len(connections))
+	nodeInfo, err := backend.LvolNodes(lvolID)
+	for i := range online {
+		// connections are listed in the order of the nodes of the lvol
+		online[i] = err != nil || len(nodeInfo.Nodes) != len(connections) || backend.IsNodeOnline(nodeInfo.Nodes[i])
+	}
+
+	// connect new paths over the transport of the existing ones if the
+	// management API does not tell
+	transport := TargetTypeNVMf
+	if len(subsys.Paths) > 0 && subsys.Paths[0].Transport != "" {
+		transport = subsys.Paths[0].Transport
+	}
+	for _, conn := range connections {
+		if conn.Transport == "" {
+			conn.Transport = transport
+		}
+		conn.Transport = resolveTransport(conn.Transport)
+	}
+
+	connect, disconnect := planRepair(subsys.Paths, connections, online)
+	var errs []error
+	for _, conn := range connect {
+		if err := connectViaNVMe(conn, ctrlLossTimeout(len(connections))); err != nil {
+			errs = append(errs, err)
+			// the stale paths may still be needed
+			disconnect = nil
+		}
+	}
+	for _, p := range disconnect {
+		if err := disconnectViaNVMe(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return len(connections), errors.Join(errs...)
+}
+
+// planRepair returns the connections of the lvol without a path on the host
+// and whose target is online, and the paths to targets that do not serve
+// the lvol anymore. A stale path is kept if it would leave the subsystem
+// without a live path, counting the new paths as live.
+func planRepair(paths []nvme.Path, connections []*LvolConnectResp, online []bool) (connect []*LvolConnectResp, disconnect []nvme.Path) {
+	existing := make(map[string]struct{}, len(paths))
+	live := 0
+	for i := range paths {
+		existing[pathKey(paths[i].Transport, paths[i].TrAddr, paths[i].TrSvcID)] = struct{}{}
+		if paths[i].Live() {
+			live++
+		}
+	}
+
+	wanted := make(map[string]struct{}, len(connections))
+	for i, conn := range connections {
+		transport := conn.Transport
+		if transport == "" {
+			transport = TargetTypeNVMf
+		}
+		key := pathKey(transport, conn.IP, strconv.Itoa(conn.Port))
+		wanted[key] = struct{}{}
+		if _, ok := existing[key]; ok {
+			continue
+		}
+		if !online[i] {
+			klog.Infof("target %s of %s is not online yet", key, conn.Nqn)
+			continue
+		}
+		connect = append(connect, conn)
+		live++
+	}
+
+	for i := range paths {
+		if _, ok := wanted[pathKey(paths[i].Transport, paths[i].TrAddr, paths[i].TrSvcID)]; ok {
+			continue
+		}
+		if paths[i].Live() {
+			if live <= 1 {
+				klog.Warningf("keeping path %s to a stale target, it is the last live path", paths[i].Controller)
+				continue
+			}
+			live--
+		} else if live == 0 {
+			continue
+		}
+		disconnect = append(disconnect, paths[i])
+	}
+	return connect, disconnect
+}
@@ -0,0 +1,233 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the path health state machine against a fake sysfs tree
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+const healthTestNQN = "nqn.2023-02.io.simplyblock:cluster1:lvol:lvol1"
+
+// fakePaths creates subsystem nvme-subsys0 of an HA volume with controller
+// nvme<i> in states[i]
+func fakePaths(t *testing.T, root string, states ...string) {
+	t.Helper()
+	subsys := filepath.Join(root, "class", "nvme-subsystem", "nvme-subsys0")
+	if err := os.RemoveAll(subsys); err != nil {
+		t.Fatal(err)
+	}
+	mustMkdir(t, subsys)
+	mustWrite(t, filepath.Join(subsys, "subsysnqn"), healthTestNQN)
+	mustWrite(t, filepath.Join(subsys, "serial"), "ha")
+	for i, state := range states {
+		ctrl := "nvme" + strconv.Itoa(i)
+		mustMkdir(t, filepath.Join(subsys, ctrl))
+		mustMkdir(t, filepath.Join(root, "class", "nvme", ctrl))
+		mustWrite(t, filepath.Join(root, "class", "nvme", ctrl, "address"), "traddr=10.0.0."+strconv.Itoa(i)+",trsvcid=4420")
+		mustWrite(t, filepath.Join(root, "class", "nvme", ctrl, "state"), state)
+	}
+}
+
+func TestPathHealthController(t *testing.T) {
+	root := t.TempDir()
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: root}
+	t.Cleanup(func() { fabrics = oldFabrics })
+
+	now := time.Unix(0, 0)
+	repairs := 0
+	c := NewPathHealthController()
+	c.now = func() time.Time { return now }
+	c.repair = func(*nvme.Subsystem) (int, error) {
+		repairs++
+		// the controller is not locked while repairing
+		states := make(chan map[string]HealthState, 1)
+		go func() { states <- c.States() }()
+		select {
+		case <-states:
+		case <-time.After(time.Second):
+			t.Error("States blocked by a repair")
+		}
+		return 2, nil
+	}
+
+	step := func(d time.Duration, wantState HealthState, wantRepairs int) {
+		t.Helper()
+		now = now.Add(d)
+		c.sync()
+		if state := c.States()[healthTestNQN]; state != wantState || repairs != wantRepairs {
+			t.Fatalf("at %s: state %s with %d repairs, want %s with %d", now.Sub(time.Unix(0, 0)), state, repairs, wantState, wantRepairs)
+		}
+	}
+
+	fakePaths(t, root, "live", "live")
+	step(0, HealthHealthy, 0)
+	step(time.Minute, HealthHealthy, 0)
+
+	// a path goes down, the kernel gets time to reconnect it first
+	fakePaths(t, root, "live", "connecting")
+	step(0, HealthDegraded, 0)
+	step(pathSettleTime, HealthReconnecting, 1)
+	// backoff before the next attempt, doubling per attempt
+	step(pathBackoffBase-time.Second, HealthReconnecting, 1)
+	step(time.Second, HealthReconnecting, 2)
+	step(pathBackoffBase, HealthReconnecting, 2)
+	step(pathBackoffBase, HealthReconnecting, 3)
+
+	// the repair worked
+	fakePaths(t, root, "live", "live")
+	step(0, HealthHealthy, 3)
+
+	// all paths down
+	fakePaths(t, root, "connecting")
+	step(0, HealthFailed, 3)
+	step(pathSettleTime, HealthFailed, 4)
+
+	// disconnected
+	fakePaths(t, root)
+	if err := os.RemoveAll(filepath.Join(root, "class", "nvme-subsystem")); err != nil {
+		t.Fatal(err)
+	}
+	c.sync()
+	if _, ok := c.States()[healthTestNQN]; ok {
+		t.Fatal("disconnected subsystem still watched")
+	}
+}
+
+func TestPathBackoff(t *testing.T) {
+	if b := pathBackoff(1); b != pathBackoffBase {
+		t.Errorf("first backoff %s", b)
+	}
+	if b := pathBackoff(3); b != 4*pathBackoffBase {
+		t.Errorf("third backoff %s", b)
+	}
+	if b := pathBackoff(100); b != pathBackoffMax {
+		t.Errorf("backoff not capped: %s", b)
+	}
+}
+
+func TestPlanRepair(t *testing.T) {
+	path := func(ctrl, addr, port, state string) nvme.Path {
+		return nvme.Path{Controller: ctrl, Transport: "tcp", TrAddr: addr, TrSvcID: port, State: state}
+	}
+	conn := func(addr string, port int) *LvolConnectResp {
+		return &LvolConnectResp{Nqn: healthTestNQN, IP: addr, Port: port}
+	}
+	rdma := func(addr string, port int) *LvolConnectResp {
+		return &LvolConnectResp{Nqn: healthTestNQN, IP: addr, Port: port, Transport: TargetTypeRDMA}
+	}
+	a, b, c := conn("10.0.0.1", 4420), conn("10.0.0.2", 4420), conn("10.0.0.3", 4420)
+
+	tests := []struct {
+		name           string
+		paths          []nvme.Path
+		connections    []*LvolConnectResp
+		online         []bool
+		wantConnect    []*LvolConnectResp
+		wantDisconnect []string
+	}{
+		{
+			name:        "restore all missing paths",
+			paths:       []nvme.Path{path("nvme0", "10.0.0.1", "4420", "live")},
+			connections: []*LvolConnectResp{a, b, c},
+			online:      []bool{true, true, true},
+			wantConnect: []*LvolConnectResp{b, c},
+		},
+		{
+			name:        "skip offline targets",
+			paths:       []nvme.Path{path("nvme0", "10.0.0.1", "4420", "live")},
+			connections: []*LvolConnectResp{a, b, c},
+			online:      []bool{true, false, true},
+			wantConnect: []*LvolConnectResp{c},
+		},
+		{
+			name:        "same address, other port",
+			paths:       []nvme.Path{path("nvme0", "10.0.0.1", "4420", "live")},
+			connections: []*LvolConnectResp{a, conn("10.0.0.1", 4421)},
+			online:      []bool{true, true},
+			wantConnect: []*LvolConnectResp{conn("10.0.0.1", 4421)},
+		},
+		{
+			name:           "move to the new target",
+			paths:          []nvme.Path{path("nvme0", "10.0.0.1", "4420", "connecting")},
+			connections:    []*LvolConnectResp{b},
+			online:         []bool{true},
+			wantConnect:    []*LvolConnectResp{b},
+			wantDisconnect: []string{"nvme0"},
+		},
+		{
+			name:        "keep the last live path",
+			paths:       []nvme.Path{path("nvme0", "10.0.0.1", "4420", "live")},
+			connections: []*LvolConnectResp{b},
+			online:      []bool{false},
+		},
+		{
+			name:           "move from tcp to rdma",
+			paths:          []nvme.Path{path("nvme0", "10.0.0.1", "4420", "live")},
+			connections:    []*LvolConnectResp{rdma("10.0.0.1", 4420)},
+			online:         []bool{true},
+			wantConnect:    []*LvolConnectResp{rdma("10.0.0.1", 4420)},
+			wantDisconnect: []string{"nvme0"},
+		},
+		{
+			name:           "drop stale paths next to a live one",
+			paths:          []nvme.Path{path("nvme0", "10.0.0.1", "4420", "live"), path("nvme1", "10.0.0.4", "4420", "live"), path("nvme2", "10.0.0.5", "4420", "connecting")},
+			connections:    []*LvolConnectResp{a},
+			online:         []bool{true},
+			wantDisconnect: []string{"nvme1", "nvme2"},
+		},
+	}
+	for _, tt := range tests {
+		connect, disconnect := planRepair(tt.paths, tt.connections, tt.online)
+		if !reflect.DeepEqual(connect, tt.wantConnect) {
+			t.Errorf("%s: connect %v, want %v", tt.name, connect, tt.wantConnect)
+		}
+		var controllers []string
+		for _, p := range disconnect {
+			controllers = append(controllers, p.Controller)
+		}
+		if !reflect.DeepEqual(controllers, tt.wantDisconnect) {
+			t.Errorf("%s: disconnect %v, want %v", tt.name, controllers, tt.wantDisconnect)
+		}
+	}
+}
+
+func TestResolveTransport(t *testing.T) {
+	root := t.TempDir()
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: root}
+	t.Cleanup(func() { fabrics = oldFabrics })
+
+	if transport := resolveTransport(""); transport != TargetTypeNVMf {
+		t.Errorf("default transport %s", transport)
+	}
+	if transport := resolveTransport("RDMA"); transport != TargetTypeNVMf {
+		t.Errorf("rdma without device resolved to %s", transport)
+	}
+	mustMkdir(t, filepath.Join(root, "class", "infiniband", "mlx5_0"))
+	if transport := resolveTransport("RDMA"); transport != TargetTypeRDMA {
+		t.Errorf("rdma with device resolved to %s", transport)
+	}
+}
@@ -0,0 +1,46 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+)
+
+// SetDeviceReadOnly sets or clears the read-only flag of a block device in
+// the kernel, as blockdev --setro does. Writes to a read-only device fail,
+// whatever opened it.
+func SetDeviceReadOnly(devicePath string, readOnly bool) error {
+	dev, err := os.Open(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", devicePath, err)
+	}
+	defer dev.Close()
+
+	flag := 0
+	if readOnly {
+		flag = 1
+	}
+	if err := unix.IoctlSetPointerInt(int(dev.Fd()), unix.BLKROSET, flag); err != nil {
+		return fmt.Errorf("failed to set read-only flag of %s to %d: %w", devicePath, flag, err)
+	}
+	klog.Infof("set read-only flag of %s to %d", devicePath, flag)
+	return nil
+}
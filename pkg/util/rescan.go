@@ -0,0 +1,120 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	cfgRescanTimeoutSeconds = 30
+	sectorSize              = 512
+)
+
+var nvmeControllerRe = regexp.MustCompile(`^nvme[0-9]+$`)
+
+// RescanDevice makes the kernel re-read the size of the NVMe namespace behind
+// devicePath and waits until it reaches minSize bytes. It returns the size of
+// the block device. Devices other than NVMe namespaces are not rescanned.
+func RescanDevice(devicePath string, minSize int64) (int64, error) {
+	return rescanDevice(devicePath, minSize, cfgRescanTimeoutSeconds*time.Second)
+}
+
+func rescanDevice(devicePath string, minSize int64, timeout time.Duration) (int64, error) {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve %s: %w", devicePath, err)
+	}
+	devName := filepath.Base(realPath)
+
+	if strings.HasPrefix(devName, "nvme") {
+		controllers, err := namespaceControllers(devName)
+		if err != nil {
+			return 0, err
+		}
+		for _, ctrl := range controllers {
+			rescanFile := filepath.Join(fabrics.SysfsRoot, "class", "nvme", ctrl, "rescan_controller")
+			klog.Infof("rescanning namespaces of controller %s for %s", ctrl, devName)
+			if err := os.WriteFile(rescanFile, []byte("1"), 0o200); err != nil {
+				return 0, fmt.Errorf("failed to rescan controller %s: %w", ctrl, err)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		size, err := blockDeviceSize(devName)
+		if err != nil {
+			return 0, err
+		}
+		if size >= minSize {
+			return size, nil
+		}
+		if time.Now().After(deadline) {
+			return size, fmt.Errorf("size of %s is %d bytes after rescan, expected at least %d", devName, size, minSize)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// namespaceControllers returns the controllers a namespace block device is
+// reachable through, all controllers of the subsystem for a multipath head
+func namespaceControllers(devName string) ([]string, error) {
+	parent, err := filepath.EvalSymlinks(filepath.Join(fabrics.SysfsRoot, "block", devName, "device"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find controller of %s: %w", devName, err)
+	}
+	if nvmeControllerRe.MatchString(filepath.Base(parent)) {
+		return []string{filepath.Base(parent)}, nil
+	}
+
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list controllers of %s: %w", devName, err)
+	}
+	var controllers []string
+	for _, entry := range entries {
+		if nvmeControllerRe.MatchString(entry.Name()) {
+			controllers = append(controllers, entry.Name())
+		}
+	}
+	if len(controllers) == 0 {
+		return nil, fmt.Errorf("no controller found for %s", devName)
+	}
+	return controllers, nil
+}
+
+// blockDeviceSize returns the size in bytes of a block device from sysfs
+func blockDeviceSize(devName string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(fabrics.SysfsRoot, "block", devName, "size"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read size of %s: %w", devName, err)
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size of %s: %w", devName, err)
+	}
+	return sectors * sectorSize, nil
+}
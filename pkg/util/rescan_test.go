@@ -0,0 +1,105 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the namespace rescan against a fake sysfs tree
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+// fakeSysfs creates block device nvme0n1, a multipath head of subsystem
+// nvme-subsys0 with controllers nvme0 and nvme1
+func fakeSysfs(t *testing.T, sizeBytes int64) (root, devicePath string) {
+	t.Helper()
+	root = t.TempDir()
+	subsys := filepath.Join(root, "devices", "virtual", "nvme-subsystem", "nvme-subsys0")
+	for _, ctrl := range []string{"nvme0", "nvme1"} {
+		mustMkdir(t, filepath.Join(subsys, ctrl))
+		mustMkdir(t, filepath.Join(root, "class", "nvme", ctrl))
+		mustWrite(t, filepath.Join(root, "class", "nvme", ctrl, "rescan_controller"), "")
+	}
+	mustMkdir(t, filepath.Join(subsys, "nvme0n1"))
+	mustMkdir(t, filepath.Join(root, "block", "nvme0n1"))
+	if err := os.Symlink(subsys, filepath.Join(root, "block", "nvme0n1", "device")); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, filepath.Join(root, "block", "nvme0n1", "size"), strconv.FormatInt(sizeBytes/sectorSize, 10))
+
+	devicePath = filepath.Join(t.TempDir(), "nvme0n1")
+	mustWrite(t, devicePath, "")
+
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: root}
+	t.Cleanup(func() { fabrics = oldFabrics })
+	return root, devicePath
+}
+
+func mustMkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustWrite(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRescanDeviceAllControllers(t *testing.T) {
+	root, devicePath := fakeSysfs(t, 2<<30)
+
+	size, err := rescanDevice(devicePath, 2<<30, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 2<<30 {
+		t.Fatalf("size %d, want %d", size, 2<<30)
+	}
+	for _, ctrl := range []string{"nvme0", "nvme1"} {
+		data, err := os.ReadFile(filepath.Join(root, "class", "nvme", ctrl, "rescan_controller"))
+		if err != nil || string(data) != "1" {
+			t.Errorf("controller %s not rescanned: %q %v", ctrl, data, err)
+		}
+	}
+}
+
+func TestRescanDeviceWaitsForSize(t *testing.T) {
+	root, devicePath := fakeSysfs(t, 1<<30)
+
+	if _, err := rescanDevice(devicePath, 2<<30, 300*time.Millisecond); err == nil {
+		t.Fatal("rescan should time out while the namespace did not grow")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		//nolint:errcheck // the rescan below times out if the write failed
+		os.WriteFile(filepath.Join(root, "block", "nvme0n1", "size"), []byte(strconv.Itoa(2<<30/sectorSize)), 0o600)
+	}()
+	size, err := rescanDevice(devicePath, 2<<30, 5*time.Second)
+	if err != nil || size != 2<<30 {
+		t.Fatalf("rescan returned %d, %v", size, err)
+	}
+}
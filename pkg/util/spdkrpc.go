@@ -0,0 +1,724 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	spdkDefaultTargetPort = 4420
+	spdkTransport         = "tcp"
+	spdkSerialNumber      = "single"
+	spdkNQNPrefix         = "nqn.2023-02.io.simplyblock"
+
+	// connection parameters passed to the node, the SPDK target has no
+	// opinion about them
+	spdkReconnectDelay = 2
+	spdkCtrlLossTmo    = 600
+	spdkNrIoQueues     = 4
+)
+
+var errSPDKNoCachingNodes = errors.New("caching nodes are not supported by the SPDK backend")
+
+// NodeSPDK manages a standalone SPDK NVMe-oF target through its JSON-RPC socket.
+// Volumes are lvols in the target's lvstores, each exported by its own
+// subsystem nqn.2023-02.io.simplyblock:<clusterID>:lvol:<lvolID>.
+type NodeSPDK struct {
+	clusterID     string
+	rpc           *spdkRPCClient
+	targetAddress string
+	targetPort    int
+}
+
+type spdkRPCClient struct {
+	network string
+	address string
+	timeout time.Duration
+	lastID  int64
+}
+
+type spdkRPCRequest struct {
+	Version string      `json:"jsonrpc"`
+	ID      int64       `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type spdkRPCResponse struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// spdkBDev is an entry of bdev_get_bdevs
+type spdkBDev struct {
+	Name           string   `json:"name"`
+	UUID           string   `json:"uuid"`
+	Aliases        []string `json:"aliases"`
+	BlockSize      int64    `json:"block_size"`
+	NumBlocks      int64    `json:"num_blocks"`
+	DriverSpecific struct {
+		Lvol *struct {
+			LvolStoreUUID string `json:"lvol_store_uuid"`
+			Snapshot      bool   `json:"snapshot"`
+			Clone         bool   `json:"clone"`
+			BaseSnapshot  string `json:"base_snapshot"`
+			// Clones of a snapshot, the lvol it was taken from first
+			Clones []string `json:"clones"`
+		} `json:"lvol"`
+	} `json:"driver_specific"`
+}
+
+func (bdev *spdkBDev) size() int64 {
+	return bdev.BlockSize * bdev.NumBlocks
+}
+
+// alias returns the lvstore and lvol name of an lvol bdev
+func (bdev *spdkBDev) alias() (lvsName, lvolName string) {
+	if len(bdev.Aliases) == 0 {
+		return "", bdev.Name
+	}
+	lvsName, lvolName, _ = strings.Cut(bdev.Aliases[0], "/")
+	return lvsName, lvolName
+}
+
+type spdkListenAddress struct {
+	TrType  string `json:"trtype"`
+	AdrFam  string `json:"adrfam"`
+	TrAddr  string `json:"traddr"`
+	TrSvcID string `json:"trsvcid"`
+}
+
+// spdkSubsystem is an entry of nvmf_get_subsystems
+type spdkSubsystem struct {
+	NQN             string              `json:"nqn"`
+	ListenAddresses []spdkListenAddress `json:"listen_addresses"`
+	Namespaces      []struct {
+		NSID     int    `json:"nsid"`
+		BDevName string `json:"bdev_name"`
+	} `json:"namespaces"`
+	Hosts []struct {
+		NQN string `json:"nqn"`
+	} `json:"hosts"`
+}
+
+func newSPDKNode(clusterConfig *ClusterConfig) (*NodeSPDK, error) {
+	network, address, err := parseRPCAddress(clusterConfig.RPCAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster configuration for clusterID %s: %w", clusterConfig.ClusterID, err)
+	}
+	if clusterConfig.TargetAddress == "" {
+		return nil, fmt.Errorf("invalid cluster configuration for clusterID %s: missing target_address", clusterConfig.ClusterID)
+	}
+	port := clusterConfig.TargetPort
+	if port == 0 {
+		port = spdkDefaultTargetPort
+	}
+
+	klog.Infof("SPDK client created for ClusterID:%s, RPC:%s, Target:%s:%d",
+		clusterConfig.ClusterID, clusterConfig.RPCAddress, clusterConfig.TargetAddress, port)
+	return &NodeSPDK{
+		clusterID: clusterConfig.ClusterID,
+		rpc: &spdkRPCClient{
+			network: network,
+			address: address,
+			timeout: cfgRPCTimeoutSeconds * time.Second,
+		},
+		targetAddress: clusterConfig.TargetAddress,
+		targetPort:    port,
+	}, nil
+}
+
+// parseRPCAddress splits unix:///path or tcp://host:port into network and address
+func parseRPCAddress(rpcAddress string) (network, address string, err error) {
+	network, address, ok := strings.Cut(rpcAddress, "://")
+	if !ok || address == "" || (network != "unix" && network != "tcp") {
+		return "", "", fmt.Errorf("rpc_address %q is not unix:///path or tcp://host:port", rpcAddress)
+	}
+	return network, address, nil
+}
+
+// call sends one JSON-RPC request and decodes the result into result, if not nil
+func (client *spdkRPCClient) call(method string, params, result interface{}) error {
+	conn, err := net.DialTimeout(client.network, client.address, client.timeout)
+	if err != nil {
+		return fmt.Errorf("spdk rpc %s: %w", method, err)
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(client.timeout)); err != nil {
+		return fmt.Errorf("spdk rpc %s: %w", method, err)
+	}
+
+	req := spdkRPCRequest{
+		Version: "2.0",
+		ID:      atomic.AddInt64(&client.lastID, 1),
+		Method:  method,
+		Params:  params,
+	}
+	klog.V(5).Infof("Calling SPDK RPC %s://%s: Method: %s: Params: %v", client.network, client.address, method, params)
+	if err = json.NewEncoder(conn).Encode(&req); err != nil {
+		return fmt.Errorf("spdk rpc %s: %w", method, err)
+	}
+
+	var resp spdkRPCResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("spdk rpc %s: %w", method, err)
+	}
+	if resp.ID != req.ID {
+		return fmt.Errorf("spdk rpc %s: response id %d does not match request id %d", method, resp.ID, req.ID)
+	}
+	if resp.Error != nil {
+		return spdkError(method, resp.Error)
+	}
+	if result != nil {
+		if err = json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("spdk rpc %s: failed to decode result: %w", method, err)
+		}
+	}
+	return nil
+}
+
+// spdkError maps errno codes of the target to the errors the controller knows
+func spdkError(method string, rpcErr *Error) error {
+	err := fmt.Errorf("spdk rpc %s: %s (code %d)", method, rpcErr.Message, rpcErr.Code)
+	switch {
+	case rpcErr.Code == -int(syscall.ENOSPC) || errorMatches(err, ErrJSONNoSpaceLeft):
+		return fmt.Errorf("%w: %w", ErrJSONNoSpaceLeft, err)
+	case rpcErr.Code == -int(syscall.ENODEV) || errorMatches(err, ErrJSONNoSuchDevice):
+		return fmt.Errorf("%w: %w", ErrJSONNoSuchDevice, err)
+	}
+	return err
+}
+
+func (node *NodeSPDK) nqn(lvolID string) string {
+	return fmt.Sprintf("%s:%s:lvol:%s", spdkNQNPrefix, node.clusterID, lvolID)
+}
+
+func (node *NodeSPDK) getBDev(name string) (*spdkBDev, error) {
+	var bdevs []spdkBDev
+	err := node.rpc.call("bdev_get_bdevs", map[string]string{"name": name}, &bdevs)
+	if err != nil {
+		return nil, err
+	}
+	if len(bdevs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrJSONNoSuchDevice, name)
+	}
+	return &bdevs[0], nil
+}
+
+// lvolBDevs returns all lvol bdevs, snapshots included
+func (node *NodeSPDK) lvolBDevs() ([]spdkBDev, error) {
+	var bdevs []spdkBDev
+	err := node.rpc.call("bdev_get_bdevs", nil, &bdevs)
+	if err != nil {
+		return nil, err
+	}
+	lvols := bdevs[:0]
+	for i := range bdevs {
+		if bdevs[i].DriverSpecific.Lvol != nil {
+			lvols = append(lvols, bdevs[i])
+		}
+	}
+	return lvols, nil
+}
+
+func (node *NodeSPDK) getSubsystem(lvolID string) (*spdkSubsystem, error) {
+	var subsystems []spdkSubsystem
+	err := node.rpc.call("nvmf_get_subsystems", nil, &subsystems)
+	if err != nil {
+		return nil, err
+	}
+	nqn := node.nqn(lvolID)
+	for i := range subsystems {
+		if subsystems[i].NQN == nqn {
+			return &subsystems[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// ensureTransport creates the TCP transport if the target has none yet
+func (node *NodeSPDK) ensureTransport() error {
+	var transports []struct {
+		TrType string `json:"trtype"`
+	}
+	err := node.rpc.call("nvmf_get_transports", nil, &transports)
+	if err != nil {
+		return err
+	}
+	for _, t := range transports {
+		if strings.EqualFold(t.TrType, spdkTransport) {
+			return nil
+		}
+	}
+	return node.rpc.call("nvmf_create_transport", map[string]string{"trtype": strings.ToUpper(spdkTransport)}, nil)
+}
+
+// ClusterID returns the ID of the cluster the client talks to
+func (node *NodeSPDK) ClusterID() string {
+	return node.clusterID
+}
+
+func (node *NodeSPDK) Info() string {
+	return fmt.Sprintf("%s (spdk %s://%s)", node.clusterID, node.rpc.network, node.rpc.address)
+}
+
+func (node *NodeSPDK) LvStores() ([]LvStore, error) {
+	var result []CSIPoolsResp
+	err := node.rpc.call("bdev_lvol_get_lvstores", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	lvs := make([]LvStore, len(result))
+	for i := range result {
+		r := &result[i]
+		lvs[i].Name = r.Name
+		lvs[i].UUID = r.UUID
+		lvs[i].TotalSizeMiB = r.TotalClusters * r.ClusterSize / 1024 / 1024
+		lvs[i].FreeSizeMiB = r.FreeClusters * r.ClusterSize / 1024 / 1024
+	}
+	return lvs, nil
+}
+
+// VolumeInfo returns the same volume context as the SimplyBlock backend
+func (node *NodeSPDK) VolumeInfo(lvolID string) (map[string]string, error) {
+	connections, err := node.LvolConnections(lvolID)
+	if err != nil {
+		return nil, err
+	}
+	conn := connections[0]
+	connectionsData, err := json.Marshal([]connectionInfo{{IP: conn.IP, Port: conn.Port}})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"name":           lvolID,
+		"uuid":           lvolID,
+		"nqn":            conn.Nqn,
+		"reconnectDelay": strconv.Itoa(conn.ReconnectDelay),
+		"nrIoQueues":     strconv.Itoa(conn.NrIoQueues),
+		"ctrlLossTmo":    strconv.Itoa(conn.CtrlLossTmo),
+		"model":          lvolID,
+		"targetType":     spdkTransport,
+		"connections":    string(connectionsData),
+		"nsId":           strconv.Itoa(conn.NSID),
+		// namespaces get the UUID of their bdev
+		"nsUuid": lvolID,
+	}, nil
+}
+
+// CreateVolume creates a thin provisioned lvol and returns its UUID.
+// Compression and encryption are features of the SimplyBlock cluster.
+func (node *NodeSPDK) CreateVolume(params *CreateLVolData) (string, error) {
+	if params.Compression || params.Encryption {
+		return "", errors.New("compression and encryption are not supported by the SPDK backend")
+	}
+	sizeMiB, err := parseSizeMiB(params.Size)
+	if err != nil {
+		return "", err
+	}
+
+	var lvolID string
+	err = node.rpc.call("bdev_lvol_create", map[string]interface{}{
+		"lvol_name":      params.LvolName,
+		"size_in_mib":    sizeMiB,
+		"lvs_name":       params.LvsName,
+		"thin_provision": true,
+	}, &lvolID)
+	if err != nil {
+		return "", err
+	}
+
+	if err = node.setQoS(lvolID, params); err != nil {
+		node.DeleteVolume(lvolID) //nolint:errcheck // we can do little
+		return "", err
+	}
+	klog.V(5).Infof("volume created: %s", lvolID)
+	return lvolID, nil
+}
+
+// setQoS applies the qos_* StorageClass parameters with bdev_set_qos_limit
+func (node *NodeSPDK) setQoS(lvolID string, params *CreateLVolData) error {
+	limits := map[string]interface{}{"name": lvolID}
+	for key, value := range map[string]string{
+		"rw_ios_per_sec":    params.MaxRWIOPS,
+		"rw_mbytes_per_sec": params.MaxRWmBytes,
+		"r_mbytes_per_sec":  params.MaxRmBytes,
+		"w_mbytes_per_sec":  params.MaxWmBytes,
+	} {
+		if value == "" || value == "0" {
+			continue
+		}
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid qos limit %s=%q: %w", key, value, err)
+		}
+		limits[key] = limit
+	}
+	if len(limits) == 1 {
+		return nil
+	}
+	return node.rpc.call("bdev_set_qos_limit", limits, nil)
+}
+
+// GetVolume returns the UUID of the lvol poolName/lvolName
+func (node *NodeSPDK) GetVolume(lvolName, poolName string) (string, error) {
+	bdev, err := node.getBDev(fmt.Sprintf("%s/%s", poolName, lvolName))
+	if err != nil {
+		return "", err
+	}
+	return bdev.UUID, nil
+}
+
+func (node *NodeSPDK) GetVolumeSize(lvolID string) (string, error) {
+	bdev, err := node.getBDev(lvolID)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(bdev.size(), 10), nil
+}
+
+func (node *NodeSPDK) ListVolumes() ([]*BDev, error) {
+	bdevs, err := node.lvolBDevs()
+	if err != nil {
+		return nil, err
+	}
+	var volumes []*BDev
+	for i := range bdevs {
+		if bdevs[i].DriverSpecific.Lvol.Snapshot {
+			continue
+		}
+		_, name := bdevs[i].alias()
+		volumes = append(volumes, &BDev{Name: name, UUID: bdevs[i].UUID, LvolSize: bdevs[i].size()})
+	}
+	return volumes, nil
+}
+
+func (node *NodeSPDK) ResizeVolume(lvolID string, newSize int64) (bool, error) {
+	err := node.rpc.call("bdev_lvol_resize", map[string]interface{}{
+		"name":        lvolID,
+		"size_in_mib": ToMiB(newSize),
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (node *NodeSPDK) DeleteVolume(lvolID string) error {
+	err := node.rpc.call("bdev_lvol_delete", map[string]string{"name": lvolID}, nil)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("volume deleted: %s", lvolID)
+	return nil
+}
+
+// PublishVolume exports the lvol through its own subsystem, steps already
+// done by an earlier request are skipped. Only hosts added by AllowHost may
+// connect to it.
+func (node *NodeSPDK) PublishVolume(lvolID string) error {
+	if err := node.ensureTransport(); err != nil {
+		return err
+	}
+	subsystem, err := node.getSubsystem(lvolID)
+	if err != nil {
+		return err
+	}
+	nqn := node.nqn(lvolID)
+
+	if subsystem == nil {
+		err = node.rpc.call("nvmf_create_subsystem", map[string]interface{}{
+			"nqn":            nqn,
+			"serial_number":  spdkSerialNumber,
+			"model_number":   lvolID,
+			"allow_any_host": false,
+		}, nil)
+		if err != nil {
+			return err
+		}
+		subsystem = &spdkSubsystem{NQN: nqn}
+	}
+
+	if len(subsystem.Namespaces) == 0 {
+		err = node.rpc.call("nvmf_subsystem_add_ns", map[string]interface{}{
+			"nqn":       nqn,
+			"namespace": map[string]string{"bdev_name": lvolID},
+		}, nil)
+		if err != nil {
+			node.UnpublishVolume(lvolID) //nolint:errcheck // we can do little
+			return err
+		}
+	}
+
+	if len(subsystem.ListenAddresses) == 0 {
+		err = node.rpc.call("nvmf_subsystem_add_listener", map[string]interface{}{
+			"nqn": nqn,
+			"listen_address": spdkListenAddress{
+				TrType:  strings.ToUpper(spdkTransport),
+				AdrFam:  "ipv4",
+				TrAddr:  node.targetAddress,
+				TrSvcID: strconv.Itoa(node.targetPort),
+			},
+		}, nil)
+		if err != nil {
+			node.UnpublishVolume(lvolID) //nolint:errcheck // we can do little
+			return err
+		}
+	}
+
+	klog.V(5).Infof("volume published: %s", lvolID)
+	return nil
+}
+
+// AllowHost lets the host connect to the subsystem of the lvol
+func (node *NodeSPDK) AllowHost(lvolID, hostNQN string) error {
+	subsystem, err := node.getSubsystem(lvolID)
+	if err != nil {
+		return err
+	}
+	if subsystem == nil {
+		return fmt.Errorf("%w: subsystem of %s", ErrJSONNoSuchDevice, lvolID)
+	}
+	for _, host := range subsystem.Hosts {
+		if host.NQN == hostNQN {
+			return nil
+		}
+	}
+	err = node.rpc.call("nvmf_subsystem_add_host", map[string]string{
+		"nqn":  subsystem.NQN,
+		"host": hostNQN,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("host %s allowed to connect to %s", hostNQN, lvolID)
+	return nil
+}
+
+// DisallowHost removes the host from the subsystem of the lvol
+func (node *NodeSPDK) DisallowHost(lvolID, hostNQN string) error {
+	subsystem, err := node.getSubsystem(lvolID)
+	if err != nil || subsystem == nil {
+		return err
+	}
+	for _, host := range subsystem.Hosts {
+		if host.NQN == hostNQN {
+			return node.rpc.call("nvmf_subsystem_remove_host", map[string]string{
+				"nqn":  subsystem.NQN,
+				"host": hostNQN,
+			}, nil)
+		}
+	}
+	return nil
+}
+
+func (node *NodeSPDK) UnpublishVolume(lvolID string) error {
+	subsystem, err := node.getSubsystem(lvolID)
+	if err != nil {
+		return err
+	}
+	if subsystem == nil {
+		return ErrVolumeUnpublished
+	}
+	err = node.rpc.call("nvmf_delete_subsystem", map[string]string{"nqn": subsystem.NQN}, nil)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("volume unpublished: %s", lvolID)
+	return nil
+}
+
+// CreateSnapshot creates a snapshot of a volume, the ID is prefixed with the cluster ID
+func (node *NodeSPDK) CreateSnapshot(lvolID, snapshotName string) (string, error) {
+	var snapshotID string
+	err := node.rpc.call("bdev_lvol_snapshot", map[string]string{
+		"lvol_name":     lvolID,
+		"snapshot_name": snapshotName,
+	}, &snapshotID)
+	if err != nil {
+		return "", err
+	}
+	snapshotID = fmt.Sprintf("%s:%s", node.clusterID, snapshotID)
+	klog.V(5).Infof("snapshot created: %s", snapshotID)
+	return snapshotID, nil
+}
+
+// ListSnapshots returns snapshot lvols. The source is the first clone of
+// the snapshot, SPDK makes the lvol a snapshot was taken from its first
+// clone; it is unknown once that lvol is deleted.
+func (node *NodeSPDK) ListSnapshots() ([]*SnapshotResp, error) {
+	bdevs, err := node.lvolBDevs()
+	if err != nil {
+		return nil, err
+	}
+
+	// clones are listed by lvol name, unique within their lvstore
+	lvols := make(map[string]*spdkBDev)
+	for i := range bdevs {
+		_, name := bdevs[i].alias()
+		lvols[bdevs[i].DriverSpecific.Lvol.LvolStoreUUID+"/"+name] = &bdevs[i]
+	}
+
+	var snapshots []*SnapshotResp
+	for i := range bdevs {
+		bdev := &bdevs[i]
+		if !bdev.DriverSpecific.Lvol.Snapshot {
+			continue
+		}
+		poolName, name := bdev.alias()
+		snapshot := &SnapshotResp{
+			Name:      name,
+			UUID:      bdev.UUID,
+			Size:      bdev.size(),
+			PoolName:  poolName,
+			PoolID:    bdev.DriverSpecific.Lvol.LvolStoreUUID,
+			CreatedAt: "0", // SPDK does not record it
+		}
+		if clones := bdev.DriverSpecific.Lvol.Clones; len(clones) > 0 {
+			source := lvols[bdev.DriverSpecific.Lvol.LvolStoreUUID+"/"+clones[0]]
+			if source != nil && source.DriverSpecific.Lvol.BaseSnapshot == name {
+				snapshot.SourceVolume.UUID = source.UUID
+			}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// CloneSnapshot clones a snapshot and grows the clone to newSize if larger
+func (node *NodeSPDK) CloneSnapshot(snapshotID, cloneName, newSize, _ string) (string, error) {
+	var lvolID string
+	err := node.rpc.call("bdev_lvol_clone", map[string]string{
+		"snapshot_name": snapshotID,
+		"clone_name":    cloneName,
+	}, &lvolID)
+	if err != nil {
+		return "", err
+	}
+
+	if newSize != "" {
+		sizeMiB, err := parseSizeMiB(newSize)
+		if err != nil {
+			return "", err
+		}
+		bdev, err := node.getBDev(lvolID)
+		if err != nil {
+			return "", err
+		}
+		if sizeMiB > ToMiB(bdev.size()) {
+			if _, err = node.ResizeVolume(lvolID, sizeMiB*1024*1024); err != nil {
+				return "", err
+			}
+		}
+	}
+	klog.V(5).Infof("snapshot cloned: %s", lvolID)
+	return lvolID, nil
+}
+
+func (node *NodeSPDK) DeleteSnapshot(snapshotID string) error {
+	err := node.rpc.call("bdev_lvol_delete", map[string]string{"name": snapshotID}, nil)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("snapshot deleted: %s", snapshotID)
+	return nil
+}
+
+// LvolNodes returns the target itself, a standalone target is a single node
+func (node *NodeSPDK) LvolNodes(_ string) (*NodeInfo, error) {
+	return &NodeInfo{NodeID: node.clusterID, Nodes: []string{node.clusterID}}, nil
+}
+
+// IsNodeOnline returns whether the target answers RPCs
+func (node *NodeSPDK) IsNodeOnline(_ string) bool {
+	err := node.rpc.call("spdk_get_version", nil, nil)
+	if err != nil {
+		klog.Errorf("failed to reach SPDK target of cluster %s: %v", node.clusterID, err)
+		return false
+	}
+	return true
+}
+
+func (node *NodeSPDK) LvolConnections(lvolID string) ([]*LvolConnectResp, error) {
+	subsystem, err := node.getSubsystem(lvolID)
+	if err != nil {
+		return nil, err
+	}
+	if subsystem == nil {
+		return nil, fmt.Errorf("%w: subsystem of %s", ErrJSONNoSuchDevice, lvolID)
+	}
+
+	nsid := 1
+	for _, ns := range subsystem.Namespaces {
+		if ns.BDevName == lvolID {
+			nsid = ns.NSID
+		}
+	}
+	return []*LvolConnectResp{{
+		Nqn:            subsystem.NQN,
+		ReconnectDelay: spdkReconnectDelay,
+		NrIoQueues:     spdkNrIoQueues,
+		CtrlLossTmo:    spdkCtrlLossTmo,
+		Port:           node.targetPort,
+		IP:             node.targetAddress,
+		NSID:           nsid,
+	}}, nil
+}
+
+func (node *NodeSPDK) CachingNodes() ([]*CachingNode, error) {
+	return nil, errSPDKNoCachingNodes
+}
+
+func (node *NodeSPDK) ConnectCachingNode(_, _ string) error {
+	return errSPDKNoCachingNodes
+}
+
+func (node *NodeSPDK) DisconnectCachingNode(_, _ string) error {
+	return errSPDKNoCachingNodes
+}
+
+// parseSizeMiB parses sizes like "1024M", "10G" or plain bytes into MiB
+func parseSizeMiB(size string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	multiplier := int64(1)
+	number := strings.ToUpper(strings.TrimSpace(size))
+	if n := len(number); n > 0 {
+		if m, ok := units[number[n-1:]]; ok {
+			multiplier = m
+			number = number[:n-1]
+		}
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return ToMiB(value * multiplier), nil
+}
@@ -0,0 +1,351 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the SPDK JSON-RPC backend against a scripted target
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type rpcHandler func(params json.RawMessage) (interface{}, *Error)
+
+// scriptedSPDK answers JSON-RPC requests on a unix socket with the handler
+// registered for the method and records the calls it got
+type scriptedSPDK struct {
+	mtx      sync.Mutex
+	handlers map[string]rpcHandler
+	calls    []string
+	params   map[string]json.RawMessage
+}
+
+func newScriptedSPDK(t *testing.T, handlers map[string]rpcHandler) (*scriptedSPDK, *NodeSPDK) {
+	t.Helper()
+	target := &scriptedSPDK{handlers: handlers, params: make(map[string]json.RawMessage)}
+	socket := filepath.Join(t.TempDir(), "spdk.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go target.serve(listener)
+
+	node, err := newSPDKNode(&ClusterConfig{
+		ClusterID:     "spdk-cluster",
+		Backend:       BackendSPDK,
+		RPCAddress:    "unix://" + socket,
+		TargetAddress: "192.168.0.10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target, node
+}
+
+func (target *scriptedSPDK) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		var req struct {
+			ID     int64           `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(conn).Decode(&req); err == nil {
+			target.mtx.Lock()
+			target.calls = append(target.calls, req.Method)
+			target.params[req.Method] = req.Params
+			handler, ok := target.handlers[req.Method]
+			target.mtx.Unlock()
+
+			resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+			if !ok {
+				resp["error"] = Error{Code: -32601, Message: "Method not found"}
+			} else if result, rpcErr := handler(req.Params); rpcErr != nil {
+				resp["error"] = rpcErr
+			} else {
+				resp["result"] = result
+			}
+			json.NewEncoder(conn).Encode(resp) //nolint:errcheck // client reports broken responses
+		}
+		conn.Close()
+	}
+}
+
+func (target *scriptedSPDK) param(t *testing.T, method string) map[string]interface{} {
+	t.Helper()
+	target.mtx.Lock()
+	defer target.mtx.Unlock()
+	var params map[string]interface{}
+	if err := json.Unmarshal(target.params[method], &params); err != nil {
+		t.Fatalf("%s not called with params: %v", method, err)
+	}
+	return params
+}
+
+func result(value interface{}) rpcHandler {
+	return func(json.RawMessage) (interface{}, *Error) { return value, nil }
+}
+
+func TestSPDKCreateVolume(t *testing.T) {
+	target, node := newScriptedSPDK(t, map[string]rpcHandler{
+		"bdev_lvol_create":   result("lvol-uuid"),
+		"bdev_set_qos_limit": result(true),
+	})
+
+	lvolID, err := node.CreateVolume(&CreateLVolData{LvolName: "pvc-1", Size: "2G", LvsName: "lvs0", MaxRWIOPS: "1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lvolID != "lvol-uuid" {
+		t.Fatalf("got lvol %s", lvolID)
+	}
+	params := target.param(t, "bdev_lvol_create")
+	if params["lvol_name"] != "pvc-1" || params["lvs_name"] != "lvs0" || params["size_in_mib"] != float64(2048) {
+		t.Fatalf("unexpected bdev_lvol_create params %v", params)
+	}
+	if qos := target.param(t, "bdev_set_qos_limit"); qos["rw_ios_per_sec"] != float64(1000) || qos["name"] != "lvol-uuid" {
+		t.Fatalf("unexpected bdev_set_qos_limit params %v", qos)
+	}
+}
+
+func TestSPDKErrors(t *testing.T) {
+	_, node := newScriptedSPDK(t, map[string]rpcHandler{
+		"bdev_lvol_create": func(json.RawMessage) (interface{}, *Error) {
+			return nil, &Error{Code: -28, Message: "No space left on device"}
+		},
+		"bdev_lvol_delete": func(json.RawMessage) (interface{}, *Error) {
+			return nil, &Error{Code: -19, Message: "No such device"}
+		},
+		"nvmf_get_subsystems": result([]spdkSubsystem{}),
+	})
+
+	_, err := node.CreateVolume(&CreateLVolData{LvolName: "pvc-1", Size: "1G", LvsName: "lvs0"})
+	if !errors.Is(err, ErrJSONNoSpaceLeft) {
+		t.Fatalf("expected ErrJSONNoSpaceLeft, got %v", err)
+	}
+	if err = node.DeleteVolume("lvol-uuid"); !errors.Is(err, ErrJSONNoSuchDevice) {
+		t.Fatalf("expected ErrJSONNoSuchDevice, got %v", err)
+	}
+	if err = node.UnpublishVolume("lvol-uuid"); !errors.Is(err, ErrVolumeUnpublished) {
+		t.Fatalf("expected ErrVolumeUnpublished, got %v", err)
+	}
+}
+
+func TestSPDKPublishVolume(t *testing.T) {
+	var mtx sync.Mutex
+	var subsystems []spdkSubsystem
+	target, node := newScriptedSPDK(t, map[string]rpcHandler{
+		"nvmf_get_transports":   result([]interface{}{}),
+		"nvmf_create_transport": result(true),
+		"nvmf_get_subsystems": func(json.RawMessage) (interface{}, *Error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return subsystems, nil
+		},
+		"nvmf_create_subsystem": func(params json.RawMessage) (interface{}, *Error) {
+			var s spdkSubsystem
+			json.Unmarshal(params, &s) //nolint:errcheck // checked by the test below
+			mtx.Lock()
+			defer mtx.Unlock()
+			subsystems = append(subsystems, s)
+			return true, nil
+		},
+		"nvmf_subsystem_add_ns": func(json.RawMessage) (interface{}, *Error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			subsystems[0].Namespaces = append(subsystems[0].Namespaces, struct {
+				NSID     int    `json:"nsid"`
+				BDevName string `json:"bdev_name"`
+			}{1, "lvol-uuid"})
+			return 1, nil
+		},
+		"nvmf_subsystem_add_listener": func(json.RawMessage) (interface{}, *Error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			subsystems[0].ListenAddresses = append(subsystems[0].ListenAddresses, spdkListenAddress{TrType: "TCP", TrAddr: "192.168.0.10", TrSvcID: "4420"})
+			return true, nil
+		},
+	})
+
+	if err := node.PublishVolume("lvol-uuid"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"nvmf_get_transports", "nvmf_create_transport", "nvmf_get_subsystems",
+		"nvmf_create_subsystem", "nvmf_subsystem_add_ns", "nvmf_subsystem_add_listener"}
+	if !reflect.DeepEqual(target.calls, want) {
+		t.Fatalf("calls %v, want %v", target.calls, want)
+	}
+	params := target.param(t, "nvmf_create_subsystem")
+	if params["nqn"] != "nqn.2023-02.io.simplyblock:spdk-cluster:lvol:lvol-uuid" ||
+		params["model_number"] != "lvol-uuid" || params["serial_number"] != "single" || params["allow_any_host"] != false {
+		t.Fatalf("unexpected nvmf_create_subsystem params %v", params)
+	}
+
+	// publishing again only looks up the existing subsystem
+	target.calls = nil
+	if err := node.PublishVolume("lvol-uuid"); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.calls) != 3 {
+		t.Fatalf("republish called %v", target.calls)
+	}
+
+	info, err := node.VolumeInfo("lvol-uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterID, lvolID := getLvolIDFromNQN(info["nqn"])
+	if clusterID != "spdk-cluster" || lvolID != "lvol-uuid" || info["model"] != "lvol-uuid" || info["nsId"] != "1" ||
+		info["connections"] != `[{"ip":"192.168.0.10","port":4420}]` {
+		t.Fatalf("unexpected volume info %v", info)
+	}
+}
+
+func TestSPDKAllowHost(t *testing.T) {
+	const hostNQN = "nqn.2014-08.org.nvmexpress:uuid:host1"
+	var mtx sync.Mutex
+	subsystem := spdkSubsystem{NQN: "nqn.2023-02.io.simplyblock:spdk-cluster:lvol:lvol-uuid"}
+	target, node := newScriptedSPDK(t, map[string]rpcHandler{
+		"nvmf_get_subsystems": func(json.RawMessage) (interface{}, *Error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return []spdkSubsystem{subsystem}, nil
+		},
+		"nvmf_subsystem_add_host": func(params json.RawMessage) (interface{}, *Error) {
+			var p struct {
+				Host string `json:"host"`
+			}
+			json.Unmarshal(params, &p) //nolint:errcheck // checked by the test below
+			mtx.Lock()
+			defer mtx.Unlock()
+			subsystem.Hosts = append(subsystem.Hosts, struct {
+				NQN string `json:"nqn"`
+			}{p.Host})
+			return true, nil
+		},
+		"nvmf_subsystem_remove_host": func(json.RawMessage) (interface{}, *Error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			subsystem.Hosts = nil
+			return true, nil
+		},
+	})
+
+	if err := node.AllowHost("lvol-uuid", hostNQN); err != nil {
+		t.Fatal(err)
+	}
+	if params := target.param(t, "nvmf_subsystem_add_host"); params["nqn"] != subsystem.NQN || params["host"] != hostNQN {
+		t.Fatalf("unexpected nvmf_subsystem_add_host params %v", params)
+	}
+
+	// an allowed host is not added again
+	target.calls = nil
+	if err := node.AllowHost("lvol-uuid", hostNQN); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"nvmf_get_subsystems"}; !reflect.DeepEqual(target.calls, want) {
+		t.Fatalf("calls %v, want %v", target.calls, want)
+	}
+
+	if err := node.DisallowHost("lvol-uuid", hostNQN); err != nil {
+		t.Fatal(err)
+	}
+	if params := target.param(t, "nvmf_subsystem_remove_host"); params["host"] != hostNQN {
+		t.Fatalf("unexpected nvmf_subsystem_remove_host params %v", params)
+	}
+	if err := node.AllowHost("other-lvol", hostNQN); !errors.Is(err, ErrJSONNoSuchDevice) {
+		t.Fatalf("allowing host on a missing subsystem returned %v", err)
+	}
+}
+
+func TestSPDKListSnapshots(t *testing.T) {
+	lvol := func(uuid, alias string, snapshot bool, baseSnapshot string, clones ...string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":    uuid,
+			"uuid":    uuid,
+			"aliases": []string{alias},
+			"driver_specific": map[string]interface{}{"lvol": map[string]interface{}{
+				"lvol_store_uuid": "lvs-uuid",
+				"snapshot":        snapshot,
+				"base_snapshot":   baseSnapshot,
+				"clones":          clones,
+			}},
+		}
+	}
+	_, node := newScriptedSPDK(t, map[string]rpcHandler{
+		// the clone is listed before the volume the snapshot was taken from
+		"bdev_get_bdevs": result([]interface{}{
+			lvol("clone-uuid", "lvs0/clone", false, "snap"),
+			lvol("snap-uuid", "lvs0/snap", true, "", "vol", "clone"),
+			lvol("vol-uuid", "lvs0/vol", false, "snap"),
+			lvol("orphan-uuid", "lvs0/orphan", true, ""),
+		}),
+	})
+
+	snapshots, err := node.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(map[string]string)
+	for _, snapshot := range snapshots {
+		sources[snapshot.UUID] = snapshot.SourceVolume.UUID
+	}
+	if want := map[string]string{"snap-uuid": "vol-uuid", "orphan-uuid": ""}; !reflect.DeepEqual(sources, want) {
+		t.Fatalf("snapshot sources %v, want %v", sources, want)
+	}
+}
+
+func TestNewBackendSelectsSPDK(t *testing.T) {
+	secret, err := json.Marshal(ClustersInfo{Clusters: []ClusterConfig{
+		{ClusterID: "sb", ClusterEndpoint: "http://127.0.0.1", ClusterSecret: "secret"},
+		{ClusterID: "edge", Backend: BackendSPDK, RPCAddress: "tcp://127.0.0.1:5260", TargetAddress: "127.0.0.1"},
+		{ClusterID: "broken", Backend: BackendSPDK, RPCAddress: "/var/tmp/spdk.sock", TargetAddress: "127.0.0.1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretFile := filepath.Join(t.TempDir(), "secret.json")
+	if err = os.WriteFile(secretFile, secret, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SPDKCSI_SECRET", secretFile)
+
+	if backend, err := NewBackend("sb", RequestClassMonitor); err != nil {
+		t.Fatal(err)
+	} else if node, ok := backend.(*NodeNVMf); !ok {
+		t.Fatalf("expected SimplyBlock backend, got %T", backend)
+	} else if node.Client.Class != RequestClassMonitor {
+		t.Fatalf("requests drawn from the %s budget", node.Client.Class)
+	}
+	if backend, err := NewBackend("edge", RequestClassDefault); err != nil {
+		t.Fatal(err)
+	} else if _, ok := backend.(*NodeSPDK); !ok {
+		t.Fatalf("expected SPDK backend, got %T", backend)
+	}
+	if _, err := NewBackend("broken", RequestClassDefault); err == nil {
+		t.Fatal("rpc_address without scheme should be rejected")
+	}
+}
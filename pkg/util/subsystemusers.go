@@ -0,0 +1,161 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"k8s.io/klog"
+)
+
+// with max_namespace_per_subsys above 1 the volumes of a cluster share
+// subsystems, the node keeps the staged volumes using each subsystem and
+// disconnects it with the last one
+
+// nvmfUsersDir keeps the volumes using the connected subsystems, replaced
+// by tests
+var nvmfUsersDir = "/var/lib/spdkcsi/nvmf-users"
+
+var subsystemLocks = NewVolumeLocks()
+
+type subsystemUsers struct {
+	Volumes []string `json:"volumes"`
+}
+
+// LockSubsystem serializes connecting, disconnecting and the stashed state
+// of a subsystem shared by volumes that are staged and unstaged concurrently.
+// Returns the unlock function.
+func LockSubsystem(nqn string) func() {
+	if nqn == "" {
+		return func() {}
+	}
+	return subsystemLocks.Lock(nqn)
+}
+
+// SubsystemUser returns the key a staged volume is recorded with as user of
+// its subsystem: its volume ID or, for volume contexts stashed by versions
+// that did not keep it, its staging path
+func SubsystemUser(volumeContext map[string]string) string {
+	if volumeID := volumeContext["volumeID"]; volumeID != "" {
+		return volumeID
+	}
+	if stagingParentPath := volumeContext["stagingParentPath"]; stagingParentPath != "" {
+		return "staging:" + stagingParentPath
+	}
+	return ""
+}
+
+// subsystemVolumes returns the volumes using a subsystem
+func subsystemVolumes(nqn string) ([]string, error) {
+	var users subsystemUsers
+	if _, err := lookupNQNState(nvmfUsersDir, nqn, &users); err != nil {
+		return nil, fmt.Errorf("failed to read volumes using %s: %w", nqn, err)
+	}
+	return users.Volumes, nil
+}
+
+func setSubsystemVolumes(nqn string, volumes []string) error {
+	var err error
+	if len(volumes) == 0 {
+		err = cleanUpNQNState(nvmfUsersDir, nqn)
+	} else {
+		sort.Strings(volumes)
+		err = stashNQNState(nvmfUsersDir, nqn, &subsystemUsers{Volumes: volumes})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store volumes using %s: %w", nqn, err)
+	}
+	return nil
+}
+
+// addSubsystemUser records that a staged volume uses the subsystem
+func addSubsystemUser(nqn, volumeID string) error {
+	if volumeID == "" {
+		return nil
+	}
+	volumes, err := subsystemVolumes(nqn)
+	if err != nil || slices.Contains(volumes, volumeID) {
+		return err
+	}
+	return setSubsystemVolumes(nqn, append(volumes, volumeID))
+}
+
+// removeSubsystemUser records that a volume no longer uses the subsystem,
+// returns the volumes still using it
+func removeSubsystemUser(nqn, volumeID string) ([]string, error) {
+	volumes, err := subsystemVolumes(nqn)
+	if err != nil {
+		return nil, err
+	}
+	remaining := slices.DeleteFunc(volumes, func(v string) bool { return v == volumeID })
+	return remaining, setSubsystemVolumes(nqn, remaining)
+}
+
+// CleanUpUnusedSubsystem removes the stashed secrets and connect parameters
+// of a subsystem that is not connected and no staged volume uses, as left by
+// a failed first stage. Callers hold LockSubsystem.
+func CleanUpUnusedSubsystem(nqn string) {
+	volumes, err := subsystemVolumes(nqn)
+	if err != nil || len(volumes) > 0 {
+		return
+	}
+	if connected, err := IsNQNConnected(nqn); err != nil || connected {
+		return
+	}
+	if err := CleanUpNVMfAuth(nqn); err != nil {
+		klog.Error(err)
+	}
+	if err := CleanUpConnectParams(nqn); err != nil {
+		klog.Error(err)
+	}
+}
+
+// RestoreSubsystemUsers records the staged volumes using each subsystem,
+// found in the stashed volume contexts on startup. If complete, the volumes
+// are all staged volumes and users not among them are dropped.
+func RestoreSubsystemUsers(users map[string][]string, complete bool) error {
+	nqns, err := listNQNStates(nvmfUsersDir)
+	if err != nil {
+		return err
+	}
+	for _, nqn := range nqns {
+		if _, ok := users[nqn]; !ok && complete {
+			if err := setSubsystemVolumes(nqn, nil); err != nil {
+				return err
+			}
+		}
+	}
+	for nqn, volumes := range users {
+		if !complete {
+			known, err := subsystemVolumes(nqn)
+			if err != nil {
+				return err
+			}
+			for _, v := range known {
+				if !slices.Contains(volumes, v) {
+					volumes = append(volumes, v)
+				}
+			}
+		}
+		if err := setSubsystemVolumes(nqn, slices.Clone(volumes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the volumes kept per shared subsystem
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubsystemUsers(t *testing.T) {
+	nvmfUsersDir = t.TempDir()
+	t.Cleanup(func() { nvmfUsersDir = "/var/lib/spdkcsi/nvmf-users" })
+	const otherNQN = "nqn.2023-02.io.simplyblock:cluster1:lvol:lvol2"
+
+	want := func(nqn string, volumes ...string) {
+		t.Helper()
+		got, err := subsystemVolumes(nqn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, volumes) {
+			t.Errorf("volumes using %s: %v, want %v", nqn, got, volumes)
+		}
+	}
+
+	for _, volumeID := range []string{"vol2", "vol1", "vol2", ""} {
+		if err := addSubsystemUser(healthTestNQN, volumeID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want(healthTestNQN, "vol1", "vol2")
+
+	if remaining, err := removeSubsystemUser(healthTestNQN, "vol2"); err != nil || !reflect.DeepEqual(remaining, []string{"vol1"}) {
+		t.Errorf("remaining %v, %v", remaining, err)
+	}
+	if remaining, err := removeSubsystemUser(healthTestNQN, "vol1"); err != nil || len(remaining) != 0 {
+		t.Errorf("remaining %v, %v", remaining, err)
+	}
+	if nqns, err := listNQNStates(nvmfUsersDir); err != nil || len(nqns) != 0 {
+		t.Errorf("state left after the last user: %v, %v", nqns, err)
+	}
+
+	// restored after a restart, vol4 was unstaged while the plugin was down
+	if err := addSubsystemUser(otherNQN, "vol4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreSubsystemUsers(map[string][]string{healthTestNQN: {"vol3", "vol1"}}, false); err != nil {
+		t.Fatal(err)
+	}
+	want(healthTestNQN, "vol1", "vol3")
+	want(otherNQN, "vol4")
+	if err := RestoreSubsystemUsers(map[string][]string{healthTestNQN: {"vol3"}}, true); err != nil {
+		t.Fatal(err)
+	}
+	want(healthTestNQN, "vol3")
+	want(otherNQN)
+}
@@ -0,0 +1,316 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+// nvmfTuningDir keeps the tuning profiles of the namespaces of the
+// connected subsystems, replaced by tests
+var nvmfTuningDir = "/var/lib/spdkcsi/nvmf-tuning"
+
+// tuningAttr is a request queue attribute, set in order
+type tuningAttr struct {
+	name, value string
+}
+
+// tuningProfile is a set of block device attributes of a namespace, unset
+// attributes are left as they are
+type tuningProfile struct {
+	// paths are set on the request based devices, the path devices with
+	// native multipath, else the namespace itself
+	paths []tuningAttr
+	// head is set on the namespace device the filesystem is on
+	head []tuningAttr
+	// ioPolicy is the native multipath I/O policy of the subsystem
+	ioPolicy string
+}
+
+// tuningProfiles are the profiles by tuning_profile storage class parameter
+var tuningProfiles = map[string]tuningProfile{
+	// small random I/O: no scheduler in the way, little read-ahead and the
+	// I/O spread over all optimized paths
+	"database": {
+		paths:    []tuningAttr{{"scheduler", "none"}},
+		head:     []tuningAttr{{"read_ahead_kb", "16"}},
+		ioPolicy: "round-robin",
+	},
+	// large sequential I/O: merged requests, deep read-ahead and each
+	// stream kept on the path of its NUMA node
+	"streaming": {
+		paths: []tuningAttr{
+			{"scheduler", "mq-deadline"},
+			{"nr_requests", "256"},
+			{"max_sectors_kb", "1024"},
+		},
+		head: []tuningAttr{
+			{"read_ahead_kb", "4096"},
+			{"max_sectors_kb", "1024"},
+		},
+		ioPolicy: "numa",
+	},
+	// the kernel defaults, undoing other profiles. Switching the scheduler to
+	// none resets nr_requests to the queue depth of the device.
+	"default": {
+		paths: []tuningAttr{
+			{"scheduler", "none"},
+			{"max_sectors_kb", "1280"},
+		},
+		head: []tuningAttr{
+			{"read_ahead_kb", "128"},
+			{"max_sectors_kb", "1280"},
+		},
+		ioPolicy: "numa",
+	},
+}
+
+// tuningState is the stashed tuning of a subsystem
+type tuningState struct {
+	// Profile is the profile of the last namespace tuned, its I/O policy is
+	// the one of the subsystem. Older versions stashed only it and applied
+	// it to all namespaces.
+	Profile string `json:"profile"`
+	// Namespaces are the profiles of the staged namespaces by NSID
+	Namespaces map[string]namespaceTuning `json:"namespaces,omitempty"`
+}
+
+// namespaceTuning is the stashed tuning profile of a namespace
+type namespaceTuning struct {
+	Profile string `json:"profile"`
+	// UUID keeps the profile off another namespace with the same NSID
+	UUID string `json:"uuid,omitempty"`
+}
+
+// ValidateTuningProfile returns an error if the tuning_profile storage
+// class parameter names no known profile
+func ValidateTuningProfile(params map[string]string) error {
+	name, ok := params["tuning_profile"]
+	if !ok {
+		return nil
+	}
+	if _, ok := tuningProfiles[name]; !ok {
+		names := make([]string, 0, len(tuningProfiles))
+		for name := range tuningProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown tuning_profile %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// TuneVolume stashes the tuning profile of the namespace of a volume, so it
+// is applied again after reconnects, and applies it. The profile of the
+// volume also sets the I/O policy of its subsystem. Failing to set an
+// attribute is logged only, the kernel may not support it. Callers hold
+// LockSubsystem.
+func TuneVolume(volumeContext map[string]string) error {
+	nqn, profile := volumeContext["nqn"], volumeContext["tuning_profile"]
+	if nqn == "" || profile == "" {
+		return nil
+	}
+	if _, ok := tuningProfiles[profile]; !ok {
+		return fmt.Errorf("unknown tuning profile %q", profile)
+	}
+	var state tuningState
+	if _, err := lookupNQNState(nvmfTuningDir, nqn, &state); err != nil {
+		return fmt.Errorf("failed to read tuning profile of %s: %w", nqn, err)
+	}
+	if state.Namespaces == nil {
+		// a stash of an older version tuned all namespaces alike
+		state = tuningState{Namespaces: map[string]namespaceTuning{}}
+	}
+	state.Profile = profile
+	state.Namespaces[volumeContext["nsId"]] = namespaceTuning{Profile: profile, UUID: volumeContext["nsUuid"]}
+	if err := stashNQNState(nvmfTuningDir, nqn, &state); err != nil {
+		return fmt.Errorf("failed to stash tuning profile of %s: %w", nqn, err)
+	}
+	return CheckTuning(nqn)
+}
+
+// untuneNamespace removes the stashed tuning profile of a namespace of a
+// subsystem that stays connected for other volumes, unless the NSID was
+// tuned for another namespace since
+func untuneNamespace(nqn, nsID, nsUUID string) error {
+	var state tuningState
+	if found, err := lookupNQNState(nvmfTuningDir, nqn, &state); err != nil || !found {
+		return err
+	}
+	tuning, ok := state.Namespaces[nsID]
+	if !ok || (tuning.UUID != "" && nsUUID != "" && !strings.EqualFold(tuning.UUID, nsUUID)) {
+		return nil
+	}
+	delete(state.Namespaces, nsID)
+	if err := stashNQNState(nvmfTuningDir, nqn, &state); err != nil {
+		return fmt.Errorf("failed to stash tuning profile of %s: %w", nqn, err)
+	}
+	return nil
+}
+
+// CheckTuning applies the stashed tuning profile of a subsystem again, a
+// reconnect creates devices with the kernel defaults
+func CheckTuning(nqn string) error {
+	subsys, err := fabrics.SubsystemByNQN(nqn)
+	if err != nil {
+		return err
+	} else if subsys == nil {
+		return nil
+	}
+	tuneSubsystem(subsys)
+	return nil
+}
+
+// tuneSubsystem sets the attributes of the stashed profiles of the
+// namespaces of the subsystem that differ, returns the number of
+// attributes changed
+func tuneSubsystem(subsys *nvme.Subsystem) int {
+	var state tuningState
+	found, err := lookupNQNState(nvmfTuningDir, subsys.NQN, &state)
+	if err != nil {
+		klog.Errorf("failed to read tuning profile of %s: %v", subsys.NQN, err)
+		return 0
+	} else if !found {
+		return 0
+	}
+
+	changed := 0
+	if ioPolicy := tuningProfiles[state.Profile].ioPolicy; ioPolicy != "" {
+		file := filepath.Join(fabrics.SysfsRoot, "class", "nvme-subsystem", subsys.Name, "iopolicy")
+		if setTuningAttr(file, ioPolicy) {
+			changed++
+		}
+	}
+	if state.Namespaces == nil {
+		for _, ns := range subsys.Namespaces {
+			changed += tuneNamespace(ns, tuningProfiles[state.Profile])
+		}
+	}
+	for nsID, tuning := range state.Namespaces {
+		namespace, err := lookupNamespace(subsys, nsID, tuning.UUID)
+		if err != nil {
+			klog.V(4).Infof("not tuning namespace %s of %s: %v", nsID, subsys.NQN, err)
+			continue
+		}
+		changed += tuneNamespace(namespace.Name, tuningProfiles[tuning.Profile])
+	}
+	if changed > 0 {
+		klog.Infof("applied tuning profiles to %s, %d attributes changed", subsys.NQN, changed)
+	}
+	return changed
+}
+
+// tuneNamespace sets the attributes of a profile on a namespace device and
+// its path devices, returns the number of attributes changed
+func tuneNamespace(ns string, profile tuningProfile) int {
+	paths := pathDevices(ns)
+	if len(paths) == 0 {
+		// without native multipath the namespace takes I/O requests
+		paths = []string{ns}
+	}
+	changed := 0
+	for _, dev := range paths {
+		changed += tuneQueue(dev, profile.paths)
+	}
+	return changed + tuneQueue(ns, profile.head)
+}
+
+var headRe = regexp.MustCompile(`^(nvme[0-9]+)(n[0-9]+)$`)
+
+// pathDevices returns the path devices of a multipath head like nvme0n1,
+// e.g. nvme0c1n1
+func pathDevices(head string) []string {
+	m := headRe.FindStringSubmatch(head)
+	if m == nil {
+		return nil
+	}
+	matches, _ := filepath.Glob(filepath.Join(fabrics.SysfsRoot, "block", m[1]+"c*"+m[2]))
+	devices := make([]string, 0, len(matches))
+	for _, match := range matches {
+		devices = append(devices, filepath.Base(match))
+	}
+	return devices
+}
+
+// tuneQueue sets the request queue attributes of a block device, returns
+// the number of attributes changed
+func tuneQueue(dev string, attrs []tuningAttr) int {
+	queue := filepath.Join(fabrics.SysfsRoot, "block", dev, "queue")
+	changed := 0
+	for _, attr := range attrs {
+		value := attr.value
+		if attr.name == "max_sectors_kb" {
+			// the device may not take requests that large
+			hw, err := strconv.Atoi(readSysfsAttr(filepath.Join(queue, "max_hw_sectors_kb")))
+			want, _ := strconv.Atoi(value)
+			if err == nil && hw < want {
+				value = strconv.Itoa(hw)
+			}
+		}
+		if setTuningAttr(filepath.Join(queue, attr.name), value) {
+			changed++
+		}
+	}
+	return changed
+}
+
+// setTuningAttr writes a sysfs attribute unless it has the value already,
+// returns whether it was written
+func setTuningAttr(file, value string) bool {
+	current := readSysfsAttr(file)
+	if i := strings.Index(current, "["); i >= 0 {
+		// choices like "[none] mq-deadline", the current one in brackets
+		current, _, _ = strings.Cut(current[i+1:], "]")
+	}
+	if current == value {
+		return false
+	}
+	if err := os.WriteFile(file, []byte(value), 0o200); err != nil {
+		klog.Warningf("failed to set %s to %s: %v", file, value, err)
+		return false
+	}
+	return true
+}
+
+func readSysfsAttr(file string) string {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// CleanUpTuning removes the stashed tuning profile of a subsystem
+func CleanUpTuning(nqn string) error {
+	if nqn == "" {
+		return nil
+	}
+	if err := cleanUpNQNState(nvmfTuningDir, nqn); err != nil {
+		return fmt.Errorf("failed to clean up tuning profile of %s: %w", nqn, err)
+	}
+	return nil
+}
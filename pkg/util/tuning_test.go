@@ -0,0 +1,176 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the tuning profiles against a fake sysfs tree
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/nvme"
+)
+
+const tuningTestNQN = "nqn.2023-02.io.simplyblock:cluster1:lvol:lvol1"
+
+// fakeQueue creates the request queue attributes of a block device with
+// the kernel defaults
+func fakeQueue(t *testing.T, root, dev string) {
+	t.Helper()
+	queue := filepath.Join(root, "block", dev, "queue")
+	mustMkdir(t, queue)
+	for attr, value := range map[string]string{
+		"scheduler":         "[none] mq-deadline kyber",
+		"nr_requests":       "128",
+		"read_ahead_kb":     "128",
+		"max_sectors_kb":    "128",
+		"max_hw_sectors_kb": "512",
+	} {
+		mustWrite(t, filepath.Join(queue, attr), value)
+	}
+}
+
+func TestTuneSubsystem(t *testing.T) {
+	root := t.TempDir()
+	oldFabrics := fabrics
+	fabrics = &nvme.Fabrics{SysfsRoot: root}
+	nvmfTuningDir = filepath.Join(t.TempDir(), "nvmf-tuning")
+	t.Cleanup(func() {
+		fabrics = oldFabrics
+		nvmfTuningDir = "/var/lib/spdkcsi/nvmf-tuning"
+	})
+
+	// multipath heads nvme0n1 and nvme0n2 with a path through controller
+	// nvme0
+	subsys := filepath.Join(root, "class", "nvme-subsystem", "nvme-subsys0")
+	mustMkdir(t, filepath.Join(subsys, "nvme0"))
+	for _, ns := range []string{"1", "2"} {
+		mustMkdir(t, filepath.Join(subsys, "nvme0n"+ns))
+		mustWrite(t, filepath.Join(subsys, "nvme0n"+ns, "nsid"), ns)
+		fakeQueue(t, root, "nvme0n"+ns)
+		fakeQueue(t, root, "nvme0c0n"+ns)
+	}
+	mustWrite(t, filepath.Join(subsys, "subsysnqn"), tuningTestNQN)
+	mustWrite(t, filepath.Join(subsys, "iopolicy"), "numa")
+	mustMkdir(t, filepath.Join(root, "class", "nvme", "nvme0"))
+
+	attr := func(elem ...string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(append([]string{root}, elem...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	tune := func(nsID, profile string) {
+		t.Helper()
+		err := TuneVolume(map[string]string{"nqn": tuningTestNQN, "nsId": nsID, "tuning_profile": profile})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	type want struct {
+		file []string
+		want string
+	}
+	check := func(wants []want) {
+		t.Helper()
+		for _, tc := range wants {
+			if got := attr(tc.file...); got != tc.want {
+				t.Errorf("%s is %q, want %q", filepath.Join(tc.file...), got, tc.want)
+			}
+		}
+	}
+
+	tune("1", "streaming")
+	check([]want{
+		{[]string{"class", "nvme-subsystem", "nvme-subsys0", "iopolicy"}, "numa"},
+		{[]string{"block", "nvme0c0n1", "queue", "scheduler"}, "mq-deadline"},
+		{[]string{"block", "nvme0c0n1", "queue", "nr_requests"}, "256"},
+		{[]string{"block", "nvme0n1", "queue", "read_ahead_kb"}, "4096"},
+		// limited by the device
+		{[]string{"block", "nvme0n1", "queue", "max_sectors_kb"}, "512"},
+		{[]string{"block", "nvme0n1", "queue", "scheduler"}, "[none] mq-deadline kyber"},
+		// the other namespace of the subsystem is left alone
+		{[]string{"block", "nvme0c0n2", "queue", "scheduler"}, "[none] mq-deadline kyber"},
+		{[]string{"block", "nvme0n2", "queue", "read_ahead_kb"}, "128"},
+	})
+
+	// only the I/O policy is shared by the namespaces
+	tune("2", "database")
+	check([]want{
+		{[]string{"class", "nvme-subsystem", "nvme-subsys0", "iopolicy"}, "round-robin"},
+		{[]string{"block", "nvme0n2", "queue", "read_ahead_kb"}, "16"},
+		{[]string{"block", "nvme0n1", "queue", "read_ahead_kb"}, "4096"},
+	})
+	// the default profile restores the kernel defaults
+	tune("2", "default")
+	tune("1", "default")
+	check([]want{
+		{[]string{"class", "nvme-subsystem", "nvme-subsys0", "iopolicy"}, "numa"},
+		{[]string{"block", "nvme0c0n1", "queue", "scheduler"}, "none"},
+		{[]string{"block", "nvme0n1", "queue", "read_ahead_kb"}, "128"},
+		{[]string{"block", "nvme0n1", "queue", "max_sectors_kb"}, "512"},
+		{[]string{"block", "nvme0n2", "queue", "read_ahead_kb"}, "128"},
+	})
+	tune("1", "streaming")
+	if err := untuneNamespace(tuningTestNQN, "2", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reconnect resets the attributes of the path device
+	fakeQueue(t, root, "nvme0c0n1")
+	subsystem, err := fabrics.SubsystemByNQN(tuningTestNQN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeQueue(t, root, "nvme0c0n2")
+	if changed := tuneSubsystem(subsystem); changed != 3 {
+		t.Errorf("%d attributes changed after reconnect, want 3", changed)
+	}
+	if changed := tuneSubsystem(subsystem); changed != 0 {
+		t.Errorf("%d attributes changed again", changed)
+	}
+
+	if err := CleanUpTuning(tuningTestNQN); err != nil {
+		t.Fatal(err)
+	}
+	fakeQueue(t, root, "nvme0c0n1")
+	if changed := tuneSubsystem(subsystem); changed != 0 {
+		t.Errorf("%d attributes changed without a tuning profile", changed)
+	}
+
+	// stashes of older versions tune all namespaces alike
+	if err := stashNQNState(nvmfTuningDir, tuningTestNQN, &tuningState{Profile: "database"}); err != nil {
+		t.Fatal(err)
+	}
+	tuneSubsystem(subsystem)
+	check([]want{
+		{[]string{"class", "nvme-subsystem", "nvme-subsys0", "iopolicy"}, "round-robin"},
+		{[]string{"block", "nvme0n1", "queue", "read_ahead_kb"}, "16"},
+		{[]string{"block", "nvme0n2", "queue", "read_ahead_kb"}, "16"},
+	})
+
+	if err := ValidateTuningProfile(map[string]string{"tuning_profile": "database"}); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateTuningProfile(map[string]string{"tuning_profile": "oltp"}); err == nil {
+		t.Error("unknown tuning profile accepted")
+	}
+}
@@ -319,6 +319,28 @@ func CleanUpVolumeContext(path string) error {
 	return cleanUpContext(path, volumeContextFileName)
 }
 
+// FindVolumeContexts returns the staging paths below the kubelet plugin
+// directory that hold a stashed volume context. Only the staging directories
+// kubelet creates are looked at, staged filesystems are never walked.
+func FindVolumeContexts(kubeletPluginDir string) ([]string, error) {
+	var paths []string
+	for _, pattern := range []string{
+		// mounted volumes: csi/<driver>/<volume hash>/globalmount, csi/pv/<pv>/globalmount
+		"kubernetes.io/csi/*/*/globalmount",
+		// block volumes
+		"kubernetes.io/csi/volumeDevices/staging/*",
+	} {
+		matches, err := filepath.Glob(filepath.Join(kubeletPluginDir, pattern, volumeContextFileName))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			paths = append(paths, filepath.Dir(match))
+		}
+	}
+	return paths, nil
+}
+
 // StashXPUContext stashes XPU context into the volumeContextFileName at the passed in path, in
 // JSON format.
 func StashXPUContext(xpuContext map[string]string, path string) error {
@@ -0,0 +1,371 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/klog"
+)
+
+// xPU target types of the xpuList in the node server config, the xPU
+// connects the volume and exposes it to the host through the OPI storage API
+const (
+	XPUTargetTypeOPINVMe      = "xpu-opi-nvme"
+	XPUTargetTypeOPIVirtioBlk = "xpu-opi-virtioblk"
+)
+
+// IsXPUTargetType returns whether the target type attaches volumes through
+// an xPU
+func IsXPUTargetType(targetType string) bool {
+	return targetType == XPUTargetTypeOPINVMe || targetType == XPUTargetTypeOPIVirtioBlk
+}
+
+const xpuCallTimeout = 30 * time.Second
+
+// device lookups of the host, replaced by tests
+var (
+	xpuPhysicalFunction = GetAvailablePhysicalFunction
+	xpuNvmeDevice       = GetNvmeDeviceName
+	xpuVirtioBlkDevice  = GetVirtioBlkDeviceName
+)
+
+// XPUInitiator connects a volume on an xPU, which exposes it to the host
+// as an NVMe or virtio-blk PCIe function. The names of the objects created
+// on the xPU are kept in the XPU context stashed with the volume.
+type XPUInitiator struct {
+	remote    pb.NvmeRemoteControllerServiceClient
+	nvme      pb.FrontendNvmeServiceClient
+	virtioBlk pb.FrontendVirtioBlkServiceClient
+
+	targetType    string
+	kvmPciBridges int
+
+	transport   string
+	connections []connectionInfo
+	nqn         string
+	nsID        string
+	nsUUID      string
+	// id names all objects of the volume on the xPU
+	id      string
+	context map[string]string
+}
+
+// NewXPUInitiator creates an initiator of a volume attached through the xPU
+// at conn. The XPU context of a staged volume is passed to disconnect it.
+func NewXPUInitiator(conn grpc.ClientConnInterface, targetType string, kvmPciBridges int, volumeContext, xpuContext map[string]string) (*XPUInitiator, error) {
+	if !IsXPUTargetType(targetType) {
+		return nil, fmt.Errorf("unknown xPU target type: %s", targetType)
+	}
+	transport := volumeContext["targetType"]
+	if xpuContext != nil {
+		transport = xpuContext["transport"]
+	}
+	if !IsNVMfTarget(transport) {
+		return nil, fmt.Errorf("%s volumes cannot be attached through an xPU", transport)
+	}
+	var connections []connectionInfo
+	if err := json.Unmarshal([]byte(volumeContext["connections"]), &connections); err != nil {
+		return nil, fmt.Errorf("failed to unmarshall connections: %w", err)
+	}
+	_, lvolID := getLvolIDFromNQN(volumeContext["nqn"])
+	if lvolID == "" {
+		return nil, fmt.Errorf("invalid volume nqn %q", volumeContext["nqn"])
+	}
+	nsUUID := volumeContext["nsUuid"]
+	if nsUUID == "" {
+		nsUUID = lvolID
+	}
+	nsID := volumeContext["nsId"]
+	if nsID == "" {
+		nsID = "1"
+	}
+	if xpuContext == nil {
+		xpuContext = map[string]string{"targetType": targetType, "transport": transport}
+	}
+	return &XPUInitiator{
+		remote:        pb.NewNvmeRemoteControllerServiceClient(conn),
+		nvme:          pb.NewFrontendNvmeServiceClient(conn),
+		virtioBlk:     pb.NewFrontendVirtioBlkServiceClient(conn),
+		targetType:    targetType,
+		kvmPciBridges: kvmPciBridges,
+		transport:     transport,
+		connections:   connections,
+		nqn:           volumeContext["nqn"],
+		nsID:          nsID,
+		nsUUID:        nsUUID,
+		id:            "spdkcsi-" + lvolID,
+		context:       xpuContext,
+	}, nil
+}
+
+// Context returns the XPU context to stash with the staged volume
+func (x *XPUInitiator) Context() map[string]string {
+	return x.context
+}
+
+// xpuObjectName returns the name of a created xPU object, or of the
+// existing one
+func xpuObjectName(name string, err error, existing string) (string, error) {
+	if status.Code(err) == codes.AlreadyExists {
+		return existing, nil
+	} else if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return existing, nil
+	}
+	return name, nil
+}
+
+func (x *XPUInitiator) Connect() (devicePath string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), xpuCallTimeout)
+	defer cancel()
+	defer func() {
+		if err != nil {
+			x.Disconnect() //nolint:errcheck // ignore error
+		}
+	}()
+
+	if err = x.connectRemote(ctx); err != nil {
+		return "", fmt.Errorf("failed to connect volume %s on the xPU: %w", x.nqn, err)
+	}
+	switch x.targetType {
+	case XPUTargetTypeOPINVMe:
+		devicePath, err = x.exposeNvme(ctx)
+	case XPUTargetTypeOPIVirtioBlk:
+		devicePath, err = x.exposeVirtioBlk(ctx)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to expose volume %s to the host: %w", x.nqn, err)
+	}
+	x.context["devicePath"] = devicePath
+	klog.Infof("volume %s attached through the xPU as %s", x.nqn, devicePath)
+	return devicePath, nil
+}
+
+// connectRemote connects the xPU to every path of the volume
+func (x *XPUInitiator) connectRemote(ctx context.Context) error {
+	trtype := pb.NvmeTransportType_NVME_TRANSPORT_TYPE_TCP
+	if x.transport == TargetTypeRDMA {
+		trtype = pb.NvmeTransportType_NVME_TRANSPORT_TYPE_RDMA
+	}
+	ctrl, err := x.remote.CreateNvmeRemoteController(ctx, &pb.CreateNvmeRemoteControllerRequest{
+		NvmeRemoteControllerId: x.id,
+		NvmeRemoteController: &pb.NvmeRemoteController{
+			Multipath: pb.NvmeMultipath_NVME_MULTIPATH_MULTIPATH,
+		},
+	})
+	x.context["remoteController"], err = xpuObjectName(ctrl.GetName(), err, "nvmeRemoteControllers/"+x.id)
+	if err != nil {
+		return err
+	}
+
+	var hostNQN string
+	if hostIdentity != nil {
+		hostNQN = hostIdentity.HostNQN
+	}
+	var paths []string
+	for i, conn := range x.connections {
+		adrfam := pb.NvmeAddressFamily_NVME_ADDRESS_FAMILY_IPV4
+		if ip := net.ParseIP(conn.IP); ip != nil && ip.To4() == nil {
+			adrfam = pb.NvmeAddressFamily_NVME_ADDRESS_FAMILY_IPV6
+		}
+		pathID := fmt.Sprintf("%s-%d", x.id, i)
+		path, err := x.remote.CreateNvmePath(ctx, &pb.CreateNvmePathRequest{
+			Parent:     x.context["remoteController"],
+			NvmePathId: pathID,
+			NvmePath: &pb.NvmePath{
+				Trtype: trtype,
+				Traddr: conn.IP,
+				Fabrics: &pb.FabricsPath{
+					Trsvcid: int64(conn.Port),
+					Subnqn:  x.nqn,
+					Adrfam:  adrfam,
+					Hostnqn: hostNQN,
+				},
+			},
+		})
+		name, err := xpuObjectName(path.GetName(), err, x.context["remoteController"]+"/nvmePaths/"+pathID)
+		if err != nil {
+			return fmt.Errorf("path %s:%d: %w", conn.IP, conn.Port, err)
+		}
+		paths = append(paths, name)
+	}
+	x.context["paths"] = strings.Join(paths, ",")
+	return nil
+}
+
+// volumeRef is the xPU block device of the remote namespace
+func (x *XPUInitiator) volumeRef() string {
+	return x.id + "n" + x.nsID
+}
+
+// pciEndpoint picks a free PCIe function of the host, returns it and its
+// address on the host
+func (x *XPUInitiator) pciEndpoint() (*pb.PciEndpoint, string, error) {
+	pf, vf, err := xpuPhysicalFunction(x.kvmPciBridges)
+	if err != nil {
+		return nil, "", fmt.Errorf("no free PCIe function: %w", err)
+	}
+	endpoint := &pb.PciEndpoint{
+		PortId:           wrapperspb.Int32(0),
+		PhysicalFunction: wrapperspb.Int32(int32(pf)), //nolint:gosec // bounded by the PCI bridges
+		VirtualFunction:  wrapperspb.Int32(int32(vf)), //nolint:gosec // bounded by the PCI bridges
+	}
+	return endpoint, fmt.Sprintf("0000:%02x:%02x.0", pf+1, vf), nil
+}
+
+func (x *XPUInitiator) exposeNvme(ctx context.Context) (string, error) {
+	subsys, err := x.nvme.CreateNvmeSubsystem(ctx, &pb.CreateNvmeSubsystemRequest{
+		NvmeSubsystemId: x.id,
+		NvmeSubsystem: &pb.NvmeSubsystem{
+			Spec: &pb.NvmeSubsystemSpec{
+				Nqn:           "nqn.2016-06.io.spdk:" + x.id,
+				SerialNumber:  x.nsUUID,
+				ModelNumber:   "simplyblock-csi",
+				MaxNamespaces: 1,
+			},
+		},
+	})
+	x.context["subsystem"], err = xpuObjectName(subsys.GetName(), err, "nvmeSubsystems/"+x.id)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint, bdf, err := x.pciEndpoint()
+	if err != nil {
+		return "", err
+	}
+	ctrl, err := x.nvme.CreateNvmeController(ctx, &pb.CreateNvmeControllerRequest{
+		Parent:           x.context["subsystem"],
+		NvmeControllerId: x.id,
+		NvmeController: &pb.NvmeController{
+			Spec: &pb.NvmeControllerSpec{
+				Trtype:   pb.NvmeTransportType_NVME_TRANSPORT_TYPE_PCIE,
+				Endpoint: &pb.NvmeControllerSpec_PcieId{PcieId: endpoint},
+			},
+		},
+	})
+	x.context["controller"], err = xpuObjectName(ctrl.GetName(), err, x.context["subsystem"]+"/nvmeControllers/"+x.id)
+	if err != nil {
+		return "", err
+	}
+
+	namespace, err := x.nvme.CreateNvmeNamespace(ctx, &pb.CreateNvmeNamespaceRequest{
+		Parent:          x.context["subsystem"],
+		NvmeNamespaceId: x.id,
+		NvmeNamespace: &pb.NvmeNamespace{
+			Spec: &pb.NvmeNamespaceSpec{
+				HostNsid:      1,
+				Uuid:          x.nsUUID,
+				VolumeNameRef: x.volumeRef(),
+			},
+		},
+	})
+	x.context["namespace"], err = xpuObjectName(namespace.GetName(), err, x.context["subsystem"]+"/nvmeNamespaces/"+x.id)
+	if err != nil {
+		return "", err
+	}
+	// the host finds the namespace by the UUID given to it
+	return xpuNvmeDevice(x.nsUUID, bdf)
+}
+
+func (x *XPUInitiator) exposeVirtioBlk(ctx context.Context) (string, error) {
+	endpoint, bdf, err := x.pciEndpoint()
+	if err != nil {
+		return "", err
+	}
+	blk, err := x.virtioBlk.CreateVirtioBlk(ctx, &pb.CreateVirtioBlkRequest{
+		VirtioBlkId: x.id,
+		VirtioBlk: &pb.VirtioBlk{
+			PcieId:        endpoint,
+			VolumeNameRef: x.volumeRef(),
+		},
+	})
+	x.context["virtioBlk"], err = xpuObjectName(blk.GetName(), err, "virtioBlks/"+x.id)
+	if err != nil {
+		return "", err
+	}
+	return xpuVirtioBlkDevice(bdf, true)
+}
+
+// Disconnect removes the objects of the volume from the xPU, the ones never
+// created are skipped
+func (x *XPUInitiator) Disconnect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), xpuCallTimeout)
+	defer cancel()
+
+	var errs []error
+	del := func(kind, name string, call func(name string) error) {
+		if name == "" {
+			return
+		}
+		if err := call(name); err != nil && status.Code(err) != codes.NotFound {
+			errs = append(errs, fmt.Errorf("failed to delete %s %s: %w", kind, name, err))
+		}
+	}
+	del("virtio-blk", x.context["virtioBlk"], func(name string) error {
+		_, err := x.virtioBlk.DeleteVirtioBlk(ctx, &pb.DeleteVirtioBlkRequest{Name: name, AllowMissing: true})
+		return err
+	})
+	del("namespace", x.context["namespace"], func(name string) error {
+		_, err := x.nvme.DeleteNvmeNamespace(ctx, &pb.DeleteNvmeNamespaceRequest{Name: name, AllowMissing: true})
+		return err
+	})
+	del("controller", x.context["controller"], func(name string) error {
+		_, err := x.nvme.DeleteNvmeController(ctx, &pb.DeleteNvmeControllerRequest{Name: name, AllowMissing: true})
+		return err
+	})
+	del("subsystem", x.context["subsystem"], func(name string) error {
+		_, err := x.nvme.DeleteNvmeSubsystem(ctx, &pb.DeleteNvmeSubsystemRequest{Name: name, AllowMissing: true})
+		return err
+	})
+	// the device is gone once the host function is removed
+	if devicePath := x.context["devicePath"]; devicePath != "" && len(errs) == 0 {
+		if err := waitForDeviceGone(devicePath); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if x.context["paths"] != "" {
+		for _, path := range strings.Split(x.context["paths"], ",") {
+			del("path", path, func(name string) error {
+				_, err := x.remote.DeleteNvmePath(ctx, &pb.DeleteNvmePathRequest{Name: name, AllowMissing: true})
+				return err
+			})
+		}
+	}
+	del("remote controller", x.context["remoteController"], func(name string) error {
+		_, err := x.remote.DeleteNvmeRemoteController(ctx, &pb.DeleteNvmeRemoteControllerRequest{Name: name, AllowMissing: true})
+		return err
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to detach volume %s from the xPU: %w", x.nqn, errors.Join(errs...))
+	}
+	return nil
+}
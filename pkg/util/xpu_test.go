@@ -0,0 +1,298 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the xPU attach path against a local OPI stand-in
+package util
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fakeXPU keeps the names of the objects created through the OPI storage
+// API, the way the OPI SPDK bridge names them
+type fakeXPU struct {
+	pb.UnimplementedNvmeRemoteControllerServiceServer
+	pb.UnimplementedFrontendNvmeServiceServer
+	pb.UnimplementedFrontendVirtioBlkServiceServer
+
+	mu      sync.Mutex
+	objects map[string]string
+	// failVirtioBlk fails creating virtio-blk functions
+	failVirtioBlk bool
+	// down fails all calls
+	down bool
+}
+
+func (x *fakeXPU) create(name, ref string) (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.down {
+		return "", status.Error(codes.Unavailable, "xPU down")
+	}
+	if _, ok := x.objects[name]; ok {
+		return "", status.Errorf(codes.AlreadyExists, "%s exists", name)
+	}
+	x.objects[name] = ref
+	return name, nil
+}
+
+func (x *fakeXPU) delete(name string) (*emptypb.Empty, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.down {
+		return nil, status.Error(codes.Unavailable, "xPU down")
+	}
+	delete(x.objects, name)
+	return &emptypb.Empty{}, nil
+}
+
+func (x *fakeXPU) names() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var names []string
+	for name := range x.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (x *fakeXPU) CreateNvmeRemoteController(_ context.Context, req *pb.CreateNvmeRemoteControllerRequest) (*pb.NvmeRemoteController, error) {
+	name, err := x.create("nvmeRemoteControllers/"+req.GetNvmeRemoteControllerId(), "")
+	return &pb.NvmeRemoteController{Name: name}, err
+}
+
+func (x *fakeXPU) ListNvmeRemoteControllers(_ context.Context, _ *pb.ListNvmeRemoteControllersRequest) (*pb.ListNvmeRemoteControllersResponse, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.down {
+		return nil, status.Error(codes.Unavailable, "xPU down")
+	}
+	resp := &pb.ListNvmeRemoteControllersResponse{}
+	for name := range x.objects {
+		if strings.HasPrefix(name, "nvmeRemoteControllers/") && !strings.Contains(name, "/nvmePaths/") {
+			resp.NvmeRemoteControllers = append(resp.NvmeRemoteControllers, &pb.NvmeRemoteController{Name: name})
+		}
+	}
+	return resp, nil
+}
+
+func (x *fakeXPU) DeleteNvmeRemoteController(_ context.Context, req *pb.DeleteNvmeRemoteControllerRequest) (*emptypb.Empty, error) {
+	return x.delete(req.GetName())
+}
+
+func (x *fakeXPU) CreateNvmePath(_ context.Context, req *pb.CreateNvmePathRequest) (*pb.NvmePath, error) {
+	path := req.GetNvmePath()
+	name, err := x.create(req.GetParent()+"/nvmePaths/"+req.GetNvmePathId(), path.GetFabrics().GetSubnqn())
+	return &pb.NvmePath{Name: name}, err
+}
+
+func (x *fakeXPU) DeleteNvmePath(_ context.Context, req *pb.DeleteNvmePathRequest) (*emptypb.Empty, error) {
+	return x.delete(req.GetName())
+}
+
+func (x *fakeXPU) CreateNvmeSubsystem(_ context.Context, req *pb.CreateNvmeSubsystemRequest) (*pb.NvmeSubsystem, error) {
+	name, err := x.create("nvmeSubsystems/"+req.GetNvmeSubsystemId(), "")
+	return &pb.NvmeSubsystem{Name: name}, err
+}
+
+func (x *fakeXPU) DeleteNvmeSubsystem(_ context.Context, req *pb.DeleteNvmeSubsystemRequest) (*emptypb.Empty, error) {
+	return x.delete(req.GetName())
+}
+
+func (x *fakeXPU) CreateNvmeController(_ context.Context, req *pb.CreateNvmeControllerRequest) (*pb.NvmeController, error) {
+	name, err := x.create(req.GetParent()+"/nvmeControllers/"+req.GetNvmeControllerId(), "")
+	return &pb.NvmeController{Name: name}, err
+}
+
+func (x *fakeXPU) DeleteNvmeController(_ context.Context, req *pb.DeleteNvmeControllerRequest) (*emptypb.Empty, error) {
+	return x.delete(req.GetName())
+}
+
+func (x *fakeXPU) CreateNvmeNamespace(_ context.Context, req *pb.CreateNvmeNamespaceRequest) (*pb.NvmeNamespace, error) {
+	name, err := x.create(req.GetParent()+"/nvmeNamespaces/"+req.GetNvmeNamespaceId(), req.GetNvmeNamespace().GetSpec().GetVolumeNameRef())
+	return &pb.NvmeNamespace{Name: name}, err
+}
+
+func (x *fakeXPU) DeleteNvmeNamespace(_ context.Context, req *pb.DeleteNvmeNamespaceRequest) (*emptypb.Empty, error) {
+	return x.delete(req.GetName())
+}
+
+func (x *fakeXPU) CreateVirtioBlk(_ context.Context, req *pb.CreateVirtioBlkRequest) (*pb.VirtioBlk, error) {
+	if x.failVirtioBlk {
+		return nil, status.Error(codes.ResourceExhausted, "no free function")
+	}
+	name, err := x.create("virtioBlks/"+req.GetVirtioBlkId(), req.GetVirtioBlk().GetVolumeNameRef())
+	return &pb.VirtioBlk{Name: name}, err
+}
+
+func (x *fakeXPU) DeleteVirtioBlk(_ context.Context, req *pb.DeleteVirtioBlkRequest) (*emptypb.Empty, error) {
+	return x.delete(req.GetName())
+}
+
+// startFakeXPU serves a fake xPU on a local port, returns its address
+func startFakeXPU(t *testing.T) (*fakeXPU, string) {
+	t.Helper()
+	xpu := &fakeXPU{objects: make(map[string]string)}
+	server := grpc.NewServer()
+	pb.RegisterNvmeRemoteControllerServiceServer(server, xpu)
+	pb.RegisterFrontendNvmeServiceServer(server, xpu)
+	pb.RegisterFrontendVirtioBlkServiceServer(server, xpu)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(lis) //nolint:errcheck // stopped by the test
+	t.Cleanup(server.Stop)
+	return xpu, lis.Addr().String()
+}
+
+func dialFakeXPU(t *testing.T, addr string) *grpc.ClientConn {
+	t.Helper()
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func fakeXPUDevices(t *testing.T) {
+	t.Helper()
+	devDir := t.TempDir()
+	xpuPhysicalFunction = func(int) (pf, vf uint32, err error) { return 0, 3, nil }
+	xpuNvmeDevice = func(model, bdf string) (string, error) {
+		return filepath.Join(devDir, "nvme-"+model+"-"+bdf), nil
+	}
+	xpuVirtioBlkDevice = func(bdf string, _ bool) (string, error) {
+		return filepath.Join(devDir, "vd-"+bdf), nil
+	}
+	t.Cleanup(func() {
+		xpuPhysicalFunction = GetAvailablePhysicalFunction
+		xpuNvmeDevice = GetNvmeDeviceName
+		xpuVirtioBlkDevice = GetVirtioBlkDeviceName
+	})
+}
+
+func TestXPUInitiator(t *testing.T) {
+	fakeXPUDevices(t)
+	const lvolID = "8e2dcb9d-3a79-4362-965e-fdb0cd3f4b8d"
+	volumeContext := map[string]string{
+		"targetType":  "tcp",
+		"nqn":         "nqn.2023-02.io.simplyblock:cluster1:lvol:" + lvolID,
+		"nsId":        "1",
+		"connections": `[{"ip":"192.168.1.10","port":4420},{"ip":"192.168.1.11","port":4420}]`,
+	}
+
+	testCases := []struct {
+		targetType string
+		devicePath string
+		objects    []string
+	}{
+		{
+			XPUTargetTypeOPINVMe,
+			"nvme-" + lvolID + "-0000:01:03.0",
+			[]string{
+				"nvmeRemoteControllers/spdkcsi-" + lvolID,
+				"nvmeRemoteControllers/spdkcsi-" + lvolID + "/nvmePaths/spdkcsi-" + lvolID + "-0",
+				"nvmeRemoteControllers/spdkcsi-" + lvolID + "/nvmePaths/spdkcsi-" + lvolID + "-1",
+				"nvmeSubsystems/spdkcsi-" + lvolID,
+				"nvmeSubsystems/spdkcsi-" + lvolID + "/nvmeControllers/spdkcsi-" + lvolID,
+				"nvmeSubsystems/spdkcsi-" + lvolID + "/nvmeNamespaces/spdkcsi-" + lvolID,
+			},
+		},
+		{
+			XPUTargetTypeOPIVirtioBlk,
+			"vd-0000:01:03.0",
+			[]string{
+				"nvmeRemoteControllers/spdkcsi-" + lvolID,
+				"nvmeRemoteControllers/spdkcsi-" + lvolID + "/nvmePaths/spdkcsi-" + lvolID + "-0",
+				"nvmeRemoteControllers/spdkcsi-" + lvolID + "/nvmePaths/spdkcsi-" + lvolID + "-1",
+				"virtioBlks/spdkcsi-" + lvolID,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.targetType, func(t *testing.T) {
+			xpu, addr := startFakeXPU(t)
+			conn := dialFakeXPU(t, addr)
+			initiator, err := NewXPUInitiator(conn, tc.targetType, 1, volumeContext, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			devicePath, err := initiator.Connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Base(devicePath) != tc.devicePath {
+				t.Errorf("device path %s, want %s", devicePath, tc.devicePath)
+			}
+			if got := xpu.names(); !reflect.DeepEqual(got, tc.objects) {
+				t.Errorf("xPU objects %v, want %v", got, tc.objects)
+			}
+			// staging again finds the existing objects
+			if _, err = initiator.Connect(); err != nil {
+				t.Fatalf("connect is not idempotent: %v", err)
+			}
+
+			// unstage only knows the stashed contexts
+			staged, err := NewXPUInitiator(conn, tc.targetType, 1, volumeContext, initiator.Context())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := staged.Disconnect(); err != nil {
+				t.Fatal(err)
+			}
+			if got := xpu.names(); len(got) > 0 {
+				t.Errorf("xPU objects left after disconnect: %v", got)
+			}
+		})
+	}
+
+	t.Run("failed expose", func(t *testing.T) {
+		xpu, addr := startFakeXPU(t)
+		conn := dialFakeXPU(t, addr)
+		xpu.failVirtioBlk = true
+		initiator, err := NewXPUInitiator(conn, XPUTargetTypeOPIVirtioBlk, 1, volumeContext, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := initiator.Connect(); status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("connect error %v", err)
+		}
+		if got := xpu.names(); len(got) > 0 {
+			t.Errorf("xPU objects left after failed connect: %v", got)
+		}
+	})
+
+	if _, err := NewXPUInitiator(nil, XPUTargetTypeOPINVMe, 1, map[string]string{"targetType": TargetTypeCache}, nil); err == nil {
+		t.Error("cache volume attached through an xPU")
+	}
+}
@@ -0,0 +1,371 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/opiproject/opi-api/storage/v1alpha1/gen/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+const (
+	xpuHealthCheckInterval = 10 * time.Second
+	xpuHealthCheckTimeout  = 5 * time.Second
+	// xpuLoadPageSize bounds the remote controllers counted as load
+	xpuLoadPageSize = 1000
+)
+
+// xpuStaleDir keeps the volumes unstaged while their xPU was unhealthy,
+// replaced by tests
+var xpuStaleDir = "/var/lib/spdkcsi/xpu-stale"
+
+// XPUConfig is an xPU in the xpuList of the node server config
+//
+//nolint:tagliatelle // not using json:snake case
+type XPUConfig struct {
+	Name       string `json:"name"`
+	TargetType string `json:"targetType"`
+	TargetAddr string `json:"targetAddr"`
+}
+
+// xpuNode is a configured xPU and its last health check
+type xpuNode struct {
+	XPUConfig
+	conn    *grpc.ClientConn
+	healthy bool
+	// load is the number of volumes connected on the xPU
+	load int
+}
+
+// XPUPool keeps connections to all configured xPUs of the node, checks
+// their health and picks the xPU of every staged volume
+type XPUPool struct {
+	kvmPciBridges int
+
+	mu   sync.Mutex
+	xpus []*xpuNode
+	// staleMu serializes removing stale volumes and staging them again
+	staleMu sync.Mutex
+}
+
+// NewXPUPool connects to the xPUs, invalid ones are skipped. It returns nil
+// if no xPU is left.
+func NewXPUPool(configs []XPUConfig, kvmPciBridges int) *XPUPool {
+	p := &XPUPool{kvmPciBridges: kvmPciBridges}
+	names := make(map[string]struct{}, len(configs))
+	for i := range configs {
+		config := configs[i]
+		if config.TargetAddr == "" || !IsXPUTargetType(config.TargetType) {
+			klog.Errorf("unsupported xPU TargetType %q or missing TargetAddr in xPUList index %d, skipping this xPU node", config.TargetType, i)
+			continue
+		}
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("xPU%d", i)
+		}
+		if _, ok := names[config.Name]; ok {
+			klog.Errorf("duplicate xPU name %s in xPUList index %d, skipping this xPU node", config.Name, i)
+			continue
+		}
+		names[config.Name] = struct{}{}
+		// the connection is kept up in the background, a lost xPU is
+		// reconnected once it is back
+		conn, err := grpc.Dial(
+			config.TargetAddr,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:                10 * time.Second,
+				Timeout:             1 * time.Second,
+				PermitWithoutStream: true,
+			}),
+		)
+		if err != nil {
+			klog.Errorf("failed to set up connection to xPU node %s at %s: %v", config.Name, config.TargetAddr, err)
+			continue
+		}
+		klog.Infof("using xPU node %s at %s with TargetType %s", config.Name, config.TargetAddr, config.TargetType)
+		p.xpus = append(p.xpus, &xpuNode{XPUConfig: config, conn: conn})
+	}
+	if len(p.xpus) == 0 {
+		return nil
+	}
+	p.checkHealth(context.Background())
+	return p
+}
+
+// Run checks the health of the xPUs until ctx is done
+func (p *XPUPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(xpuHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkHealth(ctx)
+		}
+	}
+}
+
+// checkHealth asks every xPU for its remote controllers, an xPU that
+// answers is healthy and has as many volumes as remote controllers
+func (p *XPUPool) checkHealth(ctx context.Context) {
+	p.mu.Lock()
+	xpus := append([]*xpuNode(nil), p.xpus...)
+	p.mu.Unlock()
+
+	for _, x := range xpus {
+		callCtx, cancel := context.WithTimeout(ctx, xpuHealthCheckTimeout)
+		resp, err := pb.NewNvmeRemoteControllerServiceClient(x.conn).ListNvmeRemoteControllers(callCtx,
+			&pb.ListNvmeRemoteControllersRequest{PageSize: xpuLoadPageSize})
+		cancel()
+
+		p.mu.Lock()
+		wasHealthy := x.healthy
+		x.healthy = err == nil
+		if err == nil {
+			x.load = len(resp.GetNvmeRemoteControllers())
+		}
+		p.mu.Unlock()
+
+		switch {
+		case err != nil && wasHealthy:
+			klog.Errorf("xPU node %s at %s is unhealthy: %v", x.Name, x.TargetAddr, err)
+		case err != nil:
+			klog.V(4).Infof("xPU node %s at %s is still unhealthy: %v", x.Name, x.TargetAddr, err)
+		case !wasHealthy:
+			klog.Infof("xPU node %s at %s is healthy, %d volumes connected", x.Name, x.TargetAddr, x.load)
+		}
+		xpuHealthyGauge.WithLabelValues(x.Name).Set(boolToFloat(err == nil))
+		if err == nil {
+			p.releaseStaleVolumes(x)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// find returns the xPU with the name, nil if it is not configured
+func (p *XPUPool) find(name string) *xpuNode {
+	for _, x := range p.xpus {
+		if x.Name == name {
+			return x
+		}
+	}
+	return nil
+}
+
+// IsHealthy returns whether the xPU passed its last health check
+func (p *XPUPool) IsHealthy(name string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	x := p.find(name)
+	return x != nil && x.healthy
+}
+
+// selectXPU picks the healthy xPU with the least volumes, or the pinned
+// one. The volume is counted right away so concurrent stages spread.
+func (p *XPUPool) selectXPU(pinned string) (*xpuNode, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pinned != "" {
+		x := p.find(pinned)
+		if x == nil {
+			return nil, fmt.Errorf("xPU %s is not configured on this node", pinned)
+		} else if !x.healthy {
+			return nil, fmt.Errorf("xPU %s is unhealthy", pinned)
+		}
+		x.load++
+		return x, nil
+	}
+	var best *xpuNode
+	for _, x := range p.xpus {
+		if x.healthy && (best == nil || x.load < best.load) {
+			best = x
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no healthy xPU")
+	}
+	best.load++
+	return best, nil
+}
+
+// NewInitiator creates the initiator of a volume to stage through the xPU
+// picked for it, the choice is recorded in its XPU context. The xpu_name
+// storage class parameter pins volumes to an xPU.
+func (p *XPUPool) NewInitiator(volumeContext map[string]string) (*XPUInitiator, error) {
+	x, err := p.selectXPU(volumeContext["xpu_name"])
+	if err != nil {
+		return nil, err
+	}
+	initiator, err := NewXPUInitiator(x.conn, x.TargetType, p.kvmPciBridges, volumeContext, nil)
+	if err != nil {
+		return nil, err
+	}
+	initiator.context["xpu"] = x.Name
+
+	// a stale volume staged on the same xPU again reuses its objects
+	p.staleMu.Lock()
+	defer p.staleMu.Unlock()
+	var stale staleXPUState
+	key := staleXPUKey(x.Name, volumeContext["volumeID"])
+	if found, err := lookupNQNState(xpuStaleDir, key, &stale); err != nil {
+		return nil, fmt.Errorf("failed to read volume of unhealthy xPU: %w", err)
+	} else if found {
+		if err := cleanUpNQNState(xpuStaleDir, key); err != nil {
+			return nil, err
+		}
+	}
+	klog.Infof("staging volume %s through xPU %s", volumeContext["volumeID"], x.Name)
+	return initiator, nil
+}
+
+// StagedInitiator returns the initiator of a volume staged through the xPU
+// recorded in its XPU context. Volumes of an unhealthy or removed xPU are
+// released without it, their objects are removed once it is healthy again.
+// A nil pool, on a node without xPUs now, releases all volumes that way.
+func (p *XPUPool) StagedInitiator(volumeContext, xpuContext map[string]string) (SpdkCsiInitiator, error) {
+	if p == nil {
+		return &staleXPUVolume{volumeContext: volumeContext, xpuContext: xpuContext}, nil
+	}
+	p.mu.Lock()
+	x := p.find(xpuContext["xpu"])
+	if x == nil && xpuContext["xpu"] == "" {
+		// staged before the choice was recorded, with the only xPU used then
+		for _, candidate := range p.xpus {
+			if candidate.TargetType == volumeContext["targetType"] {
+				x = candidate
+				break
+			}
+		}
+	}
+	healthy := x != nil && x.healthy
+	p.mu.Unlock()
+
+	if !healthy {
+		return &staleXPUVolume{volumeContext: volumeContext, xpuContext: xpuContext}, nil
+	}
+	return NewXPUInitiator(x.conn, x.TargetType, p.kvmPciBridges, volumeContext, xpuContext)
+}
+
+// staleXPUVolume is a volume of an unhealthy xPU
+type staleXPUVolume struct {
+	volumeContext map[string]string
+	xpuContext    map[string]string
+}
+
+// staleXPUKey keeps the stale volumes of each xPU apart
+func staleXPUKey(xpu, volumeID string) string {
+	return xpu + "/" + volumeID
+}
+
+// staleXPUState is the stashed state of a stale volume
+type staleXPUState struct {
+	VolumeContext map[string]string `json:"volume_context"`
+	XPUContext    map[string]string `json:"xpu_context"`
+}
+
+func (v *staleXPUVolume) Connect() (string, error) {
+	return "", fmt.Errorf("xPU %s of the volume is unhealthy", v.xpuContext["xpu"])
+}
+
+// Disconnect keeps the volume to remove its objects from the xPU later. The
+// xPU may still pass I/O of the volume while only its control plane is
+// unreachable, so the volume is kept staged with Unavailable as long as the
+// host sees its device, and only released once the device is gone.
+func (v *staleXPUVolume) Disconnect() error {
+	devicePath := v.xpuContext["devicePath"]
+	if devicePath == "" {
+		devicePath = v.volumeContext["devicePath"]
+	}
+	if devicePath != "" {
+		if _, err := os.Stat(devicePath); err == nil {
+			return status.Errorf(codes.Unavailable, "xPU %s of volume %s is unhealthy and its device %s is still present",
+				v.xpuContext["xpu"], v.volumeContext["volumeID"], devicePath)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to check device %s: %w", devicePath, err)
+		}
+	}
+	klog.Warningf("xPU %s of volume %s is unhealthy and its device is gone, removing the volume from it once it is back",
+		v.xpuContext["xpu"], v.volumeContext["volumeID"])
+	xpuContext := make(map[string]string, len(v.xpuContext))
+	for key, value := range v.xpuContext {
+		xpuContext[key] = value
+	}
+	// the block device name may be taken by another volume meanwhile
+	delete(xpuContext, "devicePath")
+	state := &staleXPUState{VolumeContext: v.volumeContext, XPUContext: xpuContext}
+	if err := stashNQNState(xpuStaleDir, staleXPUKey(v.xpuContext["xpu"], v.volumeContext["volumeID"]), state); err != nil {
+		return fmt.Errorf("failed to stash volume of unhealthy xPU: %w", err)
+	}
+	return nil
+}
+
+// releaseStaleVolumes removes the volumes unstaged while the xPU was
+// unhealthy from it
+func (p *XPUPool) releaseStaleVolumes(x *xpuNode) {
+	p.staleMu.Lock()
+	defer p.staleMu.Unlock()
+	keys, err := listNQNStates(xpuStaleDir)
+	if err != nil {
+		klog.Errorf("failed to list volumes of unhealthy xPUs: %v", err)
+		return
+	}
+	for _, key := range keys {
+		var stale staleXPUState
+		if _, err := lookupNQNState(xpuStaleDir, key, &stale); err != nil {
+			klog.Errorf("failed to read volume %s of unhealthy xPU: %v", key, err)
+			continue
+		}
+		if stale.XPUContext["xpu"] != x.Name {
+			continue
+		}
+		volumeID := stale.VolumeContext["volumeID"]
+		initiator, err := NewXPUInitiator(x.conn, x.TargetType, p.kvmPciBridges, stale.VolumeContext, stale.XPUContext)
+		if err == nil {
+			err = initiator.Disconnect()
+		}
+		if err != nil {
+			klog.Errorf("failed to remove volume %s from xPU %s: %v", volumeID, x.Name, err)
+			continue
+		}
+		klog.Infof("removed volume %s unstaged while xPU %s was unhealthy", volumeID, x.Name)
+		if err := cleanUpNQNState(xpuStaleDir, key); err != nil {
+			klog.Error(err)
+		}
+	}
+}
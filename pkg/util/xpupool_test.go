@@ -0,0 +1,136 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// whitebox test of the xPU selection and failover
+package util
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestXPUPool(t *testing.T) {
+	fakeXPUDevices(t)
+	xpuStaleDir = t.TempDir()
+	t.Cleanup(func() { xpuStaleDir = "/var/lib/spdkcsi/xpu-stale" })
+
+	xpuA, addrA := startFakeXPU(t)
+	xpuB, addrB := startFakeXPU(t)
+	// another volume is connected on a
+	xpuA.objects["nvmeRemoteControllers/other"] = ""
+
+	pool := NewXPUPool([]XPUConfig{
+		{Name: "a", TargetType: XPUTargetTypeOPINVMe, TargetAddr: addrA},
+		{Name: "b", TargetType: XPUTargetTypeOPIVirtioBlk, TargetAddr: addrB},
+		{Name: "sma", TargetType: "xpu-sma-nvme", TargetAddr: addrB},
+	}, 1)
+	if pool == nil || len(pool.xpus) != 2 {
+		t.Fatalf("unexpected xPUs in pool %v", pool)
+	}
+
+	volume := func(volumeID, lvolID string) map[string]string {
+		return map[string]string{
+			"targetType":  "tcp",
+			"volumeID":    volumeID,
+			"nqn":         "nqn.2023-02.io.simplyblock:cluster1:lvol:" + lvolID,
+			"connections": `[{"ip":"192.168.1.10","port":4420}]`,
+		}
+	}
+	stage := func(volumeContext map[string]string) *XPUInitiator {
+		t.Helper()
+		initiator, err := pool.NewInitiator(volumeContext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := initiator.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		return initiator
+	}
+
+	// the least loaded xPU is picked
+	vol1 := volume("vol1", "lvol1")
+	staged1 := stage(vol1)
+	if xpu := staged1.Context()["xpu"]; xpu != "b" {
+		t.Errorf("volume staged through %s, want b", xpu)
+	}
+	if targetType := staged1.Context()["targetType"]; targetType != XPUTargetTypeOPIVirtioBlk {
+		t.Errorf("target type %s recorded", targetType)
+	}
+	// or the pinned one
+	vol2 := volume("vol2", "lvol2")
+	vol2["xpu_name"] = "a"
+	if xpu := stage(vol2).Context()["xpu"]; xpu != "a" {
+		t.Errorf("pinned volume staged through %s", xpu)
+	}
+
+	xpuB.mu.Lock()
+	xpuB.down = true
+	xpuB.mu.Unlock()
+	pool.checkHealth(context.Background())
+	if pool.IsHealthy("b") || !pool.IsHealthy("a") {
+		t.Fatal("health of the xPUs not updated")
+	}
+	pinned := volume("vol3", "lvol3")
+	pinned["xpu_name"] = "b"
+	if _, err := pool.NewInitiator(pinned); err == nil {
+		t.Error("volume pinned to an unhealthy xPU staged")
+	}
+
+	// the volume is kept while its device may still pass I/O
+	devicePath := staged1.Context()["devicePath"]
+	mustWrite(t, devicePath, "")
+	initiator, err := pool.StagedInitiator(vol1, staged1.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.Disconnect(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("volume with device released from the failed xPU: %v", err)
+	}
+	if keys, _ := listNQNStates(xpuStaleDir); len(keys) > 0 {
+		t.Errorf("volume with device left for removal: %v", keys)
+	}
+	// and released from the failed xPU once the device is gone, to be
+	// staged again through the other one
+	if err := os.Remove(devicePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if xpu := stage(vol1).Context()["xpu"]; xpu != "a" {
+		t.Errorf("volume moved to %s, want a", xpu)
+	}
+
+	// and removed from the failed xPU once it is back
+	xpuB.mu.Lock()
+	xpuB.down = false
+	xpuB.mu.Unlock()
+	pool.checkHealth(context.Background())
+	if objects := xpuB.names(); len(objects) > 0 {
+		t.Errorf("objects of moved volume left on the xPU: %v", objects)
+	}
+	if keys, _ := listNQNStates(xpuStaleDir); len(keys) > 0 {
+		t.Errorf("stale volumes left: %v", keys)
+	}
+	if len(xpuA.names()) != 1+2*5 {
+		t.Errorf("unexpected objects on the other xPU: %v", xpuA.names())
+	}
+}
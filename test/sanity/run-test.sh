@@ -16,20 +16,18 @@
 
 set -eo pipefail
 
+readonly OUT_DIR=_out
+readonly endpoint='unix:///tmp/csi.sock'
+readonly simulator_address='127.0.0.1:8080'
+readonly secret_file="$(pwd)/${OUT_DIR}/sanity-secret.json"
+
 function cleanup {
-  echo 'pkill -f smbplugin'
-  if [ -z "$GITHUB_ACTIONS" ]
-  then
-    # if not running on github actions, do not use sudo
-    pkill -f smbplugin
-  else
-    # if running on github actions, use sudo
-    sudo pkill -f smbplugin
-  fi
+  echo 'Stopping spdkcsi and simulator'
+  pkill -f "${OUT_DIR}/spdkcsi" || true
+  pkill -f "${OUT_DIR}/simulator" || true
   echo 'Deleting CSI sanity test binary'
   rm -rf csi-test
-  echo 'Uninstalling samba server on localhost'
-  docker rm samba -f
+  rm -f "$secret_file"
 }
 
 trap cleanup EXIT
@@ -47,8 +45,9 @@ function install_csi_sanity_bin {
 }
 
 function provision_simplyblock_cluster {
-  echo 'Running samba server on localhost'
-  docker run -e PERMISSIONS=0777 -p 445:445 --name samba -d andyzhangx/samba:win-fix -s "share;/smbshare/;yes;no;no;all;none" -u "sanity;sanitytestpassword" -p
+  echo "Running SimplyBlock management API simulator on ${simulator_address}"
+  "${OUT_DIR}/simulator" --listen "$simulator_address" --pools pool01 --secret-file "$secret_file" &
+  sleep 1
 }
 
 provision_simplyblock_cluster
@@ -57,37 +56,19 @@ if [[ -z "$(command -v csi-sanity)" ]]; then
 	install_csi_sanity_bin
 fi
 
-readonly endpoint='unix:///tmp/csi.sock'
 nodeid='CSINode'
 if [[ "$#" -gt 0 ]] && [[ -n "$1" ]]; then
   nodeid="$1"
 fi
 
-ARCH=$(uname -p)
-if [[ "${ARCH}" == "x86_64" || ${ARCH} == "unknown" ]]; then
-  ARCH="amd64"
-fi
+# only the controller runs against the simulator, node tests need a real
+# NVMe-oF target
+SPDKCSI_SECRET="$secret_file" "${OUT_DIR}/spdkcsi" --controller --endpoint "$endpoint" --nodeid "$nodeid" -v=5 &
 
-if [ -z "$GITHUB_ACTIONS" ]
-then
-  # if not running on github actions, do not use sudo
-  _output/${ARCH}/smbplugin --endpoint "$endpoint" --nodeid "$nodeid" -v=5 &
-else
-  # if running on github actions, use sudo
-  sudo _output/${ARCH}/smbplugin --endpoint "$endpoint" --nodeid "$nodeid" -v=5 &
-fi
-
-# sleep a while waiting for azurefileplugin start up
+# sleep a while waiting for spdkcsi start up
 sleep 1
 
 echo 'Begin to run sanity test...'
 CSI_SANITY_BIN=$GOPATH/bin/csi-sanity
-skipTests='create a volume with already existing name and different capacity|should fail when requesting to create a volume with already existing name and different capacity|should fail when the requested volume does not exist'
-if [ -z "$GITHUB_ACTIONS" ]
-then
-  # if not running on github actions, do not use sudo
-  "$CSI_SANITY_BIN" --ginkgo.v --csi.secrets="$(pwd)/test/sanity/secrets.yaml" --csi.testvolumeparameters="$(pwd)/test/sanity/params.yaml" --csi.endpoint="$endpoint" --ginkgo.skip="$skipTests"
-else
-  # if running on github actions, use sudo
-  sudo "$CSI_SANITY_BIN" --ginkgo.v --csi.secrets="$(pwd)/test/sanity/secrets.yaml" --csi.testvolumeparameters="$(pwd)/test/sanity/params.yaml" --csi.endpoint="$endpoint" --ginkgo.skip="$skipTests"
-fi
+skipTests='Node Service|should fail when the requested volume does not exist'
+"$CSI_SANITY_BIN" --ginkgo.v --csi.secrets="$(pwd)/test/sanity/secrets.yaml" --csi.testvolumeparameters="$(pwd)/test/sanity/params.yaml" --csi.endpoint="$endpoint" --ginkgo.skip="$skipTests"